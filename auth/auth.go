@@ -0,0 +1,237 @@
+// Package auth handles API keys and the access tokens issued from them
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"billingo/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	ScopeReadUsage       Scope = "usage:read"
+	ScopeManageCustomers Scope = "customers:manage"
+	ScopeReadInvoices    Scope = "invoices:read"
+	ScopeManageInvoices  Scope = "invoices:manage"
+	// ScopeReadMetrics reads the per-VM usage exported on /metrics/vms
+	ScopeReadMetrics Scope = "metrics:read"
+	ScopeAdmin       Scope = "admin"
+)
+
+// Scopes lists every known scope
+var Scopes = []Scope{ScopeReadUsage, ScopeManageCustomers, ScopeReadInvoices, ScopeManageInvoices, ScopeReadMetrics, ScopeAdmin}
+
+// TenantScopes lists the scopes a key bound to a customer may be granted
+var TenantScopes = []Scope{ScopeReadUsage, ScopeReadInvoices}
+
+const keyPrefix = "bgo"
+
+var (
+	ErrInvalidKey   = errors.New("invalid api key")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Claims are the JWT claims of an access token. The subject is the ID of the
+// API key the token was issued from.
+type Claims struct {
+	Scopes     []string `json:"scopes"`
+	CustomerID *uint    `json:"customer_id,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// KeyID returns the ID of the API key the token was issued from
+func (c *Claims) KeyID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	return uint(id), nil
+}
+
+// Principal is the identity behind an authenticated request. A principal with
+// a CustomerID is a tenant and only sees the VMs owned by that customer.
+type Principal struct {
+	KeyID      uint
+	Scopes     []string
+	CustomerID *uint
+}
+
+// HasScope reports whether the principal was granted the scope. The admin scope grants everything.
+func (p *Principal) HasScope(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == string(scope) || s == string(ScopeAdmin) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTenant reports whether the principal is restricted to a customer
+func (p *Principal) IsTenant() bool {
+	return p.CustomerID != nil
+}
+
+// ParseScopes validates a comma separated list of scopes and returns it normalized
+func ParseScopes(raw string) (string, error) {
+	var scopes []string
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		known := false
+		for _, scope := range Scopes {
+			if s == string(scope) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("unknown scope %q", s)
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("at least one scope is required")
+	}
+	return strings.Join(scopes, ","), nil
+}
+
+// NewAPIKey generates a new key in the form bgo_<prefix>_<secret>. It returns
+// the plain key, to be shown once to the user, and the prefix and hash to be stored.
+func NewAPIKey() (plain, prefix, hash string, err error) {
+	buf := make([]byte, 28)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(buf[:4])
+	plain = fmt.Sprintf("%s_%s_%s", keyPrefix, prefix, hex.EncodeToString(buf[4:]))
+	return plain, prefix, HashKey(plain), nil
+}
+
+// NewSitePassword generates the password an edge site authenticates with on
+// the broker. It returns the plain password, to be shown once, and its hash.
+func NewSitePassword() (plain, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	plain = hex.EncodeToString(buf)
+	return plain, HashKey(plain), nil
+}
+
+// CreateKey creates an API key from the given name and scopes, persisting only
+// its hash. The plain key is part of the response and cannot be retrieved again.
+// A key created for a customer is limited to the tenant scopes.
+func CreateKey(db *gorm.DB, name, scopes string, customerID *uint, expiresAt *time.Time) (*models.APIKey, string, error) {
+	scopes, err := ParseScopes(scopes)
+	if err != nil {
+		return nil, "", err
+	}
+	if customerID != nil {
+		if err := checkTenantScopes(scopes); err != nil {
+			return nil, "", err
+		}
+		if err := db.First(&models.Customer{}, *customerID).Error; err != nil {
+			return nil, "", fmt.Errorf("customer %d not found", *customerID)
+		}
+	}
+	plain, prefix, hash, err := NewAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	key := models.APIKey{
+		Name:       name,
+		Prefix:     prefix,
+		Hash:       hash,
+		Scopes:     scopes,
+		CustomerID: customerID,
+		ExpiresAt:  expiresAt,
+	}
+	if err := db.Create(&key).Error; err != nil {
+		return nil, "", err
+	}
+	return &key, plain, nil
+}
+
+func checkTenantScopes(scopes string) error {
+	for _, s := range strings.Split(scopes, ",") {
+		allowed := false
+		for _, scope := range TenantScopes {
+			if s == string(scope) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("scope %q cannot be granted to a customer key", s)
+		}
+	}
+	return nil
+}
+
+// HashKey returns the stored representation of a plain key
+func HashKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyPrefix extracts the lookup prefix of a plain key
+func KeyPrefix(plain string) (string, error) {
+	parts := strings.Split(plain, "_")
+	if len(parts) != 3 || parts[0] != keyPrefix {
+		return "", ErrInvalidKey
+	}
+	return parts[1], nil
+}
+
+// VerifyKey checks a plain key against the stored key
+func VerifyKey(plain string, key *models.APIKey) bool {
+	return subtle.ConstantTimeCompare([]byte(HashKey(plain)), []byte(key.Hash)) == 1
+}
+
+// GenerateToken issues an access token for the key signed with the secret
+func GenerateToken(secret string, key *models.APIKey, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(expiresAt) {
+		expiresAt = *key.ExpiresAt
+	}
+	claims := Claims{
+		Scopes:     key.ScopeList(),
+		CustomerID: key.CustomerID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(key.ID), 10),
+			Issuer:    "billingo",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	return signed, expiresAt, err
+}
+
+// ParseToken validates the signature and expiry of a token and returns its claims
+func ParseToken(secret, token string) (*Claims, error) {
+	claims := &Claims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer("billingo"))
+	if err != nil || !parsed.Valid {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,114 @@
+package billing
+
+import (
+	"billingo/models"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ValidateCommitment checks that a commitment is of a metric accumulated over
+// time, the committed quantity being per hour
+func ValidateCommitment(commitment models.Commitment) error {
+	var errs []error
+	if !slices.Contains(timeMetrics, commitment.Metric) {
+		errs = append(errs, fmt.Errorf("metric must be one of %v", timeMetrics))
+	}
+	if commitment.Quantity <= 0 {
+		errs = append(errs, errors.New("quantity must be positive"))
+	}
+	if commitment.UnitPrice < 0 {
+		errs = append(errs, errors.New("unit_price must not be negative"))
+	}
+	if !commitment.EndTime.After(commitment.StartTime) {
+		errs = append(errs, errors.New("end_time must be after start_time"))
+	}
+	return errors.Join(errs...)
+}
+
+// applyCommitments adds the lines of the committed use over the period. The
+// usage covered by a commitment is credited at the average price of the plan
+// and charged at the committed price, the committed quantity not used is
+// charged as a shortfall.
+func applyCommitments(commitments []models.Commitment, usage []HourlyUsage, rated []RatedUsage, from, to time.Time) []RatedUsage {
+	// The usage already covered by a commitment, per metric
+	consumed := map[string]float64{}
+	var lines []RatedUsage
+	for _, commitment := range commitments {
+		start, end := commitment.StartTime, commitment.EndTime
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		committed := commitment.Quantity * end.Sub(start).Hours()
+
+		used := 0.0
+		for _, hour := range usage {
+			at := hour.Hour
+			if at.Before(from) {
+				at = from
+			}
+			if !at.Before(start) && at.Before(end) {
+				used += hour.Quantities[commitment.Metric]
+			}
+		}
+		covered := min(max(used-consumed[commitment.Metric], 0), committed)
+		consumed[commitment.Metric] += covered
+
+		quantity, amount := 0.0, 0.0
+		for _, line := range rated {
+			if line.Metric == commitment.Metric && line.VM.VMID != 0 {
+				quantity += line.Quantity
+				amount += line.Amount
+			}
+		}
+		planPrice := 0.0
+		if quantity > 0 {
+			planPrice = amount / quantity
+		}
+
+		description := commitment.Description
+		if description == "" {
+			description = fmt.Sprintf("Committed use of %g %s", commitment.Quantity, commitment.Metric)
+		}
+		if covered > 0 {
+			credit := RoundAmount(covered * planPrice)
+			for i, line := range rated {
+				if line.Metric == commitment.Metric && line.VM.VMID != 0 && amount > 0 {
+					rated[i].credited += credit * line.Amount / amount
+				}
+			}
+			lines = append(lines,
+				RatedUsage{
+					Metric:      MetricCommitment,
+					Description: description + ": usage credited at the plan price",
+					Quantity:    covered,
+					UnitPrice:   -planPrice,
+					Amount:      -credit,
+				},
+				RatedUsage{
+					Metric:      MetricCommitment,
+					Description: description + ": usage at the committed price",
+					Quantity:    covered,
+					UnitPrice:   commitment.UnitPrice,
+					Amount:      RoundAmount(covered * commitment.UnitPrice),
+				})
+		}
+		if shortfall := committed - covered; shortfall > 0 {
+			lines = append(lines, RatedUsage{
+				Metric:      MetricCommitment,
+				Description: description + ": shortfall",
+				Quantity:    shortfall,
+				UnitPrice:   commitment.UnitPrice,
+				Amount:      RoundAmount(shortfall * commitment.UnitPrice),
+			})
+		}
+	}
+	return append(rated, lines...)
+}
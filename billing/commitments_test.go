@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"billingo/models"
+	"testing"
+	"time"
+)
+
+func TestApplyCommitments(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(10 * time.Hour)
+	vm := models.NewVMKey(nil, "pve", 101)
+	// hourly is the CPU usage of the VM in each hour of the period
+	hourly := func(quantity float64) []HourlyUsage {
+		var usage []HourlyUsage
+		for hour := from; hour.Before(to); hour = hour.Add(time.Hour) {
+			usage = append(usage, HourlyUsage{VM: vm, Hour: hour, Seconds: 3600, Quantities: map[string]float64{MetricCPUHours: quantity}})
+		}
+		return usage
+	}
+	// rated are the lines of the usage of the VM at 0.1 per CPU hour
+	rated := func(quantity float64) []RatedUsage {
+		return []RatedUsage{
+			{VM: vm, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: quantity, UnitPrice: 0.1, Amount: quantity * 0.1},
+			{Metric: MetricFee, Description: "Fee of the plan basic", Quantity: 1, UnitPrice: 5, Amount: 5},
+		}
+	}
+	commitment := func(quantity float64, start, end time.Time) models.Commitment {
+		return models.Commitment{Metric: MetricCPUHours, Quantity: quantity, UnitPrice: 0.05, StartTime: start, EndTime: end}
+	}
+	const description = "Committed use of 1 cpu_hours"
+
+	tests := []struct {
+		name        string
+		commitments []models.Commitment
+		usage       float64
+		want        []RatedUsage
+		credited    float64
+	}{
+		{
+			name:        "usage above the commitment",
+			commitments: []models.Commitment{commitment(1, from, to)},
+			usage:       1.5,
+			want: []RatedUsage{
+				{Metric: MetricCommitment, Description: description + ": usage credited at the plan price", Quantity: 10, UnitPrice: -0.1, Amount: -1},
+				{Metric: MetricCommitment, Description: description + ": usage at the committed price", Quantity: 10, UnitPrice: 0.05, Amount: 0.5},
+			},
+			credited: 1,
+		},
+		{
+			name:        "shortfall",
+			commitments: []models.Commitment{commitment(1, from, to)},
+			usage:       0.5,
+			want: []RatedUsage{
+				{Metric: MetricCommitment, Description: description + ": usage credited at the plan price", Quantity: 5, UnitPrice: -0.1, Amount: -0.5},
+				{Metric: MetricCommitment, Description: description + ": usage at the committed price", Quantity: 5, UnitPrice: 0.05, Amount: 0.25},
+				{Metric: MetricCommitment, Description: description + ": shortfall", Quantity: 5, UnitPrice: 0.05, Amount: 0.25},
+			},
+			credited: 0.5,
+		},
+		{
+			name:        "no usage",
+			commitments: []models.Commitment{commitment(1, from, to)},
+			want: []RatedUsage{
+				{Metric: MetricCommitment, Description: description + ": shortfall", Quantity: 10, UnitPrice: 0.05, Amount: 0.5},
+			},
+		},
+		{
+			name:        "clipped to the period",
+			commitments: []models.Commitment{commitment(1, from.Add(5*time.Hour), to.Add(24*time.Hour))},
+			usage:       0.5,
+			want: []RatedUsage{
+				{Metric: MetricCommitment, Description: description + ": usage credited at the plan price", Quantity: 2.5, UnitPrice: -0.1, Amount: -0.25},
+				{Metric: MetricCommitment, Description: description + ": usage at the committed price", Quantity: 2.5, UnitPrice: 0.05, Amount: 0.13},
+				{Metric: MetricCommitment, Description: description + ": shortfall", Quantity: 2.5, UnitPrice: 0.05, Amount: 0.13},
+			},
+			credited: 0.25,
+		},
+		{
+			name:        "outside the period",
+			commitments: []models.Commitment{commitment(1, to, to.Add(time.Hour))},
+			usage:       1,
+		},
+		{
+			name:        "usage covered once by several commitments",
+			commitments: []models.Commitment{commitment(1, from, to), commitment(1, from, to)},
+			usage:       1.5,
+			want: []RatedUsage{
+				{Metric: MetricCommitment, Description: description + ": usage credited at the plan price", Quantity: 10, UnitPrice: -0.1, Amount: -1},
+				{Metric: MetricCommitment, Description: description + ": usage at the committed price", Quantity: 10, UnitPrice: 0.05, Amount: 0.5},
+				{Metric: MetricCommitment, Description: description + ": usage credited at the plan price", Quantity: 5, UnitPrice: -0.1, Amount: -0.5},
+				{Metric: MetricCommitment, Description: description + ": usage at the committed price", Quantity: 5, UnitPrice: 0.05, Amount: 0.25},
+				{Metric: MetricCommitment, Description: description + ": shortfall", Quantity: 5, UnitPrice: 0.05, Amount: 0.25},
+			},
+			credited: 1.5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := rated(test.usage * 10)
+			got := applyCommitments(test.commitments, hourly(test.usage), lines, from, to)
+			checkLines(t, got[:len(lines)], rated(test.usage*10))
+			checkLines(t, got[len(lines):], test.want)
+			if !near(got[0].credited, test.credited) || got[1].credited != 0 {
+				t.Errorf("credited %g and %g, want %g and 0", got[0].credited, got[1].credited, test.credited)
+			}
+		})
+	}
+}
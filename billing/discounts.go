@@ -0,0 +1,157 @@
+package billing
+
+import (
+	"billingo/models"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrCouponInvalid is returned for a coupon code that does not exist, has
+	// expired or was redeemed as many times as allowed
+	ErrCouponInvalid = errors.New("invalid or expired coupon")
+	// ErrCouponRedeemed is returned when the customer already redeemed the coupon
+	ErrCouponRedeemed = errors.New("the coupon was already redeemed by the customer")
+)
+
+// ValidateDiscount checks the reduction and the scope of a discount or coupon
+func ValidateDiscount(percent, amount float64, metric string) error {
+	var errs []error
+	if (percent == 0) == (amount == 0) {
+		errs = append(errs, errors.New("either percent or amount is required"))
+	}
+	if percent < 0 || percent > 100 {
+		errs = append(errs, errors.New("percent must be between 0 and 100"))
+	}
+	if amount < 0 {
+		errs = append(errs, errors.New("amount must not be negative"))
+	}
+	if metric != "" && !slices.Contains(Metrics, metric) && metric != MetricFee && metric != MetricMinimumCharge {
+		errs = append(errs, fmt.Errorf("unknown metric %q", metric))
+	}
+	return errors.Join(errs...)
+}
+
+// RedeemCoupon grants the discount of a coupon to the customer from now
+func RedeemCoupon(db *gorm.DB, customerID uint, code string, now time.Time) (*models.Discount, error) {
+	var discount models.Discount
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Serializes the redemptions of the coupon against its limit
+		var coupons []models.Coupon
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", strings.TrimSpace(code)).Limit(1).Find(&coupons).Error
+		if err != nil {
+			return err
+		}
+		if len(coupons) == 0 {
+			return ErrCouponInvalid
+		}
+		coupon := coupons[0]
+		if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+			return ErrCouponInvalid
+		}
+		if coupon.MaxRedemptions > 0 && coupon.Redemptions >= coupon.MaxRedemptions {
+			return ErrCouponInvalid
+		}
+		var redeemed int64
+		if err := tx.Model(&models.Discount{}).Where("coupon_id = ? AND customer_id = ?", coupon.ID, customerID).Count(&redeemed).Error; err != nil {
+			return err
+		}
+		if redeemed > 0 {
+			return ErrCouponRedeemed
+		}
+
+		description := coupon.Description
+		if description == "" {
+			description = "Coupon " + coupon.Code
+		}
+		discount = models.Discount{
+			CustomerID:  &customerID,
+			Plan:        coupon.Plan,
+			Metric:      coupon.Metric,
+			Description: description,
+			Percent:     coupon.Percent,
+			Amount:      coupon.Amount,
+			ValidFrom:   now,
+			CouponID:    &coupon.ID,
+		}
+		if coupon.DurationDays > 0 {
+			validTo := now.AddDate(0, 0, coupon.DurationDays)
+			discount.ValidTo = &validTo
+		}
+		if err := tx.Create(&discount).Error; err != nil {
+			return err
+		}
+		return tx.Model(&coupon).Update("redemptions", gorm.Expr("redemptions + 1")).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &discount, nil
+}
+
+// applyDiscounts adds a line for each discount valid during the period. The
+// reductions are prorated to the part of the period the discount is valid,
+// and never exceed the lines they apply to nor the total of the invoice.
+func applyDiscounts(discounts []models.Discount, rated []RatedUsage, from, to time.Time) []RatedUsage {
+	total := 0.0
+	for _, line := range rated {
+		total += line.Amount
+	}
+	var lines []RatedUsage
+	for _, discount := range discounts {
+		start, end := discount.ValidFrom, to
+		if start.Before(from) {
+			start = from
+		}
+		if discount.ValidTo != nil && discount.ValidTo.Before(end) {
+			end = *discount.ValidTo
+		}
+		if !end.After(start) {
+			continue
+		}
+		share := float64(end.Sub(start)) / float64(to.Sub(from))
+
+		// The usage credited by a commitment is billed at the committed price
+		matching := 0.0
+		for _, line := range rated {
+			if line.Amount > line.credited && line.Metric != MetricCommitment &&
+				(discount.VMID == nil || line.VM.Matches(discount.SiteID, discount.Cluster, *discount.VMID)) &&
+				(discount.Plan == "" || discount.Plan == line.Plan) &&
+				(discount.Metric == "" || discount.Metric == line.Metric) {
+				matching += line.Amount - line.credited
+			}
+		}
+		reduction := RoundAmount(min((matching*discount.Percent/100+discount.Amount)*share, matching, total))
+		if reduction <= 0 {
+			continue
+		}
+		total -= reduction
+
+		description := discount.Description
+		if description == "" {
+			description = "Discount"
+		}
+		if discount.Percent > 0 {
+			description += fmt.Sprintf(" (%g%%)", discount.Percent)
+		}
+		line := RatedUsage{
+			Metric:      MetricDiscount,
+			Description: description,
+			Quantity:    1,
+			UnitPrice:   -reduction,
+			Amount:      -reduction,
+			Plan:        discount.Plan,
+		}
+		if discount.VMID != nil {
+			line.VM = models.NewVMKey(discount.SiteID, discount.Cluster, *discount.VMID)
+		}
+		lines = append(lines, line)
+	}
+	return append(rated, lines...)
+}
@@ -0,0 +1,91 @@
+package billing
+
+import (
+	"billingo/models"
+	"testing"
+	"time"
+)
+
+func TestApplyDiscounts(t *testing.T) {
+	from := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	halfway := time.Date(2024, 4, 16, 0, 0, 0, 0, time.UTC)
+	vm1, vm2 := models.NewVMKey(nil, "pve", 101), models.NewVMKey(nil, "pve", 102)
+	vmid1, vmid2 := 101, 102
+	rated := []RatedUsage{
+		{VM: vm1, Metric: MetricCPUHours, Amount: 60, Plan: "basic"},
+		{VM: vm2, Metric: MetricCPUHours, Amount: 30, Plan: "basic"},
+		{VM: vm2, Metric: MetricNetOutGB, Amount: 10, Plan: "basic"},
+		{Metric: MetricFee, Amount: 10, Plan: "basic"},
+	}
+
+	tests := []struct {
+		name      string
+		discounts []models.Discount
+		rated     []RatedUsage
+		want      []RatedUsage
+	}{
+		{
+			name:      "percent of the invoice",
+			discounts: []models.Discount{{Description: "Welcome", Percent: 10, ValidFrom: from}},
+			want:      []RatedUsage{{Metric: MetricDiscount, Description: "Welcome (10%)", Quantity: 1, UnitPrice: -11, Amount: -11}},
+		},
+		{
+			name:      "amount prorated to half the period",
+			discounts: []models.Discount{{Amount: 20, ValidFrom: halfway}},
+			want:      []RatedUsage{{Metric: MetricDiscount, Description: "Discount", Quantity: 1, UnitPrice: -10, Amount: -10}},
+		},
+		{
+			name:      "expired before the period",
+			discounts: []models.Discount{{Amount: 20, ValidFrom: from.AddDate(0, -1, 0), ValidTo: &from}},
+		},
+		{
+			name:      "percent of a metric of a VM",
+			discounts: []models.Discount{{VMID: &vmid2, Metric: MetricCPUHours, Percent: 50, ValidFrom: from}},
+			want:      []RatedUsage{{VM: models.NewVMKey(nil, "", 102), Metric: MetricDiscount, Description: "Discount (50%)", Quantity: 1, UnitPrice: -15, Amount: -15}},
+		},
+		{
+			name:      "capped by the lines it applies to",
+			discounts: []models.Discount{{VMID: &vmid1, Cluster: "pve", Amount: 100, ValidFrom: from}},
+			want:      []RatedUsage{{VM: vm1, Metric: MetricDiscount, Description: "Discount", Quantity: 1, UnitPrice: -60, Amount: -60}},
+		},
+		{
+			name:      "other plan",
+			discounts: []models.Discount{{Plan: "pro", Percent: 50, ValidFrom: from}},
+		},
+		{
+			name: "capped by the total of the invoice",
+			discounts: []models.Discount{
+				{Amount: 80, ValidFrom: from},
+				{Percent: 50, ValidFrom: from},
+				{Amount: 10, ValidFrom: from},
+			},
+			want: []RatedUsage{
+				{Metric: MetricDiscount, Description: "Discount", Quantity: 1, UnitPrice: -80, Amount: -80},
+				{Metric: MetricDiscount, Description: "Discount (50%)", Quantity: 1, UnitPrice: -30, Amount: -30},
+			},
+		},
+		{
+			name:      "usage credited by a commitment",
+			discounts: []models.Discount{{Percent: 100, ValidFrom: from}},
+			rated: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Amount: 60, credited: 20},
+				{Metric: MetricCommitment, Amount: -20},
+				{Metric: MetricCommitment, Amount: 15},
+			},
+			want: []RatedUsage{{Metric: MetricDiscount, Description: "Discount (100%)", Quantity: 1, UnitPrice: -40, Amount: -40}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := test.rated
+			if lines == nil {
+				lines = rated
+			}
+			lines = append([]RatedUsage(nil), lines...)
+			got := applyDiscounts(test.discounts, lines, from, to)
+			checkLines(t, got[:len(lines)], lines)
+			checkLines(t, got[len(lines):], test.want)
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package billing
+
+import (
+	"billingo/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrPeriodInvoiced is returned when an invoice of the customer already covers
+// part of the period
+var ErrPeriodInvoiced = errors.New("the period overlaps an invoice of the customer")
+
+// ErrPrepaidCustomer is returned when invoicing a prepaid customer, its usage
+// is debited from its wallet instead
+var ErrPrepaidCustomer = errors.New("the usage of a prepaid customer is debited from its wallet")
+
+// ErrInvoiceSuperseded is returned when re-rating an invoice that was replaced
+var ErrInvoiceSuperseded = errors.New("the invoice was superseded")
+
+// ErrReratingClosed is returned when applying a re-rating that was already
+// applied or discarded, or whose invoice was superseded since
+var ErrReratingClosed = errors.New("the re-rating is no longer pending")
+
+// checkNotInvoiced returns ErrPeriodInvoiced when an invoice of the customer
+// covers part of the period, open ended for a nil end
+func checkNotInvoiced(tx *gorm.DB, customerID uint, from time.Time, to *time.Time) error {
+	query := tx.Model(&models.Invoice{}).
+		Where("customer_id = ? AND status <> ?", customerID, models.InvoiceSuperseded).
+		Where("period_end > ?", from)
+	if to != nil {
+		query = query.Where("period_start < ?", *to)
+	}
+	var overlapping int64
+	if err := query.Count(&overlapping).Error; err != nil {
+		return err
+	}
+	if overlapping > 0 {
+		return ErrPeriodInvoiced
+	}
+	return nil
+}
+
+// ChangeUninvoiced runs the change of the usage attributed to the customer
+// over the period, open ended for a nil end, such as an edit of its VM
+// ownerships. It returns ErrPeriodInvoiced when an invoice covers part of the
+// period: the samples digests of its ledger entries are verified again with
+// the current ownerships, which must not change once invoiced. The change
+// runs with the customer locked so no invoice is issued meanwhile.
+func ChangeUninvoiced(db *gorm.DB, customerID uint, from time.Time, to *time.Time, change func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockCustomer(tx, customerID); err != nil {
+			return err
+		}
+		if err := checkNotInvoiced(tx, customerID, from, to); err != nil {
+			return err
+		}
+		return change(tx)
+	})
+}
+
+// GenerateInvoice rates the usage of the customer over the period, appends it
+// to the ledger and creates the invoice referencing the new ledger head. The
+// prepaid customers are not invoiced, they would pay their usage twice.
+func GenerateInvoice(db *gorm.DB, plans Plans, defaultPlan string, customerID uint, from, to time.Time) (*models.Invoice, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("the period must end after it starts")
+	}
+
+	var invoice *models.Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		customer, err := lockCustomer(tx, customerID)
+		if err != nil {
+			return err
+		}
+		if customer.Prepaid {
+			return ErrPrepaidCustomer
+		}
+		plan, rated, digests, err := rateCustomer(tx, plans, defaultPlan, customer, from, to, true)
+		if err != nil {
+			return err
+		}
+		invoice, err = issueInvoice(tx, customerID, from, to, plan, rated, digests, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("customer", customerID).Infof("Issued invoice %d of %.2f %s", invoice.ID, invoice.Total, invoice.Currency)
+	return invoice, nil
+}
+
+// lockCustomer loads the customer and serializes its invoices and ledger appends
+func lockCustomer(tx *gorm.DB, customerID uint) (models.Customer, error) {
+	var customer models.Customer
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&customer, customerID).Error
+	return customer, err
+}
+
+// rateCustomer rates the usage of the customer over the period with the plans
+// it was subscribed to, then applies its commitments and discounts. It
+// returns the digests of the samples rated when withDigests is set, those
+// are only needed for the ledger.
+func rateCustomer(tx *gorm.DB, plans Plans, defaultPlan string, customer models.Customer, from, to time.Time, withDigests bool) (Plan, []RatedUsage, map[models.VMKey]string, error) {
+	loc, err := customer.Location()
+	if err != nil {
+		return Plan{}, nil, nil, fmt.Errorf("timezone of customer %d: %w", customer.ID, err)
+	}
+	subscriptions, err := models.CustomerSubscriptions(tx, customer.ID, from, to)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+	ownerships, err := models.CustomerOwnerships(tx, customer.ID, &from, &to)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+	usage, err := CollectUsage(tx, ownerships, from, to)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+	var digests map[models.VMKey]string
+	if withDigests {
+		if digests, err = SamplesDigests(tx, ownerships, from, to); err != nil {
+			return Plan{}, nil, nil, err
+		}
+	}
+	plan, rated, err := rateSubscriptions(plans, defaultPlan, customer, subscriptions, usage, from, to, loc)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+
+	commitments, err := models.CustomerCommitments(tx, customer.ID, from, to)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+	rated = applyCommitments(commitments, usage, rated, from, to)
+	discounts, err := models.CustomerDiscounts(tx, customer.ID, from, to)
+	if err != nil {
+		return Plan{}, nil, nil, err
+	}
+	return plan, applyDiscounts(discounts, rated, from, to), digests, nil
+}
+
+// issueInvoice creates the invoice of the rated usage and appends it to the
+// ledger, the customer must be locked
+func issueInvoice(tx *gorm.DB, customerID uint, from, to time.Time, plan Plan, rated []RatedUsage, digests map[models.VMKey]string, replaces *uint) (*models.Invoice, error) {
+	if err := checkNotInvoiced(tx, customerID, from, &to); err != nil {
+		return nil, err
+	}
+
+	invoice := models.Invoice{
+		CustomerID:  customerID,
+		PeriodStart: from,
+		PeriodEnd:   to,
+		Plan:        plan.Name,
+		Currency:    plan.Currency,
+		Status:      models.InvoiceIssued,
+		ReplacesID:  replaces,
+	}
+	for _, usage := range rated {
+		invoice.Total += usage.Amount
+		invoice.Lines = append(invoice.Lines, models.InvoiceLine{
+			SiteID:      usage.VM.Site(),
+			Cluster:     usage.VM.Cluster,
+			VMID:        usage.VM.VMID,
+			Metric:      usage.Metric,
+			Description: usage.Description,
+			Quantity:    usage.Quantity,
+			UnitPrice:   usage.UnitPrice,
+			Amount:      usage.Amount,
+		})
+	}
+	invoice.Total = RoundAmount(invoice.Total)
+	if err := tx.Create(&invoice).Error; err != nil {
+		return nil, err
+	}
+
+	head, err := AppendLedger(tx, customerID, invoice.ID, from, to, rated, digests)
+	if err != nil {
+		return nil, err
+	}
+	invoice.LedgerHead = head
+	if err := tx.Model(&invoice).Update("ledger_head", head).Error; err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// rerateKey identifies a line between the invoice and its re-rating
+type rerateKey struct {
+	vm                  models.VMKey
+	metric, description string
+}
+
+// Rerate rates the period of an invoice again with the current samples and
+// plans and records the difference with the invoice, to be reviewed before it
+// is applied
+func Rerate(db *gorm.DB, plans Plans, defaultPlan string, invoiceID uint) (*models.Rerating, error) {
+	var rerating models.Rerating
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var invoice models.Invoice
+		if err := tx.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).First(&invoice, invoiceID).Error; err != nil {
+			return err
+		}
+		if invoice.Status == models.InvoiceSuperseded {
+			return ErrInvoiceSuperseded
+		}
+		var customer models.Customer
+		if err := tx.First(&customer, invoice.CustomerID).Error; err != nil {
+			return err
+		}
+		plan, rated, digests, err := rateCustomer(tx, plans, defaultPlan, customer, invoice.PeriodStart, invoice.PeriodEnd, true)
+		if err != nil {
+			return err
+		}
+
+		rerating = models.Rerating{
+			InvoiceID:     invoice.ID,
+			CustomerID:    invoice.CustomerID,
+			PeriodStart:   invoice.PeriodStart,
+			PeriodEnd:     invoice.PeriodEnd,
+			Plan:          plan.Name,
+			Currency:      plan.Currency,
+			PreviousTotal: invoice.Total,
+			Status:        models.ReratingPending,
+		}
+		previous := map[rerateKey]models.InvoiceLine{}
+		for _, line := range invoice.Lines {
+			previous[rerateKey{models.NewVMKey(line.SiteID, line.Cluster, line.VMID), line.Metric, line.Description}] = line
+		}
+		for _, usage := range rated {
+			key := rerateKey{usage.VM, usage.Metric, usage.Description}
+			line := previous[key]
+			delete(previous, key)
+			rerating.Total += usage.Amount
+			rerating.Lines = append(rerating.Lines, models.RerateLine{
+				SiteID:           usage.VM.Site(),
+				Cluster:          usage.VM.Cluster,
+				VMID:             usage.VM.VMID,
+				Metric:           usage.Metric,
+				Description:      usage.Description,
+				PreviousQuantity: line.Quantity,
+				PreviousAmount:   line.Amount,
+				Quantity:         usage.Quantity,
+				UnitPrice:        usage.UnitPrice,
+				Amount:           usage.Amount,
+				Delta:            RoundAmount(usage.Amount - line.Amount),
+				SamplesDigest:    digests[usage.VM],
+			})
+		}
+		for _, line := range invoice.Lines {
+			if _, removed := previous[rerateKey{models.NewVMKey(line.SiteID, line.Cluster, line.VMID), line.Metric, line.Description}]; removed {
+				rerating.Lines = append(rerating.Lines, models.RerateLine{
+					SiteID:           line.SiteID,
+					Cluster:          line.Cluster,
+					VMID:             line.VMID,
+					Metric:           line.Metric,
+					Description:      line.Description,
+					PreviousQuantity: line.Quantity,
+					PreviousAmount:   line.Amount,
+					Delta:            -line.Amount,
+					Removed:          true,
+				})
+			}
+		}
+		rerating.Total = RoundAmount(rerating.Total)
+		rerating.Delta = RoundAmount(rerating.Total - rerating.PreviousTotal)
+		return tx.Create(&rerating).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("customer", rerating.CustomerID).Infof("Re-rated invoice %d: %.2f %s to %.2f", invoiceID, rerating.PreviousTotal, rerating.Currency, rerating.Total)
+	return &rerating, nil
+}
+
+// ApplyRerating supersedes the invoice of a pending re-rating with a new
+// invoice of the reviewed amounts, appended to the ledger
+func ApplyRerating(db *gorm.DB, reratingID uint) (*models.Invoice, error) {
+	var invoice *models.Invoice
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var customers []uint
+		if err := tx.Model(&models.Rerating{}).Where("id = ?", reratingID).Pluck("customer_id", &customers).Error; err != nil {
+			return err
+		}
+		if len(customers) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if _, err := lockCustomer(tx, customers[0]); err != nil {
+			return err
+		}
+		// Loaded once the customer is locked, against concurrent applies
+		var rerating models.Rerating
+		if err := tx.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).First(&rerating, reratingID).Error; err != nil {
+			return err
+		}
+		var previous models.Invoice
+		if err := tx.First(&previous, rerating.InvoiceID).Error; err != nil {
+			return err
+		}
+		if rerating.Status != models.ReratingPending || previous.Status == models.InvoiceSuperseded {
+			return ErrReratingClosed
+		}
+
+		if err := tx.Model(&previous).Update("status", models.InvoiceSuperseded).Error; err != nil {
+			return err
+		}
+		var rated []RatedUsage
+		digests := map[models.VMKey]string{}
+		for _, line := range rerating.Lines {
+			if line.Removed {
+				continue
+			}
+			vm := models.NewVMKey(line.SiteID, line.Cluster, line.VMID)
+			rated = append(rated, RatedUsage{
+				VM:          vm,
+				Metric:      line.Metric,
+				Description: line.Description,
+				Quantity:    line.Quantity,
+				UnitPrice:   line.UnitPrice,
+				Amount:      line.Amount,
+			})
+			digests[vm] = line.SamplesDigest
+		}
+		plan := Plan{Name: rerating.Plan, Currency: rerating.Currency}
+		var err error
+		invoice, err = issueInvoice(tx, rerating.CustomerID, rerating.PeriodStart, rerating.PeriodEnd, plan, rated, digests, &previous.ID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&rerating).Updates(map[string]interface{}{"status": models.ReratingApplied, "new_invoice_id": invoice.ID}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("customer", invoice.CustomerID).Infof("Invoice %d superseded by invoice %d of %.2f %s", *invoice.ReplacesID, invoice.ID, invoice.Total, invoice.Currency)
+	return invoice, nil
+}
+
+// DiscardRerating closes a pending re-rating without changing the invoice
+func DiscardRerating(db *gorm.DB, reratingID uint) (*models.Rerating, error) {
+	var rerating models.Rerating
+	if err := db.First(&rerating, reratingID).Error; err != nil {
+		return nil, err
+	}
+	result := db.Model(&rerating).Where("status = ?", models.ReratingPending).Update("status", models.ReratingDiscarded)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrReratingClosed
+	}
+	return &rerating, nil
+}
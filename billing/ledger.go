@@ -0,0 +1,209 @@
+package billing
+
+import (
+	"billingo/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EntryHash computes the hash of a ledger entry, chained to the previous one.
+// The VM is hashed as its key.
+func EntryHash(entry models.LedgerEntry) string {
+	fields := []string{
+		entry.PrevHash,
+		strconv.FormatUint(uint64(entry.CustomerID), 10),
+		strconv.FormatInt(entry.Seq, 10),
+		strconv.FormatUint(uint64(entry.InvoiceID), 10),
+		entry.PeriodStart.UTC().Format(time.RFC3339Nano),
+		entry.PeriodEnd.UTC().Format(time.RFC3339Nano),
+		models.NewVMKey(entry.SiteID, entry.Cluster, entry.VMID).String(),
+		entry.Metric,
+		strconv.FormatFloat(entry.Quantity, 'g', -1, 64),
+		strconv.FormatFloat(entry.UnitPrice, 'g', -1, 64),
+		strconv.FormatFloat(entry.Amount, 'g', -1, 64),
+		entry.SamplesDigest,
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendLedger appends the rated usage of an invoice to the ledger of the
+// customer and returns the new head hash. It must run in the transaction
+// creating the invoice, after the customer row was locked.
+func AppendLedger(tx *gorm.DB, customerID, invoiceID uint, from, to time.Time, rated []RatedUsage, digests map[models.VMKey]string) (string, error) {
+	last, err := models.LastLedgerEntry(tx, customerID)
+	if err != nil {
+		return "", err
+	}
+	var seq int64
+	var head string
+	if last != nil {
+		seq, head = last.Seq, last.Hash
+	}
+	if len(rated) == 0 {
+		return head, nil
+	}
+
+	// The database keeps microseconds, the hash must match once read back
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	entries := make([]models.LedgerEntry, len(rated))
+	for i, usage := range rated {
+		seq++
+		entry := models.LedgerEntry{
+			CustomerID:    customerID,
+			Seq:           seq,
+			InvoiceID:     invoiceID,
+			PeriodStart:   from.UTC().Truncate(time.Microsecond),
+			PeriodEnd:     to.UTC().Truncate(time.Microsecond),
+			SiteID:        usage.VM.Site(),
+			Cluster:       usage.VM.Cluster,
+			VMID:          usage.VM.VMID,
+			Metric:        usage.Metric,
+			Quantity:      usage.Quantity,
+			UnitPrice:     usage.UnitPrice,
+			Amount:        usage.Amount,
+			SamplesDigest: digests[usage.VM],
+			PrevHash:      head,
+			CreatedAt:     now,
+		}
+		entry.Hash = EntryHash(entry)
+		head = entry.Hash
+		entries[i] = entry
+	}
+	if err := tx.CreateInBatches(&entries, 1000).Error; err != nil {
+		return "", err
+	}
+	return head, nil
+}
+
+// LedgerReport is the result of the verification of the ledger
+type LedgerReport struct {
+	Valid     bool     `json:"valid"`
+	Customers int      `json:"customers"`
+	Entries   int      `json:"entries"`
+	Invoices  int      `json:"invoices"`
+	Errors    []string `json:"errors"`
+	// Warnings are the checks that could not be made, such as the samples
+	// dropped by the retention policy
+	Warnings []string `json:"warnings"`
+}
+
+func (r *LedgerReport) fail(format string, args ...interface{}) {
+	r.Valid = false
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// VerifyLedger re-checks the hash chain of the ledger of a customer, or of
+// every customer, and that each invoice references the head of its entries.
+// With checkSamples the digests of the samples are computed again, detecting
+// samples changed after they were rated.
+func VerifyLedger(db *gorm.DB, customerID *uint, checkSamples bool) (*LedgerReport, error) {
+	report := &LedgerReport{Valid: true, Errors: []string{}, Warnings: []string{}}
+
+	var customers []uint
+	query := db.Model(&models.LedgerEntry{}).Distinct("customer_id").Order("customer_id")
+	if customerID != nil {
+		query = query.Where("customer_id = ?", *customerID)
+	}
+	if err := query.Pluck("customer_id", &customers).Error; err != nil {
+		return nil, err
+	}
+
+	for _, customer := range customers {
+		report.Customers++
+		if err := verifyCustomerLedger(db, customer, checkSamples, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// verifyCustomerLedger verifies the ledger of a customer into the report
+func verifyCustomerLedger(db *gorm.DB, customerID uint, checkSamples bool, report *LedgerReport) error {
+	var entries []models.LedgerEntry
+	if err := db.Where("customer_id = ?", customerID).Order("seq").Find(&entries).Error; err != nil {
+		return err
+	}
+
+	// The hash of the last entry and the total of each invoice
+	heads := map[uint]string{}
+	totals := map[uint]float64{}
+	prev := ""
+	for i, entry := range entries {
+		report.Entries++
+		if entry.Seq != int64(i+1) {
+			report.fail("customer %d: entry %d has sequence %d, expected %d", customerID, entry.ID, entry.Seq, i+1)
+		}
+		if entry.PrevHash != prev {
+			report.fail("customer %d: entry %d is not chained to the previous entry", customerID, entry.Seq)
+		}
+		if hash := EntryHash(entry); hash != entry.Hash {
+			report.fail("customer %d: entry %d was modified, its hash does not match", customerID, entry.Seq)
+		}
+		prev = entry.Hash
+		heads[entry.InvoiceID] = entry.Hash
+		totals[entry.InvoiceID] += entry.Amount
+	}
+
+	var invoices []models.Invoice
+	if err := db.Where("customer_id = ?", customerID).Order("id").Find(&invoices).Error; err != nil {
+		return err
+	}
+	for _, invoice := range invoices {
+		report.Invoices++
+		if head, exists := heads[invoice.ID]; exists && head != invoice.LedgerHead {
+			report.fail("customer %d: invoice %d references %s instead of the head %s of its entries", customerID, invoice.ID, invoice.LedgerHead, head)
+		}
+		if total := RoundAmount(totals[invoice.ID]); total != RoundAmount(invoice.Total) {
+			report.fail("customer %d: invoice %d totals %.2f but its entries %.2f", customerID, invoice.ID, invoice.Total, total)
+		}
+	}
+
+	if checkSamples {
+		return verifySamples(db, customerID, entries, report)
+	}
+	return nil
+}
+
+// verifySamples computes the digests of the samples of the entries again
+func verifySamples(db *gorm.DB, customerID uint, entries []models.LedgerEntry, report *LedgerReport) error {
+	type period struct{ from, to time.Time }
+	checked := map[period]map[models.VMKey]string{}
+	unavailable := map[period]map[models.VMKey]bool{}
+	for _, entry := range entries {
+		// The minimum charges are not computed from samples
+		if entry.VMID == 0 {
+			continue
+		}
+		key := period{entry.PeriodStart, entry.PeriodEnd}
+		digests, exists := checked[key]
+		if !exists {
+			ownerships, err := models.CustomerOwnerships(db, customerID, &key.from, &key.to)
+			if err != nil {
+				return err
+			}
+			if digests, err = SamplesDigests(db, ownerships, key.from, key.to); err != nil {
+				return err
+			}
+			checked[key] = digests
+			unavailable[key] = map[models.VMKey]bool{}
+		}
+		vm := models.NewVMKey(entry.SiteID, entry.Cluster, entry.VMID)
+		digest, exists := digests[vm]
+		switch {
+		case !exists && entry.SamplesDigest != "" && !unavailable[key][vm]:
+			unavailable[key][vm] = true
+			report.Warnings = append(report.Warnings, fmt.Sprintf("customer %d: entry %d: the samples of VM %s are no longer available", customerID, entry.Seq, vm))
+		case exists && digest != entry.SamplesDigest:
+			report.fail("customer %d: entry %d: the samples of VM %s changed after they were rated", customerID, entry.Seq, vm)
+		}
+	}
+	return nil
+}
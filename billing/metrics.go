@@ -0,0 +1,142 @@
+// Package billing rates the usage collected in the data table with the price
+// plans and records the rated usage in the ledger the invoices are built from.
+package billing
+
+import (
+	"billingo/filters"
+	"billingo/logging"
+	"billingo/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var log = logging.For("billing")
+
+// Metrics rated by the billing, derived from the fields of the samples
+const (
+	// MetricCPUHours is the vCPU-hours used, cpu times maxcpu over time
+	MetricCPUHours = "cpu_hours"
+	// MetricMemGBHours and MetricDiskGBHours are the GB of memory and disk used over time
+	MetricMemGBHours  = "mem_gb_hours"
+	MetricDiskGBHours = "disk_gb_hours"
+	// The traffic and disk IO in GB
+	MetricNetInGB     = "netin_gb"
+	MetricNetOutGB    = "netout_gb"
+	MetricDiskReadGB  = "diskread_gb"
+	MetricDiskWriteGB = "diskwrite_gb"
+)
+
+// Metrics lists every rated metric
+var Metrics = []string{
+	MetricCPUHours, MetricMemGBHours, MetricDiskGBHours,
+	MetricNetInGB, MetricNetOutGB, MetricDiskReadGB, MetricDiskWriteGB,
+}
+
+// gigabyte is the unit of the memory, disk and traffic metrics
+const gigabyte = 1e9
+
+// timeMetrics are the metrics accumulated over the time the VM was sampled
+var timeMetrics = []string{MetricCPUHours, MetricMemGBHours, MetricDiskGBHours}
+
+// HourlyUsage is the usage of a VM on a node over an hour. Seconds is the
+// time covered by its samples.
+type HourlyUsage struct {
+	VM         models.VMKey
+	Node       string
+	Hour       time.Time
+	Seconds    int64
+	Quantities map[string]float64
+}
+
+// customerSamples selects the samples of the VMs owned by the customer over
+// the period, while they were owned
+func customerSamples(db *gorm.DB, ownerships []models.VMOwnership, from, to time.Time) *gorm.DB {
+	query := db.Model(&models.Data{}).Where("time >= ? AND time < ?", from.Unix(), to.Unix())
+	return filters.TenantScope(query, ownerships)
+}
+
+// CollectUsage sums the usage of each VM owned by the customer per hour of the period
+func CollectUsage(db *gorm.DB, ownerships []models.VMOwnership, from, to time.Time) ([]HourlyUsage, error) {
+	var rows []struct {
+		SiteID      *uint
+		Cluster     string
+		VMID        int
+		Node        string
+		Hour        int64
+		Seconds     int64
+		CPUHours    float64
+		MemGBHours  float64
+		DiskGBHours float64
+		NetInGB     float64
+		NetOutGB    float64
+		DiskReadGB  float64
+		DiskWriteGB float64
+	}
+	hourly := float64(models.SampleInterval) / 3600
+	err := customerSamples(db, ownerships, from, to).
+		Select(`site_id, cluster, vm_id, node,
+			time / 3600 * 3600 AS hour,
+			count(*) * ? AS seconds,
+			coalesce(sum(cpu * max_cpu), 0) * ? AS cpu_hours,
+			coalesce(sum(mem), 0) * ? AS mem_gb_hours,
+			coalesce(sum(disk), 0) * ? AS disk_gb_hours,
+			coalesce(sum(net_in), 0) * ? AS net_in_gb,
+			coalesce(sum(net_out), 0) * ? AS net_out_gb,
+			coalesce(sum(disk_read), 0) * ? AS disk_read_gb,
+			coalesce(sum(disk_write), 0) * ? AS disk_write_gb`,
+			models.SampleInterval, hourly, hourly/gigabyte, hourly/gigabyte,
+			models.SampleInterval/gigabyte, models.SampleInterval/gigabyte,
+			models.SampleInterval/gigabyte, models.SampleInterval/gigabyte).
+		Group("site_id, cluster, vm_id, node, hour").
+		Order("site_id NULLS FIRST, cluster, vm_id, hour, node").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]HourlyUsage, len(rows))
+	for i, row := range rows {
+		usage[i] = HourlyUsage{
+			VM:      models.NewVMKey(row.SiteID, row.Cluster, row.VMID),
+			Node:    row.Node,
+			Hour:    time.Unix(row.Hour, 0).UTC(),
+			Seconds: row.Seconds,
+			Quantities: map[string]float64{
+				MetricCPUHours:    row.CPUHours,
+				MetricMemGBHours:  row.MemGBHours,
+				MetricDiskGBHours: row.DiskGBHours,
+				MetricNetInGB:     row.NetInGB,
+				MetricNetOutGB:    row.NetOutGB,
+				MetricDiskReadGB:  row.DiskReadGB,
+				MetricDiskWriteGB: row.DiskWriteGB,
+			},
+		}
+	}
+	return usage, nil
+}
+
+// SamplesDigests returns the SHA-256 digest of the samples of each VM owned by
+// the customer over the period, in time order
+func SamplesDigests(db *gorm.DB, ownerships []models.VMOwnership, from, to time.Time) (map[models.VMKey]string, error) {
+	var rows []struct {
+		SiteID  *uint
+		Cluster string
+		VMID    int
+		Digest  string
+	}
+	err := customerSamples(db, ownerships, from, to).
+		Select(`site_id, cluster, vm_id, encode(sha256(convert_to(string_agg(
+			concat_ws(',', time, cpu, max_cpu, mem, max_mem, disk, max_disk, net_in, net_out, disk_read, disk_write),
+			';' ORDER BY time, id), 'UTF8')), 'hex') AS digest`).
+		Group("site_id, cluster, vm_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[models.VMKey]string, len(rows))
+	for _, row := range rows {
+		digests[models.NewVMKey(row.SiteID, row.Cluster, row.VMID)] = row.Digest
+	}
+	return digests, nil
+}
@@ -0,0 +1,116 @@
+package billing
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// weekdays are the names of the days of the time windows, by time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Modifier scales the prices of the usage on a node, on the nodes of a class
+// or during a time window of the week, in the timezone of the customer. The
+// usage matching several modifiers is scaled by each of them.
+type Modifier struct {
+	// Name describes the modifier on the invoice lines
+	Name string `yaml:"name" json:"name"`
+	// Metrics are the metrics modified, every metric when empty
+	Metrics   []string `yaml:"metrics" json:"metrics,omitempty"`
+	Node      string   `yaml:"node" json:"node,omitempty"`
+	NodeClass string   `yaml:"node_class" json:"node_class,omitempty"`
+	// Days are the days of the window, mon to sun, every day when empty
+	Days []string `yaml:"days" json:"days,omitempty"`
+	// From and To are the HH:00 bounds of the window, the whole day when
+	// empty. They are on the hour like the hourly usage they select. A window
+	// ending before it starts spans midnight.
+	From   string  `yaml:"from" json:"from,omitempty"`
+	To     string  `yaml:"to" json:"to,omitempty"`
+	Factor float64 `yaml:"factor" json:"factor"`
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(clock string) (int, error) {
+	at, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return at.Hour()*60 + at.Minute(), nil
+}
+
+// validate checks the modifier, nodeClasses maps the nodes to their class
+func (m Modifier) validate(name string, nodeClasses map[string]string) []error {
+	var errs []error
+	if m.Name == "" {
+		errs = append(errs, fmt.Errorf("%s: name is required", name))
+	}
+	if m.Factor < 0 {
+		errs = append(errs, fmt.Errorf("%s: factor must not be negative", name))
+	}
+	for _, metric := range m.Metrics {
+		if !slices.Contains(Metrics, metric) {
+			errs = append(errs, fmt.Errorf("%s: unknown metric %q", name, metric))
+		}
+	}
+	if m.NodeClass != "" {
+		known := false
+		for _, class := range nodeClasses {
+			known = known || class == m.NodeClass
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("%s: unknown node class %q", name, m.NodeClass))
+		}
+	}
+	for _, day := range m.Days {
+		if !slices.Contains(weekdays, strings.ToLower(day)) {
+			errs = append(errs, fmt.Errorf("%s: unknown day %q", name, day))
+		}
+	}
+	if (m.From == "") != (m.To == "") {
+		errs = append(errs, fmt.Errorf("%s: from and to go together", name))
+	}
+	for _, bound := range []struct{ field, clock string }{{"from", m.From}, {"to", m.To}} {
+		field, clock := bound.field, bound.clock
+		if clock == "" {
+			continue
+		}
+		minutes, err := parseClock(clock)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		} else if minutes%60 != 0 {
+			errs = append(errs, fmt.Errorf("%s: %s must be on the hour", name, field))
+		}
+	}
+	return errs
+}
+
+// matches reports whether the modifier applies to the usage of the metric on
+// the node during the hour starting at the given local time
+func (m Modifier) matches(metric, node, nodeClass string, at time.Time) bool {
+	if len(m.Metrics) > 0 && !slices.Contains(m.Metrics, metric) {
+		return false
+	}
+	if m.Node != "" && m.Node != node {
+		return false
+	}
+	if m.NodeClass != "" && m.NodeClass != nodeClass {
+		return false
+	}
+	if len(m.Days) > 0 && !slices.ContainsFunc(m.Days, func(day string) bool {
+		return strings.ToLower(day) == weekdays[at.Weekday()]
+	}) {
+		return false
+	}
+	if m.From == "" {
+		return true
+	}
+	// Validated when the plans are loaded
+	from, _ := parseClock(m.From)
+	to, _ := parseClock(m.To)
+	minute := at.Hour()*60 + at.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
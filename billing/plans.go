@@ -0,0 +1,264 @@
+package billing
+
+import (
+	"billingo/models"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Plan prices the metrics of the usage, the metrics without a price are not
+// billed. Its prices change over time with its versions, a plan without
+// versions has a single one made of its fee, prices, modifiers and minimum
+// charge.
+type Plan struct {
+	Name          string        `yaml:"name" json:"name"`
+	Currency      string        `yaml:"currency" json:"currency"`
+	Fee           float64       `yaml:"fee" json:"fee,omitempty"`
+	MinimumCharge float64       `yaml:"minimum_charge" json:"minimum_charge,omitempty"`
+	Prices        []Price       `yaml:"prices" json:"prices,omitempty"`
+	Modifiers     []Modifier    `yaml:"modifiers" json:"modifiers,omitempty"`
+	Versions      []PlanVersion `yaml:"versions" json:"versions"`
+	// NodeClasses maps the nodes to their class, from the node_classes of the file
+	NodeClasses map[string]string `yaml:"-" json:"-"`
+}
+
+// PlanVersion are the prices of a plan effective from EffectiveFrom until
+// EffectiveTo, or without end. Fee is charged every invoice period regardless
+// of the usage and MinimumCharge is the least amount of an invoice period,
+// both prorated when the version only covers part of it.
+type PlanVersion struct {
+	EffectiveFrom time.Time  `yaml:"effective_from" json:"effective_from"`
+	EffectiveTo   *time.Time `yaml:"effective_to" json:"effective_to"`
+	Fee           float64    `yaml:"fee" json:"fee,omitempty"`
+	MinimumCharge float64    `yaml:"minimum_charge" json:"minimum_charge,omitempty"`
+	Prices        []Price    `yaml:"prices" json:"prices"`
+	Modifiers     []Modifier `yaml:"modifiers" json:"modifiers,omitempty"`
+
+	// share is the fraction of the invoice period covered once prorated
+	share float64
+}
+
+// Tier modes of a price
+const (
+	// TierGraduated prices each part of the quantity at the price of its tier
+	TierGraduated = "graduated"
+	// TierVolume prices the whole quantity at the price of the tier it reaches
+	TierVolume = "volume"
+)
+
+// Rounding rules of the quantities of a price
+const (
+	// RoundMinute and RoundHour round up the time covered by the samples of a
+	// VM in each hour, only for the metrics accumulated over time
+	RoundMinute = "minute"
+	RoundHour   = "hour"
+	// RoundUnit rounds up the quantity of a VM over the period to a whole unit
+	RoundUnit = "unit"
+)
+
+// Price is the price of a metric. The quantity of every VM of the customer
+// over the invoice period is summed, the included allowance is free and the
+// rest is priced with the unit price or the tiers. Minimum is the least amount
+// charged for the metric in an invoice period. The allowance, the tiers and
+// the minimum are prorated when a version only covers part of the period.
+type Price struct {
+	Metric      string  `yaml:"metric" json:"metric"`
+	Description string  `yaml:"description" json:"description,omitempty"`
+	UnitPrice   float64 `yaml:"unit_price" json:"unit_price,omitempty"`
+	Tiers       []Tier  `yaml:"tiers" json:"tiers,omitempty"`
+	TierMode    string  `yaml:"tier_mode" json:"tier_mode,omitempty"`
+	Included    float64 `yaml:"included" json:"included,omitempty"`
+	Minimum     float64 `yaml:"minimum" json:"minimum,omitempty"`
+	Rounding    string  `yaml:"rounding" json:"rounding,omitempty"`
+}
+
+// Tier prices the quantity up to UpTo, the last tier has no limit
+type Tier struct {
+	UpTo      *float64 `yaml:"up_to" json:"up_to"`
+	UnitPrice float64  `yaml:"unit_price" json:"unit_price"`
+}
+
+// Plans are the price plans by name
+type Plans map[string]Plan
+
+// LoadPlans reads the price plans file of the billing configuration
+func LoadPlans(path string) (Plans, error) {
+	if path == "" {
+		return nil, errors.New("no price plans are configured, billing.price_plans_path is empty")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		// NodeClasses lists the nodes of each class
+		NodeClasses map[string][]string `yaml:"node_classes"`
+		Plans       []Plan              `yaml:"plans"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var errs []error
+	nodeClasses := map[string]string{}
+	for class, nodes := range file.NodeClasses {
+		for _, node := range nodes {
+			if other, exists := nodeClasses[node]; exists && other != class {
+				errs = append(errs, fmt.Errorf("node_classes: node %s is in the classes %s and %s", node, other, class))
+			}
+			nodeClasses[node] = class
+		}
+	}
+
+	plans := make(Plans, len(file.Plans))
+	for i, plan := range file.Plans {
+		if plan.Name == "" {
+			errs = append(errs, fmt.Errorf("plans[%d]: name is required", i))
+			continue
+		}
+		if _, exists := plans[plan.Name]; exists {
+			errs = append(errs, fmt.Errorf("plans[%d]: duplicated name %q", i, plan.Name))
+		}
+		if len(plan.Versions) == 0 {
+			plan.Versions = []PlanVersion{{Fee: plan.Fee, MinimumCharge: plan.MinimumCharge, Prices: plan.Prices, Modifiers: plan.Modifiers}}
+		} else if len(plan.Prices) > 0 || len(plan.Modifiers) > 0 || plan.MinimumCharge != 0 || plan.Fee != 0 {
+			errs = append(errs, fmt.Errorf("plan %s: fee, prices, modifiers and minimum_charge go in the versions when it has some", plan.Name))
+		}
+		plan.Prices, plan.Modifiers, plan.MinimumCharge, plan.Fee = nil, nil, 0, 0
+		plan.NodeClasses = nodeClasses
+		sort.SliceStable(plan.Versions, func(a, b int) bool {
+			return plan.Versions[a].EffectiveFrom.Before(plan.Versions[b].EffectiveFrom)
+		})
+		errs = append(errs, plan.validate()...)
+		plans[plan.Name] = plan
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid price plans in %s:\n%w", path, err)
+	}
+	return plans, nil
+}
+
+// validate checks that the versions do not overlap and start on the hour, the
+// usage being rated per hour
+func (p Plan) validate() []error {
+	var errs []error
+	for i, version := range p.Versions {
+		name := "plan " + p.Name
+		if !version.EffectiveFrom.IsZero() {
+			name = fmt.Sprintf("plan %s: version from %s", p.Name, version.EffectiveFrom.Format(time.RFC3339))
+		}
+		if !version.EffectiveFrom.Truncate(time.Hour).Equal(version.EffectiveFrom) {
+			errs = append(errs, fmt.Errorf("%s: effective_from must be on the hour", name))
+		}
+		if to := version.EffectiveTo; to != nil {
+			if !to.Truncate(time.Hour).Equal(*to) {
+				errs = append(errs, fmt.Errorf("%s: effective_to must be on the hour", name))
+			}
+			if !to.After(version.EffectiveFrom) {
+				errs = append(errs, fmt.Errorf("%s: effective_to must be after effective_from", name))
+			}
+		}
+		if i > 0 {
+			previous := p.Versions[i-1]
+			if previous.EffectiveTo == nil || previous.EffectiveTo.After(version.EffectiveFrom) {
+				errs = append(errs, fmt.Errorf("%s: overlaps the previous version", name))
+			}
+		}
+		errs = append(errs, version.validate(name)...)
+		for j, modifier := range version.Modifiers {
+			errs = append(errs, modifier.validate(fmt.Sprintf("%s: modifiers[%d]", name, j), p.NodeClasses)...)
+		}
+	}
+	return errs
+}
+
+// validate checks that the prices are of known metrics, not negative and
+// that their tiers and rounding rules are consistent
+func (v PlanVersion) validate(versionName string) []error {
+	var errs []error
+	if v.MinimumCharge < 0 || v.Fee < 0 {
+		errs = append(errs, fmt.Errorf("%s: fee and minimum_charge must not be negative", versionName))
+	}
+	metrics := map[string]bool{}
+	for i, price := range v.Prices {
+		name := fmt.Sprintf("%s: prices[%d]", versionName, i)
+		if !slices.Contains(Metrics, price.Metric) {
+			errs = append(errs, fmt.Errorf("%s: unknown metric %q", name, price.Metric))
+		}
+		if metrics[price.Metric] {
+			errs = append(errs, fmt.Errorf("%s: metric %q is priced twice", name, price.Metric))
+		}
+		metrics[price.Metric] = true
+		if price.UnitPrice < 0 || price.Included < 0 || price.Minimum < 0 {
+			errs = append(errs, fmt.Errorf("%s: unit_price, included and minimum must not be negative", name))
+		}
+		switch price.Rounding {
+		case "", RoundUnit:
+		case RoundMinute, RoundHour:
+			if !slices.Contains(timeMetrics, price.Metric) {
+				errs = append(errs, fmt.Errorf("%s: rounding %q only applies to %v", name, price.Rounding, timeMetrics))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown rounding %q", name, price.Rounding))
+		}
+		errs = append(errs, price.validateTiers(name)...)
+	}
+	return errs
+}
+
+// validateTiers checks that the tiers are in increasing order and that only
+// the last one is unlimited
+func (p Price) validateTiers(name string) []error {
+	if len(p.Tiers) == 0 {
+		if p.TierMode != "" {
+			return []error{fmt.Errorf("%s: tier_mode requires tiers", name)}
+		}
+		return nil
+	}
+	var errs []error
+	if p.TierMode != "" && p.TierMode != TierGraduated && p.TierMode != TierVolume {
+		errs = append(errs, fmt.Errorf("%s: unknown tier_mode %q", name, p.TierMode))
+	}
+	if p.UnitPrice != 0 {
+		errs = append(errs, fmt.Errorf("%s: unit_price and tiers are exclusive", name))
+	}
+	previous := 0.0
+	for i, tier := range p.Tiers {
+		if tier.UnitPrice < 0 {
+			errs = append(errs, fmt.Errorf("%s: tiers[%d]: unit_price must not be negative", name, i))
+		}
+		if tier.UpTo == nil {
+			if i != len(p.Tiers)-1 {
+				errs = append(errs, fmt.Errorf("%s: tiers[%d]: only the last tier may omit up_to", name, i))
+			}
+			continue
+		}
+		if *tier.UpTo <= previous {
+			errs = append(errs, fmt.Errorf("%s: tiers[%d]: up_to must be greater than the previous tier", name, i))
+		}
+		previous = *tier.UpTo
+	}
+	return errs
+}
+
+// ForCustomer returns the plan of the customer, or the default plan
+func (p Plans) ForCustomer(customer models.Customer, defaultPlan string) (Plan, error) {
+	name := customer.PricePlan
+	if name == "" {
+		name = defaultPlan
+	}
+	if name == "" {
+		return Plan{}, fmt.Errorf("customer %d has no price plan and no default plan is configured", customer.ID)
+	}
+	plan, exists := p[name]
+	if !exists {
+		return Plan{}, fmt.Errorf("price plan %q of customer %d does not exist", name, customer.ID)
+	}
+	return plan, nil
+}
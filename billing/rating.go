@@ -0,0 +1,324 @@
+package billing
+
+import (
+	"billingo/models"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics of the lines not computed from the samples
+const (
+	// MetricMinimumCharge is the metric of the line topping an invoice up to
+	// the minimum charge of the plan
+	MetricMinimumCharge = "minimum_charge"
+	// MetricFee is the metric of the recurring fee of the plan
+	MetricFee = "fee"
+	// MetricDiscount is the metric of the discount lines
+	MetricDiscount = "discount"
+	// MetricCommitment is the metric of the lines of the committed use
+	MetricCommitment = "commitment"
+)
+
+// RatedUsage is the amount of a metric of a VM over a period. The lines not
+// bound to a VM, such as the minimum charges, have a VMID of 0.
+type RatedUsage struct {
+	VM          models.VMKey `json:"vm"`
+	Metric      string       `json:"metric"`
+	Description string       `json:"description"`
+	Quantity    float64      `json:"quantity"`
+	UnitPrice   float64      `json:"unit_price"`
+	Amount      float64      `json:"amount"`
+	// Plan is the plan the line was rated with
+	Plan string `json:"plan,omitempty"`
+
+	// credited is the part of the amount credited by the commitments
+	credited float64
+}
+
+// RoundAmount rounds an amount to the cent
+func RoundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Rate prices the usage of the period with the versions of the plan effective
+// over it. Each hour is rated with the version effective at its start, the
+// lines of a period split between versions mention the version they are from.
+// The time windows of the modifiers are evaluated in loc at the start of each
+// hour.
+func Rate(plan Plan, usage []HourlyUsage, from, to time.Time, loc *time.Location) ([]RatedUsage, error) {
+	return rateSegment(plan, usage, from, to, to.Sub(from), loc)
+}
+
+// rateSegment rates the usage of a segment of an invoice period, the fees,
+// allowances, tiers and minimums are prorated to the part of the period it
+// covers
+func rateSegment(plan Plan, usage []HourlyUsage, from, to time.Time, period time.Duration, loc *time.Location) ([]RatedUsage, error) {
+	var rated []RatedUsage
+	covered := from
+	for _, version := range plan.Versions {
+		start, end := version.EffectiveFrom, to
+		if start.Before(from) {
+			start = from
+		}
+		if version.EffectiveTo != nil && version.EffectiveTo.Before(end) {
+			end = *version.EffectiveTo
+		}
+		if !end.After(start) {
+			continue
+		}
+		if start.After(covered) {
+			return nil, fmt.Errorf("plan %s has no prices effective at %s", plan.Name, covered.Format(time.RFC3339))
+		}
+		covered = end
+
+		// The partial hour at the start of the period belongs to it
+		var segment []HourlyUsage
+		for _, hour := range usage {
+			at := hour.Hour
+			if at.Before(from) {
+				at = from
+			}
+			if !at.Before(start) && at.Before(end) {
+				segment = append(segment, hour)
+			}
+		}
+		lines := version.prorated(float64(end.Sub(start))/float64(period)).rate(plan, loc, segment)
+		if !start.Equal(from) || !end.Equal(to) {
+			for i := range lines {
+				lines[i].Description += fmt.Sprintf(" (prices from %s)", version.EffectiveFrom.Format(time.DateOnly))
+			}
+		}
+		rated = append(rated, lines...)
+	}
+	if covered.Before(to) {
+		return nil, fmt.Errorf("plan %s has no prices effective at %s", plan.Name, covered.Format(time.RFC3339))
+	}
+	return rated, nil
+}
+
+// prorated scales the allowances, tiers and minimums of the version to the
+// fraction of the invoice period it covers
+func (v PlanVersion) prorated(fraction float64) PlanVersion {
+	if fraction == 1 {
+		v.share = 1
+		return v
+	}
+	prorated := v
+	prorated.share = fraction
+	prorated.MinimumCharge *= fraction
+	prorated.Prices = make([]Price, len(v.Prices))
+	for i, price := range v.Prices {
+		price.Included *= fraction
+		price.Minimum *= fraction
+		tiers := make([]Tier, len(price.Tiers))
+		for j, tier := range price.Tiers {
+			if tier.UpTo != nil {
+				upTo := *tier.UpTo * fraction
+				tier.UpTo = &upTo
+			}
+			tiers[j] = tier
+		}
+		price.Tiers = tiers
+		prorated.Prices[i] = price
+	}
+	return prorated
+}
+
+// modifiedUsage is the quantity of a metric of a VM scaled by the same
+// modifiers, named after them
+type modifiedUsage struct {
+	names    string
+	factor   float64
+	quantity float64
+}
+
+// rate prices the usage with the version. The charge of each metric is
+// computed on the quantity of every VM, scaled by the modifiers matching the
+// usage and split between the VMs in proportion to their scaled quantity. The
+// fee and the minimum charges are added as lines of their own.
+func (v PlanVersion) rate(plan Plan, loc *time.Location, usage []HourlyUsage) []RatedUsage {
+	roundings := map[string]string{}
+	for _, price := range v.Prices {
+		roundings[price.Metric] = price.Rounding
+	}
+
+	quantities := map[models.VMKey]map[string][]*modifiedUsage{}
+	for _, hour := range usage {
+		if quantities[hour.VM] == nil {
+			quantities[hour.VM] = map[string][]*modifiedUsage{}
+		}
+		at := hour.Hour.In(loc)
+		for metric, quantity := range hour.Quantities {
+			var names []string
+			factor := 1.0
+			for _, modifier := range v.Modifiers {
+				if modifier.matches(metric, hour.Node, plan.NodeClasses[hour.Node], at) {
+					names = append(names, modifier.Name)
+					factor *= modifier.Factor
+				}
+			}
+			quantity = roundTime(quantity, hour.Seconds, roundings[metric])
+			quantities[hour.VM][metric] = addModified(quantities[hour.VM][metric], strings.Join(names, ", "), factor, quantity)
+		}
+	}
+	vms := make([]models.VMKey, 0, len(quantities))
+	for vm := range quantities {
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(a, b int) bool { return vms[a].Less(vms[b]) })
+
+	lines := map[models.VMKey][]RatedUsage{}
+	// The lines not bound to a VM
+	var charges []RatedUsage
+	total := 0.0
+	if v.Fee > 0 {
+		fee := RoundAmount(v.Fee * v.share)
+		charges = append(charges, RatedUsage{
+			Metric:      MetricFee,
+			Description: "Fee of the plan " + plan.Name,
+			Quantity:    v.share,
+			UnitPrice:   v.Fee,
+			Amount:      fee,
+		})
+		total += fee
+	}
+	for _, price := range v.Prices {
+		description := price.Description
+		if description == "" {
+			description = price.Metric
+		}
+
+		metricTotal, scaledTotal := 0.0, 0.0
+		for _, vm := range vms {
+			for _, part := range quantities[vm][price.Metric] {
+				if price.Rounding == RoundUnit {
+					part.quantity = math.Ceil(part.quantity)
+				}
+				metricTotal += part.quantity
+				scaledTotal += part.quantity * part.factor
+			}
+		}
+		// The modifiers scale the average price of the metric
+		var unitPrice, charge float64
+		if metricTotal > 0 {
+			unitPrice = price.Charge(metricTotal) / metricTotal
+			charge = RoundAmount(unitPrice * scaledTotal)
+		}
+
+		// The last line gets the rounding remainder, the lines add up to the charge
+		allocated := 0.0
+		var last *RatedUsage
+		for _, vm := range vms {
+			for _, part := range quantities[vm][price.Metric] {
+				if part.quantity == 0 {
+					continue
+				}
+				amount := 0.0
+				if scaledTotal > 0 {
+					amount = RoundAmount(charge * part.quantity * part.factor / scaledTotal)
+				}
+				allocated += amount
+				line := RatedUsage{
+					VM:          vm,
+					Metric:      price.Metric,
+					Description: description,
+					Quantity:    part.quantity,
+					UnitPrice:   unitPrice * part.factor,
+					Amount:      amount,
+				}
+				if part.names != "" {
+					line.Description += " (" + part.names + ")"
+				}
+				lines[vm] = append(lines[vm], line)
+				last = &lines[vm][len(lines[vm])-1]
+			}
+		}
+		if last != nil {
+			last.Amount = RoundAmount(last.Amount + charge - allocated)
+		}
+		total += charge
+
+		if shortfall := RoundAmount(price.Minimum - charge); shortfall > 0 {
+			charges = append(charges, RatedUsage{
+				Metric:      price.Metric,
+				Description: "Minimum charge: " + description,
+				Amount:      shortfall,
+			})
+			total += shortfall
+		}
+	}
+	if shortfall := RoundAmount(v.MinimumCharge - total); shortfall > 0 {
+		charges = append(charges, RatedUsage{
+			Metric:      MetricMinimumCharge,
+			Description: "Minimum charge of the plan " + plan.Name,
+			Amount:      shortfall,
+		})
+	}
+
+	var rated []RatedUsage
+	for _, vm := range vms {
+		rated = append(rated, lines[vm]...)
+	}
+	return append(rated, charges...)
+}
+
+// addModified adds the quantity to the usage scaled by the same modifiers
+func addModified(parts []*modifiedUsage, names string, factor, quantity float64) []*modifiedUsage {
+	for _, part := range parts {
+		if part.names == names {
+			part.quantity += quantity
+			return parts
+		}
+	}
+	return append(parts, &modifiedUsage{names: names, factor: factor, quantity: quantity})
+}
+
+// roundTime rounds up the time covered by the samples of a VM in an hour,
+// the quantity keeps its average rate over the rounded time
+func roundTime(quantity float64, seconds int64, rounding string) float64 {
+	var unit int64
+	switch rounding {
+	case RoundMinute:
+		unit = 60
+	case RoundHour:
+		unit = 3600
+	default:
+		return quantity
+	}
+	if seconds <= 0 {
+		return quantity
+	}
+	rounded := (seconds + unit - 1) / unit * unit
+	return quantity * float64(rounded) / float64(seconds)
+}
+
+// Charge computes the amount of a quantity of the metric, before the minimum.
+// The quantity above the last tier is priced at the price of the last tier.
+func (p Price) Charge(quantity float64) float64 {
+	quantity = math.Max(quantity-p.Included, 0)
+	if len(p.Tiers) == 0 {
+		return quantity * p.UnitPrice
+	}
+
+	if p.TierMode == TierVolume {
+		for _, tier := range p.Tiers {
+			if tier.UpTo == nil || quantity <= *tier.UpTo {
+				return quantity * tier.UnitPrice
+			}
+		}
+		return quantity * p.Tiers[len(p.Tiers)-1].UnitPrice
+	}
+
+	charge, lower := 0.0, 0.0
+	for _, tier := range p.Tiers {
+		if tier.UpTo == nil || quantity <= *tier.UpTo {
+			return charge + (quantity-lower)*tier.UnitPrice
+		}
+		charge += (*tier.UpTo - lower) * tier.UnitPrice
+		lower = *tier.UpTo
+	}
+	return charge + (quantity-lower)*p.Tiers[len(p.Tiers)-1].UnitPrice
+}
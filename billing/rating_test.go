@@ -0,0 +1,212 @@
+package billing
+
+import (
+	"billingo/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func upTo(quantity float64) *float64 {
+	return &quantity
+}
+
+// near compares amounts and quantities computed with floats
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// checkLines compares the lines with the expected ones, ignoring the plan
+func checkLines(t *testing.T, got, want []RatedUsage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines %+v, want %d lines %+v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i].VM != want[i].VM || got[i].Metric != want[i].Metric || got[i].Description != want[i].Description ||
+			!near(got[i].Quantity, want[i].Quantity) || !near(got[i].UnitPrice, want[i].UnitPrice) || !near(got[i].Amount, want[i].Amount) {
+			t.Errorf("line %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPriceCharge(t *testing.T) {
+	graduated := []Tier{{UpTo: upTo(10), UnitPrice: 1}, {UpTo: upTo(20), UnitPrice: 0.5}, {UnitPrice: 0.1}}
+	limited := []Tier{{UpTo: upTo(10), UnitPrice: 1}, {UpTo: upTo(20), UnitPrice: 0.5}}
+	tests := []struct {
+		name     string
+		price    Price
+		quantity float64
+		want     float64
+	}{
+		{"unit price", Price{UnitPrice: 0.5}, 10, 5},
+		{"within the allowance", Price{UnitPrice: 0.5, Included: 4}, 3, 0},
+		{"above the allowance", Price{UnitPrice: 0.5, Included: 4}, 10, 3},
+		{"graduated first tier", Price{Tiers: graduated}, 5, 5},
+		{"graduated on a limit", Price{Tiers: graduated}, 10, 10},
+		{"graduated last tier", Price{Tiers: graduated}, 25, 15.5},
+		{"graduated above the last limit", Price{Tiers: limited}, 30, 20},
+		{"graduated above the allowance", Price{Tiers: graduated, Included: 5}, 15, 10},
+		{"volume first tier", Price{Tiers: graduated, TierMode: TierVolume}, 10, 10},
+		{"volume second tier", Price{Tiers: graduated, TierMode: TierVolume}, 15, 7.5},
+		{"volume last tier", Price{Tiers: graduated, TierMode: TierVolume}, 25, 2.5},
+		{"volume above the last limit", Price{Tiers: limited, TierMode: TierVolume}, 30, 15},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.price.Charge(test.quantity); !near(got, test.want) {
+				t.Errorf("Charge(%g) = %g, want %g", test.quantity, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRoundTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity float64
+		seconds  int64
+		rounding string
+		want     float64
+	}{
+		{"no rounding", 2, 1800, "", 2},
+		{"unit rounding", 2, 1800, RoundUnit, 2},
+		{"up to the minute", 1, 90, RoundMinute, 4.0 / 3},
+		{"on the minute", 1, 120, RoundMinute, 1},
+		{"up to the hour", 0.5, 1800, RoundHour, 1},
+		{"on the hour", 1, 3600, RoundHour, 1},
+		{"no samples", 1, 0, RoundHour, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := roundTime(test.quantity, test.seconds, test.rounding); !near(got, test.want) {
+				t.Errorf("roundTime(%g, %d, %q) = %g, want %g", test.quantity, test.seconds, test.rounding, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanVersionRate(t *testing.T) {
+	plan := Plan{Name: "basic"}
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	vm1, vm2, vm3 := models.NewVMKey(nil, "pve", 101), models.NewVMKey(nil, "pve", 102), models.NewVMKey(nil, "pve", 103)
+	cpu := func(vm models.VMKey, hour int, quantity float64) HourlyUsage {
+		return HourlyUsage{VM: vm, Hour: day.Add(time.Duration(hour) * time.Hour), Seconds: 3600, Quantities: map[string]float64{MetricCPUHours: quantity}}
+	}
+	// The night window spans midnight in the timezone of the customer
+	night := Modifier{Name: "night", From: "22:00", To: "06:00", Factor: 0.5}
+	east := time.FixedZone("UTC+2", 2*60*60)
+
+	tests := []struct {
+		name     string
+		version  PlanVersion
+		fraction float64
+		loc      *time.Location
+		usage    []HourlyUsage
+		want     []RatedUsage
+	}{
+		{
+			name:     "unit price",
+			version:  PlanVersion{Prices: []Price{{Metric: MetricCPUHours, UnitPrice: 0.1}}},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm2, 0, 4), cpu(vm1, 0, 2), cpu(vm1, 1, 4)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 6, UnitPrice: 0.1, Amount: 0.6},
+				{VM: vm2, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 4, UnitPrice: 0.1, Amount: 0.4},
+			},
+		},
+		{
+			name:     "graduated tiers over every VM",
+			version:  PlanVersion{Prices: []Price{{Metric: MetricCPUHours, Tiers: []Tier{{UpTo: upTo(10), UnitPrice: 1}, {UnitPrice: 0.5}}}}},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm1, 0, 10), cpu(vm2, 0, 10)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 10, UnitPrice: 0.75, Amount: 7.5},
+				{VM: vm2, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 10, UnitPrice: 0.75, Amount: 7.5},
+			},
+		},
+		{
+			name:     "volume tiers",
+			version:  PlanVersion{Prices: []Price{{Metric: MetricCPUHours, TierMode: TierVolume, Tiers: []Tier{{UpTo: upTo(10), UnitPrice: 1}, {UnitPrice: 0.5}}}}},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm1, 0, 15), cpu(vm2, 0, 5)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 15, UnitPrice: 0.5, Amount: 7.5},
+				{VM: vm2, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 5, UnitPrice: 0.5, Amount: 2.5},
+			},
+		},
+		{
+			name:     "rounding remainder on the last line",
+			version:  PlanVersion{Prices: []Price{{Metric: MetricCPUHours, UnitPrice: 1.0 / 3}}},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm1, 0, 1), cpu(vm2, 0, 1), cpu(vm3, 0, 1)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 1, UnitPrice: 1.0 / 3, Amount: 0.33},
+				{VM: vm2, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 1, UnitPrice: 1.0 / 3, Amount: 0.33},
+				{VM: vm3, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 1, UnitPrice: 1.0 / 3, Amount: 0.34},
+			},
+		},
+		{
+			name:     "rounding to a whole unit",
+			version:  PlanVersion{Prices: []Price{{Metric: MetricCPUHours, UnitPrice: 0.5, Rounding: RoundUnit}}},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm1, 0, 0.2), cpu(vm1, 1, 0.3)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 1, UnitPrice: 0.5, Amount: 0.5},
+			},
+		},
+		{
+			name: "included allowance, fee and minimum charge",
+			version: PlanVersion{
+				Fee:           10,
+				MinimumCharge: 20,
+				Prices:        []Price{{Metric: MetricCPUHours, UnitPrice: 1, Included: 5}},
+			},
+			fraction: 1,
+			usage:    []HourlyUsage{cpu(vm1, 0, 8)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 8, UnitPrice: 3.0 / 8, Amount: 3},
+				{Metric: MetricFee, Description: "Fee of the plan basic", Quantity: 1, UnitPrice: 10, Amount: 10},
+				{Metric: MetricMinimumCharge, Description: "Minimum charge of the plan basic", Amount: 7},
+			},
+		},
+		{
+			name: "prorated to half the period",
+			version: PlanVersion{
+				Fee:    10,
+				Prices: []Price{{Metric: MetricCPUHours, UnitPrice: 1, Included: 10, Minimum: 10}},
+			},
+			fraction: 0.5,
+			usage:    []HourlyUsage{cpu(vm1, 0, 8)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 8, UnitPrice: 3.0 / 8, Amount: 3},
+				{Metric: MetricFee, Description: "Fee of the plan basic", Quantity: 0.5, UnitPrice: 10, Amount: 5},
+				{Metric: MetricCPUHours, Description: "Minimum charge: cpu_hours", Amount: 2},
+			},
+		},
+		{
+			name: "modifier window crossing midnight",
+			version: PlanVersion{
+				Prices:    []Price{{Metric: MetricCPUHours, UnitPrice: 1}},
+				Modifiers: []Modifier{night},
+			},
+			fraction: 1,
+			loc:      east,
+			// 06:00, 23:00 and 05:00 in the timezone of the customer
+			usage: []HourlyUsage{cpu(vm1, 4, 1), cpu(vm1, 21, 1), cpu(vm1, 27, 1)},
+			want: []RatedUsage{
+				{VM: vm1, Metric: MetricCPUHours, Description: MetricCPUHours, Quantity: 1, UnitPrice: 1, Amount: 1},
+				{VM: vm1, Metric: MetricCPUHours, Description: "cpu_hours (night)", Quantity: 2, UnitPrice: 0.5, Amount: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loc := test.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			checkLines(t, test.version.prorated(test.fraction).rate(plan, loc, test.usage), test.want)
+		})
+	}
+}
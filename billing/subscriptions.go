@@ -0,0 +1,155 @@
+package billing
+
+import (
+	"billingo/models"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// segment is a part of an invoice period rated with a single plan. The
+// segments of the customer cover the whole period, those of a VM override
+// them for its usage.
+type segment struct {
+	// plan is the subscribed plan, the plan of the customer when empty
+	plan     string
+	from, to time.Time
+	// vm is the subscription of the VM of a segment
+	vm    *models.Subscription
+	usage []HourlyUsage
+}
+
+// subscriptionSegments splits the period between the subscriptions, the
+// parts of the period without a subscription of the customer are rated with
+// the plan of the customer
+func subscriptionSegments(subscriptions []models.Subscription, from, to time.Time) (customer, vms []*segment) {
+	clip := func(subscription models.Subscription) (time.Time, time.Time) {
+		start, end := subscription.StartTime, to
+		if start.Before(from) {
+			start = from
+		}
+		if subscription.EndTime != nil && subscription.EndTime.Before(end) {
+			end = *subscription.EndTime
+		}
+		return start, end
+	}
+
+	covered := from
+	for _, subscription := range subscriptions {
+		start, end := clip(subscription)
+		if subscription.VMID != nil {
+			vms = append(vms, &segment{plan: subscription.Plan, from: start, to: end, vm: &subscription})
+			continue
+		}
+		if start.After(covered) {
+			customer = append(customer, &segment{from: covered, to: start})
+		}
+		customer = append(customer, &segment{plan: subscription.Plan, from: start, to: end})
+		covered = end
+	}
+	if covered.Before(to) {
+		customer = append(customer, &segment{from: covered, to: to})
+	}
+	return customer, vms
+}
+
+// rateSubscriptions rates the usage of the customer with the plans it was
+// subscribed to over the period. Each segment of the period is rated on its
+// own, its lines mention the plan and the dates when the period is split.
+func rateSubscriptions(plans Plans, defaultPlan string, customer models.Customer, subscriptions []models.Subscription, usage []HourlyUsage, from, to time.Time, loc *time.Location) (Plan, []RatedUsage, error) {
+	customerSegments, vmSegments := subscriptionSegments(subscriptions, from, to)
+	for _, hour := range usage {
+		// The partial hour at the start of the period belongs to it
+		at := hour.Hour
+		if at.Before(from) {
+			at = from
+		}
+		index := slices.IndexFunc(vmSegments, func(s *segment) bool {
+			return hour.VM.Matches(s.vm.SiteID, s.vm.Cluster, *s.vm.VMID) && !at.Before(s.from) && at.Before(s.to)
+		})
+		if index >= 0 {
+			vmSegments[index].usage = append(vmSegments[index].usage, hour)
+			continue
+		}
+		index = slices.IndexFunc(customerSegments, func(s *segment) bool {
+			return !at.Before(s.from) && at.Before(s.to)
+		})
+		if index >= 0 {
+			customerSegments[index].usage = append(customerSegments[index].usage, hour)
+		}
+	}
+
+	var segments []*segment
+	for _, s := range append(customerSegments, vmSegments...) {
+		// Without subscriptions the whole period is rated with the plan of
+		// the customer, otherwise only the parts with usage
+		if s.plan == "" && len(subscriptions) > 0 && len(s.usage) == 0 {
+			continue
+		}
+		segments = append(segments, s)
+	}
+
+	var rated []RatedUsage
+	var names []string
+	currency := ""
+	for _, s := range segments {
+		var plan Plan
+		var err error
+		if s.plan == "" {
+			plan, err = plans.ForCustomer(customer, defaultPlan)
+		} else if subscribed, exists := plans[s.plan]; exists {
+			plan = subscribed
+		} else {
+			err = fmt.Errorf("subscribed price plan %q of customer %d does not exist", s.plan, customer.ID)
+		}
+		if err != nil {
+			return Plan{}, nil, err
+		}
+		if currency != "" && plan.Currency != currency {
+			return Plan{}, nil, fmt.Errorf("the plans of customer %d are in %s and %s, an invoice has a single currency", customer.ID, currency, plan.Currency)
+		}
+		currency = plan.Currency
+		if !slices.Contains(names, plan.Name) {
+			names = append(names, plan.Name)
+		}
+
+		lines, err := rateSegment(plan, s.usage, s.from, s.to, to.Sub(from), loc)
+		if err != nil {
+			return Plan{}, nil, err
+		}
+		for i := range lines {
+			lines[i].Plan = plan.Name
+			// The fee and the minimums of the plan of a VM are bound to it
+			if s.vm != nil && lines[i].VM.VMID == 0 {
+				lines[i].VM = models.NewVMKey(s.vm.SiteID, s.vm.Cluster, *s.vm.VMID)
+			}
+			if len(segments) > 1 {
+				lines[i].Description += fmt.Sprintf(" [%s, %s to %s]", plan.Name, formatBound(s.from, loc), formatBound(s.to, loc))
+			}
+		}
+		rated = append(rated, lines...)
+	}
+	sort.SliceStable(rated, func(a, b int) bool {
+		return lineBefore(rated[a].VM, rated[b].VM)
+	})
+	return Plan{Name: strings.Join(names, ", "), Currency: currency}, rated, nil
+}
+
+// lineBefore sorts the lines by VM, the lines not bound to a VM last
+func lineBefore(a, b models.VMKey) bool {
+	if (a.VMID == 0) != (b.VMID == 0) {
+		return b.VMID == 0
+	}
+	return a.Less(b)
+}
+
+// formatBound formats a bound of a segment in the timezone of the customer
+func formatBound(at time.Time, loc *time.Location) string {
+	at = at.In(loc)
+	if at.Hour() == 0 && at.Minute() == 0 {
+		return at.Format(time.DateOnly)
+	}
+	return at.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,82 @@
+package billing
+
+import (
+	"billingo/models"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionSegments(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	from, to := day(1), day(31)
+	vmid := 101
+	subscription := func(plan string, start time.Time, end *time.Time) models.Subscription {
+		return models.Subscription{CustomerID: 1, Plan: plan, StartTime: start, EndTime: end}
+	}
+	end := func(d int) *time.Time {
+		at := day(d)
+		return &at
+	}
+	vmSubscription := subscription("vm", day(5), end(10))
+	vmSubscription.VMID = &vmid
+
+	type bounds struct {
+		plan     string
+		from, to time.Time
+	}
+	tests := []struct {
+		name          string
+		subscriptions []models.Subscription
+		customer, vms []bounds
+	}{
+		{
+			name:     "no subscription",
+			customer: []bounds{{"", from, to}},
+		},
+		{
+			name:          "during the period",
+			subscriptions: []models.Subscription{subscription("pro", day(10), end(20))},
+			customer:      []bounds{{"", from, day(10)}, {"pro", day(10), day(20)}, {"", day(20), to}},
+		},
+		{
+			name:          "across the period",
+			subscriptions: []models.Subscription{subscription("pro", day(1).AddDate(0, -1, 0), nil)},
+			customer:      []bounds{{"pro", from, to}},
+		},
+		{
+			name:          "plan change",
+			subscriptions: []models.Subscription{subscription("basic", from, end(15)), subscription("pro", day(15), end(31))},
+			customer:      []bounds{{"basic", from, day(15)}, {"pro", day(15), to}},
+		},
+		{
+			name:          "subscription of a VM",
+			subscriptions: []models.Subscription{vmSubscription, subscription("pro", day(20), nil)},
+			customer:      []bounds{{"", from, day(20)}, {"pro", day(20), to}},
+			vms:           []bounds{{"vm", day(5), day(10)}},
+		},
+	}
+	check := func(t *testing.T, kind string, got []*segment, want []bounds) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %d %s segments, want %d", len(got), kind, len(want))
+		}
+		for i, s := range got {
+			if s.plan != want[i].plan || !s.from.Equal(want[i].from) || !s.to.Equal(want[i].to) {
+				t.Errorf("%s segment %d is %s from %s to %s, want %s from %s to %s", kind, i,
+					s.plan, s.from, s.to, want[i].plan, want[i].from, want[i].to)
+			}
+			if (s.vm != nil) != (kind == "VM") {
+				t.Errorf("%s segment %d has subscription of VM %v", kind, i, s.vm)
+			}
+		}
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			customer, vms := subscriptionSegments(test.subscriptions, from, to)
+			check(t, "customer", customer, test.customer)
+			check(t, "VM", vms, test.vms)
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package billing
+
+import (
+	"billingo/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInsufficientBalance is returned when a refund or an adjustment would
+	// take the wallet below its credit limit
+	ErrInsufficientBalance = errors.New("the balance of the wallet is too low")
+	// ErrIdempotencyConflict is returned when the idempotency key of a
+	// transaction was already used for a different one
+	ErrIdempotencyConflict = errors.New("the idempotency key was already used for another transaction")
+)
+
+// walletContra is the account each kind of transaction moves the balance of
+// the wallet from or to
+var walletContra = map[string]string{
+	models.WalletTopUp:      models.AccountCash,
+	models.WalletRefund:     models.AccountCash,
+	models.WalletUsage:      models.AccountRevenue,
+	models.WalletAdjustment: models.AccountAdjustments,
+}
+
+// WalletEntry is a transaction to post on the wallet of a customer. The
+// amount of the top-ups and refunds is positive, it is credited to the
+// wallet or debited from it by its kind. The adjustments credit a positive
+// amount and debit a negative one.
+type WalletEntry struct {
+	Kind           string
+	IdempotencyKey string
+	Description    string
+	Amount         float64
+}
+
+// Validate checks the kind and the amount of the entry, the usage is only
+// debited by DebitUsage
+func (e WalletEntry) Validate() error {
+	var errs []error
+	switch e.Kind {
+	case models.WalletTopUp, models.WalletRefund:
+		if e.Amount <= 0 {
+			errs = append(errs, errors.New("amount must be positive"))
+		}
+	case models.WalletAdjustment:
+		if RoundAmount(e.Amount) == 0 {
+			errs = append(errs, errors.New("amount must not be zero"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("kind %q is not top_up, refund or adjustment", e.Kind))
+	}
+	if e.IdempotencyKey == "" {
+		errs = append(errs, errors.New("idempotency_key is required"))
+	}
+	return errors.Join(errs...)
+}
+
+// PostWalletEntry posts the entry on the wallet of the customer. A refund or
+// a debiting adjustment is refused when the balance would fall below the
+// credit limit. Posting an entry again with the same idempotency key returns
+// the transaction of the first post, created reports whether it is new.
+func PostWalletEntry(db *gorm.DB, customerID uint, entry WalletEntry, creditLimit float64) (transaction *models.WalletTransaction, created bool, err error) {
+	if err := entry.Validate(); err != nil {
+		return nil, false, err
+	}
+	amount := RoundAmount(entry.Amount)
+	if entry.Kind == models.WalletRefund {
+		amount = -amount
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockCustomer(tx, customerID); err != nil {
+			return err
+		}
+		existing, err := walletTransaction(tx, customerID, entry.Kind, entry.IdempotencyKey, amount)
+		if err != nil || existing != nil {
+			transaction = existing
+			return err
+		}
+		if amount < 0 {
+			balance, err := models.WalletBalance(tx, customerID)
+			if err != nil {
+				return err
+			}
+			if RoundAmount(balance+amount) < -creditLimit {
+				return ErrInsufficientBalance
+			}
+		}
+		transaction, err = postWallet(tx, models.WalletTransaction{
+			CustomerID:     customerID,
+			Kind:           entry.Kind,
+			IdempotencyKey: entry.IdempotencyKey,
+			Description:    entry.Description,
+			Amount:         amount,
+		})
+		created = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		log.WithField("customer", customerID).Infof("Posted %s of %.2f on the wallet", entry.Kind, amount)
+	}
+	return transaction, created, nil
+}
+
+// walletTransaction returns the transaction posted with the idempotency key,
+// nil when there is none. It must match the one being posted.
+func walletTransaction(tx *gorm.DB, customerID uint, kind, key string, amount float64) (*models.WalletTransaction, error) {
+	var transactions []models.WalletTransaction
+	err := tx.Preload("Postings", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Where("idempotency_key = ?", key).
+		Limit(1).
+		Find(&transactions).Error
+	if err != nil || len(transactions) == 0 {
+		return nil, err
+	}
+	transaction := transactions[0]
+	if transaction.CustomerID != customerID || transaction.Kind != kind || transaction.Amount != amount {
+		return nil, ErrIdempotencyConflict
+	}
+	return &transaction, nil
+}
+
+// postWallet records the transaction with its two postings: the wallet is
+// credited with the amount and the contra account of the kind debited, or
+// the other way round for a negative amount
+func postWallet(tx *gorm.DB, transaction models.WalletTransaction) (*models.WalletTransaction, error) {
+	transaction.Postings = []models.WalletPosting{
+		{CustomerID: transaction.CustomerID, Account: models.AccountWallet, Amount: -transaction.Amount},
+		{CustomerID: transaction.CustomerID, Account: walletContra[transaction.Kind], Amount: transaction.Amount},
+	}
+	if err := tx.Create(&transaction).Error; err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// WalletStatus is the balance of the wallet of a customer
+type WalletStatus struct {
+	CustomerID  uint    `json:"customer_id"`
+	Balance     float64 `json:"balance"`
+	CreditLimit float64 `json:"credit_limit"`
+	// BelowLimit reports a balance fallen below the credit limit, the usage
+	// is still debited
+	BelowLimit bool `json:"below_limit"`
+}
+
+// GetWalletStatus returns the balance of the wallet of the customer
+func GetWalletStatus(db *gorm.DB, customerID uint, creditLimit float64) (*WalletStatus, error) {
+	balance, err := models.WalletBalance(db, customerID)
+	if err != nil {
+		return nil, err
+	}
+	balance = RoundAmount(balance)
+	return &WalletStatus{
+		CustomerID:  customerID,
+		Balance:     balance,
+		CreditLimit: creditLimit,
+		BelowLimit:  balance < -creditLimit,
+	}, nil
+}
+
+// billingCycle returns the calendar month of loc including the time
+func billingCycle(at time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := at.In(loc)
+	start := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// DebitUsage debits the wallet of a prepaid customer with the usage rated
+// since the last debit. The whole billing cycle, the calendar month in the
+// timezone of the customer, is rated with the usage collected until now: the
+// fees, minimums and committed use of the cycle are debited from its start
+// and the usage as it is collected. The previous cycle is settled too, for
+// the samples received late, until settle after its end. A usage rated lower
+// than already debited, after a correction, is credited back. The usage is
+// rated before the customer is locked, only the debit is posted under the
+// lock. It is debited whatever the balance, it returns the transactions posted.
+// A cycle invoiced before the customer was prepaid is not debited again.
+func DebitUsage(db *gorm.DB, plans Plans, defaultPlan string, customerID uint, settle time.Duration, now time.Time) ([]models.WalletTransaction, error) {
+	var customer models.Customer
+	if err := db.First(&customer, customerID).Error; err != nil {
+		return nil, err
+	}
+	loc, err := customer.Location()
+	if err != nil {
+		return nil, fmt.Errorf("timezone of customer %d: %w", customer.ID, err)
+	}
+
+	type cycle struct {
+		start, end time.Time
+		total      float64
+	}
+	current, _ := billingCycle(now, loc)
+	var cycles []cycle
+	if previous := current.AddDate(0, -1, 0); now.Before(current.Add(settle)) {
+		cycles = append(cycles, cycle{start: previous, end: current})
+	}
+	cycles = append(cycles, cycle{start: current, end: current.AddDate(0, 1, 0)})
+	for i := range cycles {
+		_, rated, _, err := rateCustomer(db, plans, defaultPlan, customer, cycles[i].start, cycles[i].end, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, usage := range rated {
+			cycles[i].total += usage.Amount
+		}
+	}
+
+	var posted []models.WalletTransaction
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockCustomer(tx, customerID); err != nil {
+			return err
+		}
+		for _, cycle := range cycles {
+			if err := checkNotInvoiced(tx, customerID, cycle.start, &cycle.end); errors.Is(err, ErrPeriodInvoiced) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			debited, err := models.DebitedUsage(tx, customerID, cycle.start)
+			if err != nil {
+				return err
+			}
+			delta := RoundAmount(cycle.total - debited)
+			if delta == 0 {
+				continue
+			}
+
+			start, to := cycle.start, now
+			if to.After(cycle.end) {
+				to = cycle.end
+			}
+			transaction, err := postWallet(tx, models.WalletTransaction{
+				CustomerID:     customerID,
+				Kind:           models.WalletUsage,
+				IdempotencyKey: fmt.Sprintf("usage:%d:%d:%d", customerID, start.Unix(), now.Unix()),
+				Description:    "Usage of " + start.Format("January 2006"),
+				Amount:         -delta,
+				PeriodStart:    &start,
+				PeriodEnd:      &to,
+			})
+			if err != nil {
+				return err
+			}
+			posted = append(posted, *transaction)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, transaction := range posted {
+		log.WithField("customer", customerID).Debugf("Debited %.2f of usage from the wallet", -transaction.Amount)
+	}
+	return posted, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"billingo/auth"
+	"billingo/billing"
+	"billingo/config"
+	"billingo/models"
+	"billingo/secrets"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runCommand runs one of the administrative commands instead of the service.
+// confErr holds the problems of the configuration, only the commands that
+// help fixing it run despite them.
+func runCommand(conf *config.Config, confErr error, command string, args []string) {
+	switch command {
+	case "check-config":
+		checkConfig(conf, confErr)
+		return
+	case "keystore":
+		keystoreCommand(conf, args)
+		return
+	case "generate-signing-key":
+		generateSigningKey()
+		return
+	}
+
+	if confErr != nil {
+		log.Fatalf("Invalid configuration:\n%v", confErr)
+	}
+	switch command {
+	case "create-api-key":
+		createAPIKey(conf, args)
+	case "verify-ledger":
+		verifyLedger(conf, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		fmt.Fprintln(os.Stderr, "available commands: check-config, create-api-key, generate-signing-key, keystore, verify-ledger")
+		os.Exit(2)
+	}
+}
+
+// checkConfig prints the effective configuration with the secrets masked and
+// every problem found, exiting with an error status if it is invalid
+func checkConfig(conf *config.Config, err error) {
+	out, marshalErr := yaml.Marshal(conf.Masked())
+	if marshalErr != nil {
+		log.Fatal(marshalErr)
+	}
+	fmt.Print(string(out))
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\ninvalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "\nconfiguration is valid")
+}
+
+// createAPIKey creates an API key from the command line, used to bootstrap the
+// first admin key since the key endpoints themselves require one.
+func createAPIKey(conf *config.Config, args []string) {
+	flags := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	name := flags.String("name", "", "name of the key")
+	scopes := flags.String("scopes", string(auth.ScopeAdmin), "comma separated list of scopes")
+	customerID := flags.Uint("customer", 0, "restrict the key to the VMs of this customer")
+	expiresIn := flags.Duration("expires-in", 0, "validity of the key, it never expires if not set")
+	flags.Parse(args)
+
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+	var expiresAt *time.Time
+	if *expiresIn > 0 {
+		expiration := time.Now().Add(*expiresIn)
+		expiresAt = &expiration
+	}
+
+	var customer *uint
+	if *customerID > 0 {
+		id := uint(*customerID)
+		customer = &id
+	}
+
+	db := models.SetupModels(conf)
+	key, plain, err := auth.CreateKey(db, *name, *scopes, customer, expiresAt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Created API key %d (%s) with scopes %s\n", key.ID, key.Name, key.Scopes)
+	fmt.Println(plain)
+}
+
+// verifyLedger re-checks the hash chain of the billing ledger, exiting with an
+// error status if it was tampered with
+func verifyLedger(conf *config.Config, args []string) {
+	flags := flag.NewFlagSet("verify-ledger", flag.ExitOnError)
+	customerID := flags.Uint("customer", 0, "only verify the ledger of this customer")
+	samples := flags.Bool("samples", false, "also verify the digests of the rated samples")
+	flags.Parse(args)
+
+	var customer *uint
+	if *customerID > 0 {
+		id := uint(*customerID)
+		customer = &id
+	}
+
+	db := models.SetupModels(conf)
+	report, err := billing.VerifyLedger(db, customer, *samples)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Verified %d entries and %d invoices of %d customers\n", report.Entries, report.Invoices, report.Customers)
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	for _, problem := range report.Errors {
+		fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+	}
+	if !report.Valid {
+		fmt.Fprintln(os.Stderr, "the ledger is invalid")
+		os.Exit(1)
+	}
+	fmt.Println("the ledger is valid")
+}
+
+// generateSigningKey prints a new Ed25519 key pair for an edge site. The
+// private key goes to mqtt.publisher.signing_key of the site, the public key
+// to its registration on the central side.
+func generateSigningKey() {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("signing_key: %s\n", base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Printf("public_key: %s\n", base64.StdEncoding.EncodeToString(public))
+}
+
+// keystoreCommand manages the entries of the keystore configured in
+// secrets.keystore_path. Values are read from stdin to keep them out of the
+// shell history.
+func keystoreCommand(conf *config.Config, args []string) {
+	usage := "usage: keystore list | set <name> | delete <name>"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+	if conf.Secrets.KeystorePath == "" {
+		log.Fatal("secrets.keystore_path is not configured")
+	}
+	keystore, err := secrets.OpenKeystore(conf.Secrets.KeystorePath, conf.Secrets.KeystorePassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, name := range keystore.Names() {
+			fmt.Println(name)
+		}
+		return
+	case args[0] == "set" && len(args) == 2:
+		fmt.Fprintf(os.Stderr, "Value of %s: ", args[1])
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		value = strings.TrimRight(value, "\r\n")
+		if value == "" {
+			log.Fatalf("No value read: %v", err)
+		}
+		if err := keystore.Set(args[1], value); err != nil {
+			log.Fatal(err)
+		}
+	case args[0] == "delete" && len(args) == 2:
+		keystore.Delete(args[1])
+	default:
+		log.Fatal(usage)
+	}
+
+	if err := keystore.Save(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Saved keystore %s\n", conf.Secrets.KeystorePath)
+}
@@ -1,27 +1,278 @@
 package config
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+
+	"billingo/logging"
+	"billingo/secrets"
 
 	"github.com/joho/godotenv"
-	log "github.com/sirupsen/logrus"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
+var log = logging.For("config")
+
+// Config is the configuration of the application. Each field can be set, in
+// increasing order of precedence, by its `default` tag, the preset of the
+// current ENVIRONMENT, the config file and the environment variable in its
+// `config` tag. Fields tagged `secret` are masked when printed and may hold a
+// secret reference, see ResolveSecrets.
 type Config struct {
-	GinPort                 string `config:"PORT"`
-	SecretKey               string `config:"SECRET_KEY"`
-	LogLevel                string `config:"LOG_LEVEL"`
-	DBName                  string `config:"POSTGRES_NAME"`
-	DBHost                  string `config:"POSTGRES_HOST"`
-	DBPort                  string `config:"POSTGRES_PORT"`
-	DBUser                  string `config:"POSTGRES_USER"`
-	DBPassword              string `config:"POSTGRES_PWD"`
-	CompressionIntervalDays int    `config:"COMPRESSION_INTERVAL_DAYS"`
+	GinPort         string `config:"PORT" default:"5000" yaml:"port" toml:"port"`
+	SecretKey       string `config:"SECRET_KEY" secret:"true" yaml:"secret_key" toml:"secret_key"`
+	LogLevel        string `config:"LOG_LEVEL" default:"INFO" yaml:"log_level" toml:"log_level"`
+	LogFormat       string `config:"LOG_FORMAT" default:"text" yaml:"log_format" toml:"log_format"`
+	LogLevels       string `config:"LOG_LEVELS" yaml:"log_levels" toml:"log_levels"`
+	TokenTTLMinutes int    `config:"TOKEN_TTL_MINUTES" default:"60" yaml:"token_ttl_minutes" toml:"token_ttl_minutes"`
+	// MetricsToken lets a Prometheus server scrape /metrics/vms with a static
+	// bearer token instead of an access token with the metrics:read scope
+	MetricsToken       string         `config:"METRICS_TOKEN" secret:"true" yaml:"metrics_token" toml:"metrics_token"`
+	CorsAllowedOrigins string         `config:"CORS_ALLOWED_ORIGINS" yaml:"cors_allowed_origins" toml:"cors_allowed_origins"`
+	Database           DatabaseConfig `yaml:"database" toml:"database"`
+	Proxmox            ProxmoxConfig  `yaml:"proxmox" toml:"proxmox"`
+	MQTT               MQTTConfig     `yaml:"mqtt" toml:"mqtt"`
+	Sinks              []SinkConfig   `config:"SINK" yaml:"sinks" toml:"sinks"`
+	Tasks              TasksConfig    `yaml:"tasks" toml:"tasks"`
+	Billing            BillingConfig  `yaml:"billing" toml:"billing"`
+	Secrets            SecretsConfig  `yaml:"secrets" toml:"secrets"`
+
+	// lock guards the secrets re-read while the service runs
+	lock *sync.RWMutex
+	// refs maps the secret fields set from a reference to the reference
+	refs map[string]string
+}
+
+// DatabaseConfig configures the PostgreSQL/TimescaleDB connection
+type DatabaseConfig struct {
+	Name                    string `config:"POSTGRES_NAME" yaml:"name" toml:"name"`
+	Host                    string `config:"POSTGRES_HOST" yaml:"host" toml:"host"`
+	Port                    string `config:"POSTGRES_PORT" default:"5432" yaml:"port" toml:"port"`
+	User                    string `config:"POSTGRES_USER" yaml:"user" toml:"user"`
+	Password                string `config:"POSTGRES_PWD" secret:"true" yaml:"password" toml:"password"`
+	CompressionIntervalDays int    `config:"COMPRESSION_INTERVAL_DAYS" default:"90" yaml:"compression_interval_days" toml:"compression_interval_days"`
+	// RetentionDays drops the collected data older than this, 0 keeps it forever
+	RetentionDays int `config:"RETENTION_DAYS" yaml:"retention_days" toml:"retention_days"`
+}
+
+// ProxmoxConfig lists the Proxmox clusters the collector fetches from. The
+// clusters can also be set from the environment as PROXMOX_CLUSTER_<n>_<field>.
+type ProxmoxConfig struct {
+	Clusters []ProxmoxCluster `config:"PROXMOX_CLUSTER" yaml:"clusters" toml:"clusters"`
+}
+
+// ProxmoxCluster is the API endpoint and token of a Proxmox cluster
+type ProxmoxCluster struct {
+	Name           string `config:"NAME" yaml:"name" toml:"name"`
+	URL            string `config:"URL" yaml:"url" toml:"url"`
+	Token          string `config:"TOKEN" secret:"true" yaml:"token" toml:"token"`
+	TimeoutSeconds int    `config:"TIMEOUT_SECONDS" default:"10" yaml:"timeout_seconds" toml:"timeout_seconds"`
+}
+
+// MQTTConfig configures the edge publisher and the central subscriber
+type MQTTConfig struct {
+	Publisher  MQTTPublisherConfig  `yaml:"publisher" toml:"publisher"`
+	Subscriber MQTTSubscriberConfig `yaml:"subscriber" toml:"subscriber"`
+}
+
+// MQTTPublisherConfig configures the publishing of collected data to a broker.
+// The topic is a template, {cluster}, {customer} and {vmid} are replaced by
+// the values of the samples so each message only carries matching samples.
+type MQTTPublisherConfig struct {
+	Enabled   bool   `config:"MQTT_PUBLISHER_ENABLED" yaml:"enabled" toml:"enabled"`
+	BrokerURL string `config:"MQTT_PUBLISHER_BROKER" yaml:"broker_url" toml:"broker_url"`
+	Topic     string `config:"MQTT_PUBLISHER_TOPIC" yaml:"topic" toml:"topic"`
+	Username  string `config:"MQTT_PUBLISHER_USERNAME" yaml:"username" toml:"username"`
+	Password  string `config:"MQTT_PUBLISHER_PASSWORD" secret:"true" yaml:"password" toml:"password"`
+	QoS       int    `config:"MQTT_PUBLISHER_QOS" default:"2" yaml:"qos" toml:"qos"`
+	// BatchSize is the number of samples per message
+	BatchSize int `config:"MQTT_PUBLISHER_BATCH_SIZE" default:"100" yaml:"batch_size" toml:"batch_size"`
+	// PageSize is the number of pending rows read from the database at once
+	PageSize int `config:"MQTT_PUBLISHER_PAGE_SIZE" default:"1000" yaml:"page_size" toml:"page_size"`
+	// ClientID must be unique per collector, it defaults to one derived from the host name
+	ClientID          string `config:"MQTT_PUBLISHER_CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	PersistentSession bool   `config:"MQTT_PUBLISHER_PERSISTENT_SESSION" default:"true" yaml:"persistent_session" toml:"persistent_session"`
+	// StatusTopic receives a retained online message on connect and the offline
+	// Last Will, {client_id} is replaced. An empty topic disables it.
+	StatusTopic string        `config:"MQTT_PUBLISHER_STATUS_TOPIC" default:"billingo/status/{client_id}" yaml:"status_topic" toml:"status_topic"`
+	TLS         MQTTTLSConfig `config:"MQTT_PUBLISHER_TLS" yaml:"tls" toml:"tls"`
+	// AckTopic receives the acknowledgements of the central side, {client_id}
+	// is replaced. Rows are only marked synced once acknowledged, batches not
+	// acknowledged within AckTimeoutSeconds are sent again. An empty topic marks
+	// the rows synced as soon as the broker accepts them.
+	AckTopic          string `config:"MQTT_PUBLISHER_ACK_TOPIC" default:"billingo/ack/{client_id}" yaml:"ack_topic" toml:"ack_topic"`
+	AckTimeoutSeconds int    `config:"MQTT_PUBLISHER_ACK_TIMEOUT_SECONDS" default:"120" yaml:"ack_timeout_seconds" toml:"ack_timeout_seconds"`
+	// MaxAttempts is the number of publications of a row before it is dead,
+	// failed rows are retried after a backoff doubling from RetryBackoffSeconds
+	// up to RetryMaxBackoffSeconds
+	MaxAttempts            int `config:"MQTT_PUBLISHER_MAX_ATTEMPTS" default:"10" yaml:"max_attempts" toml:"max_attempts"`
+	RetryBackoffSeconds    int `config:"MQTT_PUBLISHER_RETRY_BACKOFF_SECONDS" default:"30" yaml:"retry_backoff_seconds" toml:"retry_backoff_seconds"`
+	RetryMaxBackoffSeconds int `config:"MQTT_PUBLISHER_RETRY_MAX_BACKOFF_SECONDS" default:"3600" yaml:"retry_max_backoff_seconds" toml:"retry_max_backoff_seconds"`
+	// CommandTopic receives the commands of the central side, {client_id} is
+	// replaced. Commands are only accepted when addressed to Site, the name of
+	// the site of the collector, signed with the key of CommandPublicKey and
+	// issued less than CommandMaxAgeSeconds ago, none without a public key.
+	// Their results are signed with SigningKey.
+	CommandTopic         string `config:"MQTT_PUBLISHER_COMMAND_TOPIC" default:"billingo/command/{client_id}" yaml:"command_topic" toml:"command_topic"`
+	Site                 string `config:"MQTT_PUBLISHER_SITE" yaml:"site" toml:"site"`
+	CommandPublicKey     string `config:"MQTT_PUBLISHER_COMMAND_PUBLIC_KEY" yaml:"command_public_key" toml:"command_public_key"`
+	CommandMaxAgeSeconds int    `config:"MQTT_PUBLISHER_COMMAND_MAX_AGE_SECONDS" default:"300" yaml:"command_max_age_seconds" toml:"command_max_age_seconds"`
+	// SigningKey is the base64 Ed25519 private key of the site the batches are
+	// signed with, as generated by the generate-signing-key command
+	SigningKey string `config:"MQTT_PUBLISHER_SIGNING_KEY" secret:"true" yaml:"signing_key" toml:"signing_key"`
+}
+
+// MQTTSubscriberConfig configures the reception of data published by edge sites
+type MQTTSubscriberConfig struct {
+	Enabled   bool   `config:"MQTT_SUBSCRIBER_ENABLED" yaml:"enabled" toml:"enabled"`
+	BrokerURL string `config:"MQTT_SUBSCRIBER_BROKER" yaml:"broker_url" toml:"broker_url"`
+	Topic     string `config:"MQTT_SUBSCRIBER_TOPIC" yaml:"topic" toml:"topic"`
+	Username  string `config:"MQTT_SUBSCRIBER_USERNAME" yaml:"username" toml:"username"`
+	Password  string `config:"MQTT_SUBSCRIBER_PASSWORD" secret:"true" yaml:"password" toml:"password"`
+	QoS       int    `config:"MQTT_SUBSCRIBER_QOS" default:"1" yaml:"qos" toml:"qos"`
+	// ClientID must be unique per instance, it defaults to one derived from the host name
+	ClientID string `config:"MQTT_SUBSCRIBER_CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	// PersistentSession makes the broker queue the messages received while disconnected
+	PersistentSession bool          `config:"MQTT_SUBSCRIBER_PERSISTENT_SESSION" default:"true" yaml:"persistent_session" toml:"persistent_session"`
+	TLS               MQTTTLSConfig `config:"MQTT_SUBSCRIBER_TLS" yaml:"tls" toml:"tls"`
+	// DeadLetterTopic receives the messages and samples rejected by the
+	// validation, an empty topic only logs them
+	DeadLetterTopic string `config:"MQTT_SUBSCRIBER_DEAD_LETTER_TOPIC" default:"billingo/dead-letter" yaml:"dead_letter_topic" toml:"dead_letter_topic"`
+	// The received samples are inserted once BatchSize are buffered, or after
+	// FlushIntervalSeconds. The messages are acknowledged once inserted.
+	BatchSize            int `config:"MQTT_SUBSCRIBER_BATCH_SIZE" default:"500" yaml:"batch_size" toml:"batch_size"`
+	FlushIntervalSeconds int `config:"MQTT_SUBSCRIBER_FLUSH_INTERVAL_SECONDS" default:"2" yaml:"flush_interval_seconds" toml:"flush_interval_seconds"`
+	// The received samples are promoted from data_raw into data every
+	// PromoteIntervalSeconds, at most PromoteBatchSize at once
+	PromoteIntervalSeconds int `config:"MQTT_SUBSCRIBER_PROMOTE_INTERVAL_SECONDS" default:"60" yaml:"promote_interval_seconds" toml:"promote_interval_seconds"`
+	PromoteBatchSize       int `config:"MQTT_SUBSCRIBER_PROMOTE_BATCH_SIZE" default:"5000" yaml:"promote_batch_size" toml:"promote_batch_size"`
+	// RequireSite rejects the messages of the topics not registered to an edge site
+	RequireSite bool `config:"MQTT_SUBSCRIBER_REQUIRE_SITE" default:"true" yaml:"require_site" toml:"require_site"`
+	// Commands are sent to the sites signed with CommandSigningKey, as
+	// generated by the generate-signing-key command, the sites only hold its
+	// public key. Their results are received on ResultTopic/<site id>, signed
+	// with the key of the site. No command is sent without a signing key.
+	ResultTopic       string `config:"MQTT_SUBSCRIBER_RESULT_TOPIC" default:"billingo/result" yaml:"result_topic" toml:"result_topic"`
+	CommandSigningKey string `config:"MQTT_SUBSCRIBER_COMMAND_SIGNING_KEY" secret:"true" yaml:"command_signing_key" toml:"command_signing_key"`
+	// RequireSignature quarantines the batches of the sites without a public
+	// key, the batches of a site with a key are always verified
+	RequireSignature bool `config:"MQTT_SUBSCRIBER_REQUIRE_SIGNATURE" default:"true" yaml:"require_signature" toml:"require_signature"`
+	// BrokerAuthToken enables the /broker endpoints the broker authenticates
+	// its clients with, it sends it as a bearer token. The sites may use the
+	// status and acknowledgement topics of their collectors, {client_id} is
+	// replaced.
+	BrokerAuthToken string `config:"MQTT_SUBSCRIBER_BROKER_AUTH_TOKEN" secret:"true" yaml:"broker_auth_token" toml:"broker_auth_token"`
+	SiteStatusTopic string `config:"MQTT_SUBSCRIBER_SITE_STATUS_TOPIC" default:"billingo/status/{client_id}" yaml:"site_status_topic" toml:"site_status_topic"`
+	SiteAckTopic    string `config:"MQTT_SUBSCRIBER_SITE_ACK_TOPIC" default:"billingo/ack/{client_id}" yaml:"site_ack_topic" toml:"site_ack_topic"`
+}
+
+// MQTTSinkName is the name of the MQTT publisher among the sinks
+const MQTTSinkName = "mqtt"
+
+// Types of the sinks
+const (
+	SinkHTTP = "http"
+	SinkNATS = "nats"
+	SinkFile = "file"
+)
+
+// SinkConfig configures a destination of the collected data besides the MQTT
+// publisher, each sink tracks and retries its deliveries on its own. The
+// sinks can also be set from the environment as SINK_<n>_<field>.
+//
+//	http  posts each batch as JSON to URL, with Token as bearer token
+//	nats  publishes each batch on Subject of the NATS server at URL, through
+//	      JetStream when enabled so the stream acknowledges it
+//	file  appends each sample as a JSON line to Path
+type SinkConfig struct {
+	Name  string `config:"NAME" yaml:"name" toml:"name"`
+	Type  string `config:"TYPE" yaml:"type" toml:"type"`
+	URL   string `config:"URL" yaml:"url" toml:"url"`
+	Token string `config:"TOKEN" secret:"true" yaml:"token" toml:"token"`
+	// Subject is a template with the placeholders of the publisher topic
+	Subject        string `config:"SUBJECT" yaml:"subject" toml:"subject"`
+	JetStream      bool   `config:"JETSTREAM" yaml:"jetstream" toml:"jetstream"`
+	Path           string `config:"PATH" yaml:"path" toml:"path"`
+	TimeoutSeconds int    `config:"TIMEOUT_SECONDS" default:"10" yaml:"timeout_seconds" toml:"timeout_seconds"`
+	BatchSize      int    `config:"BATCH_SIZE" default:"100" yaml:"batch_size" toml:"batch_size"`
+	PageSize       int    `config:"PAGE_SIZE" default:"1000" yaml:"page_size" toml:"page_size"`
+	// The retries are as for the MQTT publisher
+	MaxAttempts            int `config:"MAX_ATTEMPTS" default:"10" yaml:"max_attempts" toml:"max_attempts"`
+	RetryBackoffSeconds    int `config:"RETRY_BACKOFF_SECONDS" default:"30" yaml:"retry_backoff_seconds" toml:"retry_backoff_seconds"`
+	RetryMaxBackoffSeconds int `config:"RETRY_MAX_BACKOFF_SECONDS" default:"3600" yaml:"retry_max_backoff_seconds" toml:"retry_max_backoff_seconds"`
+}
+
+// MQTTTLSConfig configures TLS for ssl://, tls://, mqtts:// and wss:// brokers.
+// The system roots are trusted when no CA file is set, a client certificate
+// enables mutual TLS and is read again on every connection.
+type MQTTTLSConfig struct {
+	CAFile             string `config:"CA_FILE" yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `config:"CERT_FILE" yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `config:"KEY_FILE" yaml:"key_file" toml:"key_file"`
+	ServerName         string `config:"SERVER_NAME" yaml:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `config:"INSECURE_SKIP_VERIFY" yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// TasksConfig configures the periodic tasks
+type TasksConfig struct {
+	CollectorEnabled         bool   `config:"COLLECTOR_ENABLED" default:"true" yaml:"collector_enabled" toml:"collector_enabled"`
+	MetricsIntervalMinutes   int    `config:"METRICS_INTERVAL_MINUTES" default:"50" yaml:"metrics_interval_minutes" toml:"metrics_interval_minutes"`
+	RRDTimeframe             string `config:"RRD_TIMEFRAME" default:"hour" yaml:"rrd_timeframe" toml:"rrd_timeframe"`
+	BufferPath               string `config:"BUFFER_PATH" default:"ObserverBufferTask" yaml:"buffer_path" toml:"buffer_path"`
+	BatchSaveIntervalSeconds int    `config:"BATCH_SAVE_INTERVAL_SECONDS" default:"120" yaml:"batch_save_interval_seconds" toml:"batch_save_interval_seconds"`
+	BatchSize                int    `config:"BATCH_SIZE" default:"3000" yaml:"batch_size" toml:"batch_size"`
+	PublishIntervalSeconds   int    `config:"PUBLISH_INTERVAL_SECONDS" default:"10" yaml:"publish_interval_seconds" toml:"publish_interval_seconds"`
+}
+
+// BillingConfig configures the rating of the collected usage
+type BillingConfig struct {
+	PricePlansPath string `config:"BILLING_PRICE_PLANS_PATH" yaml:"price_plans_path" toml:"price_plans_path"`
+	// DefaultPlan rates the usage of the customers without a plan
+	DefaultPlan string `config:"BILLING_DEFAULT_PLAN" yaml:"default_plan" toml:"default_plan"`
+	// WalletDebitIntervalSeconds is how often the usage of the prepaid
+	// customers is debited from their wallet
+	WalletDebitIntervalSeconds int `config:"BILLING_WALLET_DEBIT_INTERVAL_SECONDS" default:"300" yaml:"wallet_debit_interval_seconds" toml:"wallet_debit_interval_seconds"`
+	// WalletCreditLimit is how far below zero the balance of a wallet may
+	// fall, the refunds and adjustments going further are refused
+	WalletCreditLimit float64 `config:"BILLING_WALLET_CREDIT_LIMIT" yaml:"wallet_credit_limit" toml:"wallet_credit_limit"`
+	// WalletSettleHours is how long after its end a billing cycle is still
+	// debited for the samples received late, it is closed afterwards
+	WalletSettleHours int `config:"BILLING_WALLET_SETTLE_HOURS" default:"48" yaml:"wallet_settle_hours" toml:"wallet_settle_hours"`
+}
+
+// SecretsConfig configures the keystore and how often the secret references
+// are resolved again to pick up rotated credentials
+type SecretsConfig struct {
+	KeystorePath           string `config:"KEYSTORE_PATH" yaml:"keystore_path" toml:"keystore_path"`
+	KeystorePassphrase     string `config:"KEYSTORE_PASSPHRASE" secret:"true" yaml:"keystore_passphrase" toml:"keystore_passphrase"`
+	RefreshIntervalSeconds int    `config:"SECRETS_REFRESH_INTERVAL_SECONDS" default:"300" yaml:"refresh_interval_seconds" toml:"refresh_interval_seconds"`
+}
+
+// configDirectory returns where the config file is looked for, following the
+// same rules as the .env file
+func configDirectory() string {
+	if directory, hasPath := os.LookupEnv("BILLING_DIR"); hasPath {
+		return directory
+	}
+	if runtime.GOOS == "windows" {
+		executable, _ := os.Executable()
+		return filepath.Dir(filepath.FromSlash(executable)) + string(filepath.Separator)
+	}
+	return ""
 }
 
 // loadDotEnv load the configuration inside the application taking care
@@ -33,83 +284,481 @@ func loadDotEnv(environmentFile string) {
 	}
 	envFile, hasPath := os.LookupEnv("BILLING_DIR")
 	if hasPath {
-		log.Infof("Looking for Settings File at %v...\n", envFile)
+		log.Infof("Looking for Settings File at %v...", envFile)
 		godotenv.Load(envFile + environmentFile)
 	} else if runtime.GOOS == "windows" {
 		executable, _ := os.Executable()
 		executable = filepath.FromSlash(executable)
 		directory := filepath.Dir(executable)
-		log.Infof("Looking for Settings File at %v...\n", directory)
+		log.Infof("Looking for Settings File at %v...", directory)
 		godotenv.Load(filepath.Join(directory, environmentFile))
 	} else {
 		godotenv.Load(environmentFile)
 	}
 }
 
+// configFile returns the path of the config file: the one in CONFIG_FILE, or
+// the first billingo.yaml, billingo.yml or billingo.toml found
+func configFile() string {
+	if path, exists := os.LookupEnv("CONFIG_FILE"); exists {
+		return path
+	}
+	for _, name := range []string{"billingo.yaml", "billingo.yml", "billingo.toml"} {
+		path := configDirectory() + name
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadFile overlays the config file on the configuration. Unknown keys are
+// rejected so typos do not go unnoticed.
+func loadFile(config *Config, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file format %q, use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	return nil
+}
+
+// setField parses the raw value according to the kind of the field
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.Int:
+		valInt, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a valid int", raw)
+		}
+		field.SetInt(int64(valInt))
+	case reflect.Bool:
+		valBool, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a valid bool", raw)
+		}
+		field.SetBool(valBool)
+	case reflect.Float64:
+		valFloat, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid number", raw)
+		}
+		field.SetFloat(valFloat)
+	case reflect.String:
+		field.SetString(raw)
+	default:
+		return fmt.Errorf("unsupported field kind %v", field.Kind())
+	}
+	return nil
+}
+
+// applyDefaults sets the `default` tag of the fields still holding their zero value
+func applyDefaults(value reflect.Value) []error {
+	var errs []error
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		structField := value.Type().Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			errs = append(errs, applyDefaults(field)...)
+		case reflect.Slice:
+			if structField.Type.Elem().Kind() == reflect.Struct {
+				for j := 0; j < field.Len(); j++ {
+					errs = append(errs, applyDefaults(field.Index(j))...)
+				}
+			}
+		default:
+			defaultVal := structField.Tag.Get("default")
+			if defaultVal != "" && field.IsZero() {
+				if err := setField(field, defaultVal); err != nil {
+					errs = append(errs, fmt.Errorf("default of %s: %w", structField.Name, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
 // populateConfig check environment variables
 // to set to the current configuration
-func populateConfig(config *Config) {
-	loadDotEnv("")
-	value := reflect.ValueOf(config)
-	if value.Kind() == reflect.Ptr {
-		value = value.Elem()
-	}
+func populateConfig(value reflect.Value, prefix string) []error {
+	var errs []error
 	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
 		tag := value.Type().Field(i).Tag.Get("config")
-		defaultVal := value.Type().Field(i).Tag.Get("default")
-		if defaultVal != "" {
-			if value.Field(i).Kind() == reflect.Int {
-				valInt, err := strconv.Atoi(defaultVal)
-				if err != nil {
-					panic(fmt.Errorf("%v env is not a valid int: %w", defaultVal, err))
+		switch {
+		case field.Kind() == reflect.Struct && tag != "":
+			// The fields of the section are read from <TAG>_<FIELD>
+			errs = append(errs, populateConfig(field, prefix+tag+"_")...)
+		case field.Kind() == reflect.Struct:
+			errs = append(errs, populateConfig(field, prefix)...)
+		case field.Kind() == reflect.Slice && tag != "":
+			// Elements are read from <TAG>_<index>_<FIELD>, indexes start at 0 and
+			// the slice grows as needed
+			for j := 0; j < field.Len() || hasEnvPrefix(fmt.Sprintf("%s%s_%d_", prefix, tag, j)); j++ {
+				if j >= field.Len() {
+					field.Set(reflect.Append(field, reflect.New(field.Type().Elem()).Elem()))
 				}
-				value.Field(i).SetInt(int64(valInt))
-			} else if value.Field(i).Kind() == reflect.Bool {
-				valBool, err := strconv.ParseBool(defaultVal)
-				if err != nil {
-					panic(fmt.Errorf("%v env is not a valid bool: %w", defaultVal, err))
+				errs = append(errs, populateConfig(field.Index(j), fmt.Sprintf("%s%s_%d_", prefix, tag, j))...)
+			}
+		case tag != "":
+			if env, exists := os.LookupEnv(prefix + tag); exists {
+				if err := setField(field, env); err != nil {
+					errs = append(errs, fmt.Errorf("%s%s env: %w", prefix, tag, err))
 				}
-				value.Field(i).SetBool(valBool)
-			} else {
-				value.Field(i).SetString(defaultVal)
 			}
-		}
-		if tag != "" {
-			if env, exists := os.LookupEnv(tag); exists {
-				if value.Field(i).Kind() == reflect.Int {
-					valInt, err := strconv.Atoi(env)
-					if err != nil {
-						panic(fmt.Errorf("%v env is not a valid int: %w", env, err))
-					}
-					value.Field(i).SetInt(int64(valInt))
-				} else if value.Field(i).Kind() == reflect.Bool {
-					valBool, err := strconv.ParseBool(env)
-					if err != nil {
-						panic(fmt.Errorf("%v env is not a valid bool: %w", env, err))
-					}
-					value.Field(i).SetBool(valBool)
-				} else {
-					value.Field(i).SetString(env)
+			// Secrets can also be read from the file named by <TAG>_FILE
+			if path, exists := os.LookupEnv(prefix + tag + "_FILE"); exists && value.Type().Field(i).Tag.Get("secret") == "true" {
+				if _, both := os.LookupEnv(prefix + tag); both {
+					errs = append(errs, fmt.Errorf("%s%s and %s%s_FILE are both set", prefix, tag, prefix, tag))
 				}
+				field.SetString(secrets.SchemeFile + path)
 			}
 		}
 	}
+	return errs
 }
 
-// LoadConfig return the Configuration based on the current environment
-func LoadConfig() *Config {
-	env := os.Getenv("ENVIRONMENT")
-	var conf *Config
+func hasEnvPrefix(prefix string) bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// preset returns the configuration of the environment: the `default` tags,
+// then the preset of the environment so that it may override any of them
+func preset(env string) (*Config, []error) {
+	conf := &Config{lock: &sync.RWMutex{}}
+	errs := applyDefaults(reflect.ValueOf(conf).Elem())
 	switch env {
 	case "DEVELOPMENT":
-		conf = DevConfig
+		DevPreset(conf)
 	case "TESTING":
-		conf = TestConfig
-	case "PRODUCTION":
-		conf = ProdConfig
+		TestPreset(conf)
 	default:
-		conf = ProdConfig
+		ProdPreset(conf)
+	}
+	return conf, errs
+}
+
+// LoadConfig return the Configuration based on the current environment. The
+// configuration is returned even when invalid, along with every problem found.
+func LoadConfig() (*Config, error) {
+	loadDotEnv("")
+	conf, errs := preset(os.Getenv("ENVIRONMENT"))
+	if path := configFile(); path != "" {
+		log.Infof("Loading config file %v", path)
+		if err := loadFile(conf, path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, populateConfig(reflect.ValueOf(conf).Elem(), "")...)
+	// Clusters and sinks added by the file or the environment. Only them, a
+	// false set by the file must not be turned back into a true default.
+	for i := range conf.Proxmox.Clusters {
+		errs = append(errs, applyDefaults(reflect.ValueOf(&conf.Proxmox.Clusters[i]).Elem())...)
+	}
+	for i := range conf.Sinks {
+		errs = append(errs, applyDefaults(reflect.ValueOf(&conf.Sinks[i]).Elem())...)
+	}
+	if err := conf.ResolveSecrets(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Validated even when parsing failed, every problem is reported at once
+	if err := conf.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return conf, errors.Join(errs...)
+}
+
+// Validate checks the whole configuration and reports every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, err := strconv.Atoi(c.GinPort); err != nil {
+		errs = append(errs, fmt.Errorf("port: %q is not a valid port", c.GinPort))
+	}
+	check(c.SecretKey != "", "secret_key: required to sign access tokens")
+	check(c.TokenTTLMinutes > 0, "token_ttl_minutes: must be positive")
+	check(oneOf(strings.ToLower(c.LogFormat), "text", "json"), "log_format: %q is not text or json", c.LogFormat)
+	check(oneOf(strings.ToLower(c.LogLevel), "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"), "log_level: %q is not a valid level", c.LogLevel)
+
+	check(c.Database.Name != "", "database.name: required")
+	check(c.Database.Host != "", "database.host: required")
+	check(c.Database.User != "", "database.user: required")
+	if _, err := strconv.Atoi(c.Database.Port); err != nil {
+		errs = append(errs, fmt.Errorf("database.port: %q is not a valid port", c.Database.Port))
+	}
+	check(c.Database.CompressionIntervalDays >= 0, "database.compression_interval_days: must not be negative")
+	check(c.Database.RetentionDays >= 0, "database.retention_days: must not be negative")
+
+	if c.Tasks.CollectorEnabled {
+		check(len(c.Proxmox.Clusters) > 0, "proxmox.clusters: at least one cluster is required by the collector")
+	}
+	names := map[string]bool{}
+	for i, cluster := range c.Proxmox.Clusters {
+		check(cluster.Name != "", "proxmox.clusters[%d].name: required", i)
+		check(!names[cluster.Name], "proxmox.clusters[%d].name: %q is used by another cluster", i, cluster.Name)
+		names[cluster.Name] = true
+		check(validURL(cluster.URL, "http", "https"), "proxmox.clusters[%d].url: %q is not a valid http(s) URL", i, cluster.URL)
+		check(cluster.Token != "", "proxmox.clusters[%d].token: required", i)
+		check(cluster.TimeoutSeconds > 0, "proxmox.clusters[%d].timeout_seconds: must be positive", i)
+	}
+
+	if c.MQTT.Publisher.Enabled {
+		check(validURL(c.MQTT.Publisher.BrokerURL, brokerSchemes...), "mqtt.publisher.broker_url: %q is not a valid broker URL", c.MQTT.Publisher.BrokerURL)
+		check(c.MQTT.Publisher.Topic != "", "mqtt.publisher.topic: required")
+		check(!strings.ContainsAny(c.MQTT.Publisher.Topic, "+#"), "mqtt.publisher.topic: wildcards are not allowed")
+		for _, placeholder := range topicPlaceholder.FindAllString(c.MQTT.Publisher.Topic, -1) {
+			check(oneOf(placeholder, TopicPlaceholders...), "mqtt.publisher.topic: unknown placeholder %s", placeholder)
+		}
+		check(c.MQTT.Publisher.QoS >= 0 && c.MQTT.Publisher.QoS <= 2, "mqtt.publisher.qos: must be 0, 1 or 2")
+		check(c.MQTT.Publisher.BatchSize > 0, "mqtt.publisher.batch_size: must be positive")
+		check(c.MQTT.Publisher.PageSize > 0, "mqtt.publisher.page_size: must be positive")
+		check(!strings.ContainsAny(c.MQTT.Publisher.StatusTopic, "+#"), "mqtt.publisher.status_topic: wildcards are not allowed")
+		check(!strings.ContainsAny(c.MQTT.Publisher.AckTopic, "+#"), "mqtt.publisher.ack_topic: wildcards are not allowed")
+		check(c.MQTT.Publisher.AckTopic == "" || c.MQTT.Publisher.AckTimeoutSeconds > 0, "mqtt.publisher.ack_timeout_seconds: must be positive")
+		check(c.MQTT.Publisher.MaxAttempts > 0, "mqtt.publisher.max_attempts: must be positive")
+		check(c.MQTT.Publisher.RetryBackoffSeconds > 0, "mqtt.publisher.retry_backoff_seconds: must be positive")
+		check(c.MQTT.Publisher.RetryMaxBackoffSeconds >= c.MQTT.Publisher.RetryBackoffSeconds, "mqtt.publisher.retry_max_backoff_seconds: must not be less than retry_backoff_seconds")
+		check(!strings.ContainsAny(c.MQTT.Publisher.CommandTopic, "+#"), "mqtt.publisher.command_topic: wildcards are not allowed")
+		if c.MQTT.Publisher.CommandPublicKey != "" {
+			key, err := base64.StdEncoding.DecodeString(c.MQTT.Publisher.CommandPublicKey)
+			check(err == nil && len(key) == ed25519.PublicKeySize, "mqtt.publisher.command_public_key: not a base64 Ed25519 public key")
+			check(c.MQTT.Publisher.Site != "", "mqtt.publisher.site: required to accept commands")
+			check(c.MQTT.Publisher.SigningKey != "", "mqtt.publisher.signing_key: required to accept commands")
+		}
+		check(c.MQTT.Publisher.CommandMaxAgeSeconds > 0, "mqtt.publisher.command_max_age_seconds: must be positive")
+		if c.MQTT.Publisher.SigningKey != "" {
+			key, err := base64.StdEncoding.DecodeString(c.MQTT.Publisher.SigningKey)
+			check(err == nil && (len(key) == ed25519.SeedSize || len(key) == ed25519.PrivateKeySize), "mqtt.publisher.signing_key: not a base64 Ed25519 private key")
+		}
+		errs = append(errs, c.MQTT.Publisher.TLS.validate("mqtt.publisher.tls")...)
+	}
+	if c.MQTT.Subscriber.Enabled {
+		check(validURL(c.MQTT.Subscriber.BrokerURL, brokerSchemes...), "mqtt.subscriber.broker_url: %q is not a valid broker URL", c.MQTT.Subscriber.BrokerURL)
+		check(c.MQTT.Subscriber.Topic != "", "mqtt.subscriber.topic: required")
+		check(c.MQTT.Subscriber.QoS >= 0 && c.MQTT.Subscriber.QoS <= 2, "mqtt.subscriber.qos: must be 0, 1 or 2")
+		check(!strings.ContainsAny(c.MQTT.Subscriber.DeadLetterTopic, "+#"), "mqtt.subscriber.dead_letter_topic: wildcards are not allowed")
+		check(c.MQTT.Subscriber.BatchSize > 0, "mqtt.subscriber.batch_size: must be positive")
+		check(c.MQTT.Subscriber.FlushIntervalSeconds > 0, "mqtt.subscriber.flush_interval_seconds: must be positive")
+		check(c.MQTT.Subscriber.PromoteIntervalSeconds > 0, "mqtt.subscriber.promote_interval_seconds: must be positive")
+		check(c.MQTT.Subscriber.PromoteBatchSize > 0, "mqtt.subscriber.promote_batch_size: must be positive")
+		check(!strings.ContainsAny(c.MQTT.Subscriber.ResultTopic, "+#"), "mqtt.subscriber.result_topic: wildcards are not allowed")
+		if c.MQTT.Subscriber.CommandSigningKey != "" {
+			key, err := base64.StdEncoding.DecodeString(c.MQTT.Subscriber.CommandSigningKey)
+			check(err == nil && (len(key) == ed25519.SeedSize || len(key) == ed25519.PrivateKeySize), "mqtt.subscriber.command_signing_key: not a base64 Ed25519 private key")
+		}
+		check(!strings.ContainsAny(c.MQTT.Subscriber.SiteStatusTopic, "+#"), "mqtt.subscriber.site_status_topic: wildcards are not allowed")
+		check(!strings.ContainsAny(c.MQTT.Subscriber.SiteAckTopic, "+#"), "mqtt.subscriber.site_ack_topic: wildcards are not allowed")
+		errs = append(errs, c.MQTT.Subscriber.TLS.validate("mqtt.subscriber.tls")...)
+	}
+
+	sinks := map[string]bool{MQTTSinkName: true}
+	for i, sink := range c.Sinks {
+		name := fmt.Sprintf("sinks[%d]", i)
+		check(sink.Name != "", "%s.name: required", name)
+		check(!sinks[sink.Name], "%s.name: %q is used by another sink", name, sink.Name)
+		sinks[sink.Name] = true
+		switch sink.Type {
+		case SinkHTTP:
+			check(validURL(sink.URL, "http", "https"), "%s.url: %q is not a valid HTTP URL", name, sink.URL)
+		case SinkNATS:
+			check(validURL(sink.URL, "nats", "tls"), "%s.url: %q is not a valid NATS URL", name, sink.URL)
+			check(sink.Subject != "", "%s.subject: required", name)
+			check(!strings.ContainsAny(sink.Subject, "*> "), "%s.subject: wildcards are not allowed", name)
+			for _, placeholder := range topicPlaceholder.FindAllString(sink.Subject, -1) {
+				check(oneOf(placeholder, TopicPlaceholders...), "%s.subject: unknown placeholder %s", name, placeholder)
+			}
+		case SinkFile:
+			check(sink.Path != "", "%s.path: required", name)
+		default:
+			errs = append(errs, fmt.Errorf("%s.type: %q is not http, nats or file", name, sink.Type))
+		}
+		check(sink.TimeoutSeconds > 0, "%s.timeout_seconds: must be positive", name)
+		check(sink.BatchSize > 0, "%s.batch_size: must be positive", name)
+		check(sink.PageSize > 0, "%s.page_size: must be positive", name)
+		check(sink.MaxAttempts > 0, "%s.max_attempts: must be positive", name)
+		check(sink.RetryBackoffSeconds > 0, "%s.retry_backoff_seconds: must be positive", name)
+		check(sink.RetryMaxBackoffSeconds >= sink.RetryBackoffSeconds, "%s.retry_max_backoff_seconds: must not be less than retry_backoff_seconds", name)
+	}
+
+	check(c.Tasks.MetricsIntervalMinutes > 0, "tasks.metrics_interval_minutes: must be positive")
+	check(oneOf(c.Tasks.RRDTimeframe, "hour", "day", "week", "month", "year"), "tasks.rrd_timeframe: %q is not a Proxmox timeframe", c.Tasks.RRDTimeframe)
+	check(c.Tasks.BufferPath != "", "tasks.buffer_path: required")
+	check(c.Tasks.BatchSaveIntervalSeconds > 0, "tasks.batch_save_interval_seconds: must be positive")
+	check(c.Tasks.BatchSize > 0, "tasks.batch_size: must be positive")
+	check(c.Tasks.PublishIntervalSeconds > 0, "tasks.publish_interval_seconds: must be positive")
+
+	check(c.Secrets.RefreshIntervalSeconds >= 0, "secrets.refresh_interval_seconds: must not be negative")
+	if c.Secrets.KeystorePath != "" {
+		check(c.Secrets.KeystorePassphrase != "", "secrets.keystore_passphrase: required by the keystore")
+	}
+
+	if c.Billing.PricePlansPath != "" {
+		_, err := os.Stat(c.Billing.PricePlansPath)
+		check(err == nil, "billing.price_plans_path: %v", err)
+	}
+	check(c.Billing.WalletDebitIntervalSeconds > 0, "billing.wallet_debit_interval_seconds: must be positive")
+	check(c.Billing.WalletCreditLimit >= 0, "billing.wallet_credit_limit: must not be negative")
+	check(c.Billing.WalletSettleHours >= 0, "billing.wallet_settle_hours: must not be negative")
+	return errors.Join(errs...)
+}
+
+// validate checks that the TLS files are readable and the client certificate complete
+func (t MQTTTLSConfig) validate(name string) []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file must be set together", name))
+	}
+	for _, file := range []struct{ key, path string }{{"ca_file", t.CAFile}, {"cert_file", t.CertFile}, {"key_file", t.KeyFile}} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s.%s: %v", name, file.key, err))
+		}
+	}
+	return errs
+}
+
+// brokerSchemes are the broker URL schemes supported by the MQTT client
+var brokerSchemes = []string{"mqtt", "tcp", "ssl", "tls", "mqtts", "ws", "wss"}
+
+// TopicPlaceholders are replaced in the publisher topic by the values of the samples
+var TopicPlaceholders = []string{"{cluster}", "{customer}", "{vmid}"}
+
+var topicPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
+	}
+	return false
+}
+
+func validURL(raw string, schemes ...string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && parsed.Host != "" && oneOf(parsed.Scheme, schemes...)
+}
+
+// Snapshot returns a copy of the configuration that is safe to read while the
+// secrets are re-read
+func (c *Config) Snapshot() Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	snapshot := *c
+	snapshot.Proxmox.Clusters = append([]ProxmoxCluster(nil), c.Proxmox.Clusters...)
+	snapshot.Sinks = append([]SinkConfig(nil), c.Sinks...)
+	return snapshot
+}
+
+// SinkNames returns the names of the sinks the collected data is delivered to
+func (c *Config) SinkNames() []string {
+	snapshot := c.Snapshot()
+	var names []string
+	if snapshot.MQTT.Publisher.Enabled {
+		names = append(names, MQTTSinkName)
+	}
+	for _, sink := range snapshot.Sinks {
+		names = append(names, sink.Name)
+	}
+	return names
+}
+
+// Sink returns the configuration of the named sink
+func (c *Config) Sink(name string) (SinkConfig, bool) {
+	for _, sink := range c.Snapshot().Sinks {
+		if sink.Name == name {
+			return sink, true
+		}
+	}
+	return SinkConfig{}, false
+}
+
+// LoggingOptions returns the options of the loggers, including the secrets
+// to redact
+func (c *Config) LoggingOptions() logging.Options {
+	snapshot := c.Snapshot()
+	return logging.Options{
+		Level:   snapshot.LogLevel,
+		Format:  snapshot.LogFormat,
+		Levels:  snapshot.LogLevels,
+		Secrets: c.SecretValues(),
+	}
+}
+
+// Masked returns a copy of the configuration with the secrets replaced, the
+// ones set from a reference show the reference instead
+func (c *Config) Masked() *Config {
+	masked := c.Snapshot()
+	walkSecrets(reflect.ValueOf(&masked).Elem(), "", func(name string, field reflect.Value) {
+		if ref, exists := masked.refs[name]; exists {
+			field.SetString(ref)
+		} else if field.String() != "" {
+			field.SetString("****")
+		}
+	})
+	return &masked
+}
+
+// SecretValues returns the values of every secret, to be redacted from the logs
+func (c *Config) SecretValues() []string {
+	snapshot := c.Snapshot()
+	var values []string
+	walkSecrets(reflect.ValueOf(&snapshot).Elem(), "", func(name string, field reflect.Value) {
+		if field.String() != "" {
+			values = append(values, field.String())
+		}
+	})
+	return values
+}
+
+// walkSecrets calls fn with every field tagged as secret, named after the
+// path of its keys in the config file
+func walkSecrets(value reflect.Value, prefix string, fn func(name string, field reflect.Value)) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + value.Type().Field(i).Tag.Get("yaml")
+		switch field.Kind() {
+		case reflect.Struct:
+			walkSecrets(field, name+".", fn)
+		case reflect.Slice:
+			for j := 0; j < field.Len(); j++ {
+				if field.Index(j).Kind() == reflect.Struct {
+					walkSecrets(field.Index(j), fmt.Sprintf("%s[%d].", name, j), fn)
+				}
+			}
+		case reflect.String:
+			if value.Type().Field(i).Tag.Get("secret") == "true" {
+				fn(name, field)
+			}
+		}
 	}
-	populateConfig(conf)
-	return conf
 }
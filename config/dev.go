@@ -2,15 +2,28 @@
 // and other necessary configs
 package config
 
-// DevConfig configures the application to run int DEVELOPMENT mode
-var DevConfig = &Config{
-	GinPort:                 "5000",
-	SecretKey:               "super_secret_key",
-	LogLevel:                "DEBUG",
-	DBName:                  "billingo",
-	DBHost:                  "localhost",
-	DBPort:                  "5432",
-	DBUser:                  "going2",
-	DBPassword:              "going2",
-	CompressionIntervalDays: 1,
+// DevPreset configures the application to run int DEVELOPMENT mode, over the
+// defaults. Secrets are not part of the preset, set SECRET_KEY, POSTGRES_PWD,
+// PROXMOX_CLUSTER_0_TOKEN and MQTT_PUBLISHER_PASSWORD in the .env file.
+func DevPreset(conf *Config) {
+	conf.LogLevel = "DEBUG"
+	conf.CorsAllowedOrigins = "*"
+	conf.Database.Name = "billingo"
+	conf.Database.Host = "localhost"
+	conf.Database.Port = "5432"
+	conf.Database.User = "going2"
+	conf.Database.CompressionIntervalDays = 1
+	conf.Proxmox.Clusters = []ProxmoxCluster{
+		{
+			Name: "cloudvbox",
+			URL:  "https://console.cloudvbox.com/api2/json",
+		},
+	}
+	conf.MQTT.Publisher.Enabled = true
+	conf.MQTT.Publisher.BrokerURL = "mqtt://localhost:1883"
+	conf.MQTT.Publisher.Topic = "12345qwert54321"
+	conf.MQTT.Publisher.Username = "ajbkvbp/device-test"
+	conf.MQTT.Subscriber.Enabled = true
+	conf.MQTT.Subscriber.BrokerURL = "mqtt://localhost:1883"
+	conf.MQTT.Subscriber.Topic = "12345qwert54321"
 }
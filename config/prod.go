@@ -2,15 +2,7 @@
 // and other necessary configs
 package config
 
-// ProdConfig configures the application to run int PRODUCTION mode
-var ProdConfig = &Config{
-	GinPort:                 "5000",
-	SecretKey:               "",
-	LogLevel:                "INFO",
-	DBName:                  "",
-	DBHost:                  "",
-	DBPort:                  "",
-	DBUser:                  "",
-	DBPassword:              "",
-	CompressionIntervalDays: 90,
-}
+// ProdPreset configures the application to run int PRODUCTION mode, the
+// defaults are meant for it. Database, Proxmox clusters and MQTT come from
+// the config file or the environment.
+func ProdPreset(conf *Config) {}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// restartRequired lists the settings that are only read at startup, a change
+// to them is reported by Reload but only applied by restarting the service
+var restartRequired = []string{
+	"port",
+	"cors_allowed_origins",
+	"database.name",
+	"database.host",
+	"database.port",
+	"database.user",
+	"tasks.collector_enabled",
+	"tasks.buffer_path",
+	"mqtt.publisher.enabled",
+	"mqtt.subscriber.enabled",
+	// A task is started per sink
+	"sinks",
+}
+
+// Reload loads the configuration again and replaces the current one in place,
+// returning the settings that changed, named after their keys in the config
+// file. An invalid configuration is rejected and the current one is kept.
+func (c *Config) Reload() ([]string, error) {
+	next, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := diffConfig(reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem(), "")
+	lock := c.lock
+	*c = *next
+	c.lock = lock
+	return changed, nil
+}
+
+// RequiresRestart returns the changed settings that are only applied on restart
+func RequiresRestart(changed []string) []string {
+	var pending []string
+	for _, name := range changed {
+		for _, setting := range restartRequired {
+			if name == setting {
+				pending = append(pending, name)
+			}
+		}
+	}
+	return pending
+}
+
+// Changed reports whether any of the changed settings is under one of the
+// sections, such as "mqtt.publisher" or "tasks.batch_size"
+func Changed(changed []string, sections ...string) bool {
+	for _, name := range changed {
+		for _, section := range sections {
+			if name == section || strings.HasPrefix(name, section+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// diffConfig lists the settings that differ between both configurations. Lists
+// such as the Proxmox clusters are compared as a whole.
+func diffConfig(current, next reflect.Value, prefix string) []string {
+	var changed []string
+	for i := 0; i < current.NumField(); i++ {
+		structField := current.Type().Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		name := prefix + structField.Tag.Get("yaml")
+		if current.Field(i).Kind() == reflect.Struct {
+			changed = append(changed, diffConfig(current.Field(i), next.Field(i), name+".")...)
+		} else if !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"billingo/secrets"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// passphraseField is resolved before the other secrets, it opens the keystore
+const passphraseField = "secrets.keystore_passphrase"
+
+// ResolveSecrets replaces the secret fields holding a reference, such as
+// "file:/run/secrets/db_password", "env:DB_PASSWORD" or "keystore:db_password",
+// with the secret itself. The references are kept to be resolved again by
+// RefreshSecrets. Fields that cannot be resolved are left empty.
+func (c *Config) ResolveSecrets() error {
+	c.refs = map[string]string{}
+	walkSecrets(reflect.ValueOf(c).Elem(), "", func(name string, field reflect.Value) {
+		if secrets.IsReference(field.String()) {
+			c.refs[name] = field.String()
+		}
+	})
+
+	values, err := c.resolveRefs()
+	for name := range c.refs {
+		if _, resolved := values[name]; !resolved {
+			// The reference itself must never be used as the secret
+			values[name] = ""
+		}
+	}
+	c.setSecrets(values)
+	return err
+}
+
+// RefreshSecrets resolves the secret references again and returns the fields
+// that changed. The fields that fail keep their previous value.
+func (c *Config) RefreshSecrets() ([]string, error) {
+	if len(c.Snapshot().refs) == 0 {
+		return nil, nil
+	}
+	values, err := c.resolveRefs()
+	return c.setSecrets(values), err
+}
+
+// resolveRefs returns the current value of every reference that resolves
+func (c *Config) resolveRefs() (map[string]string, error) {
+	// A reload replaces the references
+	snapshot := c.Snapshot()
+	refs := snapshot.refs
+	values := make(map[string]string, len(refs))
+
+	passphrase := snapshot.Secrets.KeystorePassphrase
+	if ref, exists := refs[passphraseField]; exists {
+		if strings.HasPrefix(ref, secrets.SchemeKeystore) {
+			return values, fmt.Errorf("%s: cannot be read from the keystore it opens", passphraseField)
+		}
+		var err error
+		if passphrase, err = secrets.Resolve(ref, nil); err != nil {
+			return values, fmt.Errorf("%s: %w", passphraseField, err)
+		}
+		values[passphraseField] = passphrase
+	}
+
+	var errs []error
+	var keystore *secrets.Keystore
+	if snapshot.Secrets.KeystorePath != "" && passphrase != "" {
+		var err error
+		if keystore, err = secrets.OpenKeystore(snapshot.Secrets.KeystorePath, passphrase); err != nil {
+			errs = append(errs, fmt.Errorf("secrets.keystore_path: %w", err))
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == passphraseField {
+			continue
+		}
+		value, err := secrets.Resolve(refs[name], keystore)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		values[name] = value
+	}
+	return values, errors.Join(errs...)
+}
+
+// setSecrets stores the values by field name and returns the ones that changed
+func (c *Config) setSecrets(values map[string]string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var changed []string
+	walkSecrets(reflect.ValueOf(c).Elem(), "", func(name string, field reflect.Value) {
+		if value, exists := values[name]; exists && field.String() != value {
+			field.SetString(value)
+			changed = append(changed, name)
+		}
+	})
+	return changed
+}
@@ -2,15 +2,9 @@
 // and other necessary configs
 package config
 
-// TestConfig configures the application to run int TEST mode
-var TestConfig = &Config{
-	GinPort:                 "5000",
-	SecretKey:               "super_secret_key",
-	LogLevel:                "DEBUG",
-	DBName:                  "billingo_test",
-	DBHost:                  "localhost",
-	DBPort:                  "5432",
-	DBUser:                  "going2",
-	DBPassword:              "going2",
-	CompressionIntervalDays: 1,
+// TestPreset configures the application to run int TEST mode, as DevPreset
+// but on its own database. Secrets come from the .env file as in DevPreset.
+func TestPreset(conf *Config) {
+	DevPreset(conf)
+	conf.Database.Name = "billingo_test"
 }
@@ -1,11 +1,11 @@
 package controllers
 
 import (
+	"billingo/config"
 	"billingo/models"
+	"billingo/telemetry"
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
 	"os"
 	"sync"
 	"time"
@@ -16,46 +16,65 @@ import (
 type BatchSaveToDatabaseTask struct {
 	name      string
 	filePath  string
+	conf      *config.Config
 	batchSize int
 	db        *gorm.DB
+	manager   *Manager
 	lock      sync.Mutex
 }
 
-// NewBatchSaveToDatabaseTask initializes a new BatchSaveToDatabaseTask.
-func NewBatchSaveToDatabaseTask(name, filePath string, batchSize int) *BatchSaveToDatabaseTask {
+// NewBatchSaveToDatabaseTask initializes a new BatchSaveToDatabaseTask. The
+// file path is fixed, the batch size and interval are read from the config.
+func NewBatchSaveToDatabaseTask(name, filePath string, conf *config.Config) *BatchSaveToDatabaseTask {
 	return &BatchSaveToDatabaseTask{
-		name:      name,
-		filePath:  filePath,
-		batchSize: batchSize,
+		name:     name,
+		filePath: filePath,
+		conf:     conf,
 	}
 }
 
 func (t *BatchSaveToDatabaseTask) Setup(db *gorm.DB, manager *Manager) {
 	t.db = db
+	t.manager = manager
 }
 
 func (t *BatchSaveToDatabaseTask) Main(ctx context.Context) {
+	tasks := t.conf.Snapshot().Tasks
+	interval := time.Duration(tasks.BatchSaveIntervalSeconds) * time.Second
+	t.batchSize = tasks.BatchSize
+
 	for {
+		// Large buffers may take a while to be saved
+		t.manager.Heartbeat(t, interval+15*time.Minute)
+		t.processFileData()
+
+		// Sleep for a while to avoid continuous processing
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			t.processFileData()
-			// Sleep for a while to avoid continuous processing
-			time.Sleep(2 * time.Minute)
+		case <-time.After(interval):
 		}
 	}
 }
 
+// Reconfigure implements Reconfigurable, the batch settings are only read
+// when the task starts
+func (t *BatchSaveToDatabaseTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, "tasks.batch_size", "tasks.batch_save_interval_seconds") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
 func (t *BatchSaveToDatabaseTask) processFileData() {
-	log.Println("running batch save...")
+	taskLog(t).Debug("Running batch save...")
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
 	// Open the file for reading
 	file, err := os.Open(t.filePath)
 	if err != nil {
-		fmt.Printf("Failed to open file %s: %v\n", t.filePath, err)
+		taskLog(t).Errorf("Failed to open file %s: %v", t.filePath, err)
 		return
 	}
 	defer file.Close()
@@ -67,7 +86,7 @@ func (t *BatchSaveToDatabaseTask) processFileData() {
 		var data models.VMData
 		if err := decoder.Decode(&data); err != nil {
 			if err.Error() != "EOF" {
-				fmt.Printf("Failed to decode data from file: %v\n", err)
+				taskLog(t).Errorf("Failed to decode data from file: %v", err)
 			}
 			break
 		}
@@ -84,6 +103,8 @@ func (t *BatchSaveToDatabaseTask) processFileData() {
 		convertedBuffer[i] = models.Data{
 			RRDData: vmData.RRDData,
 			VMID:    vmData.VMID,
+			Cluster: vmData.Cluster,
+			Node:    vmData.Node,
 		}
 	}
 
@@ -94,10 +115,21 @@ func (t *BatchSaveToDatabaseTask) processFileData() {
 			end = len(convertedBuffer)
 		}
 		batch := convertedBuffer[i:end]
-		if err := t.db.Create(&batch).Error; err != nil {
-			fmt.Printf("Failed to save batch to database: %v\n", err)
+		start := time.Now()
+		// The deliveries are saved along the rows, none can be missed
+		err := t.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&batch).Error; err != nil {
+				return err
+			}
+			return models.EnqueueDeliveries(tx, batch, t.conf.SinkNames())
+		})
+		if err != nil {
+			telemetry.BatchInsertFailures.Inc()
+			taskLog(t).Errorf("Failed to save batch to database: %v", err)
 			return
 		}
+		telemetry.ObserveDuration(telemetry.BatchInsertDuration, start)
+		telemetry.BatchInsertRows.Add(float64(len(batch)))
 	}
 
 	// Clear the file after successful save
@@ -107,10 +139,11 @@ func (t *BatchSaveToDatabaseTask) processFileData() {
 func (t *BatchSaveToDatabaseTask) clearFile() {
 	file, err := os.OpenFile(t.filePath, os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Printf("Failed to clear file %s: %v\n", t.filePath, err)
+		taskLog(t).Errorf("Failed to clear file %s: %v", t.filePath, err)
 		return
 	}
 	defer file.Close()
+	telemetry.BufferFileSize.Set(0)
 }
 
 func (t *BatchSaveToDatabaseTask) String() string {
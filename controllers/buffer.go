@@ -2,24 +2,28 @@ package controllers
 
 import (
 	"billingo/models"
+	"billingo/telemetry"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"gorm.io/gorm"
 )
 
 type ObserverBufferTask struct {
-	manager *Manager
-	lock    sync.Mutex
-	name    string
-	file    *os.File
+	manager  *Manager
+	lock     sync.Mutex
+	name     string
+	filePath string
+	file     *os.File
 }
 
-func NewObserverBuffer(name string) *ObserverBufferTask {
-	return &ObserverBufferTask{name: name}
+// NewObserverBuffer creates a task appending the changes of the manager to the file
+func NewObserverBuffer(name, filePath string) *ObserverBufferTask {
+	return &ObserverBufferTask{name: name, filePath: filePath}
 }
 
 func (t *ObserverBufferTask) Setup(db *gorm.DB, manager *Manager) {
@@ -27,17 +31,23 @@ func (t *ObserverBufferTask) Setup(db *gorm.DB, manager *Manager) {
 	var err error
 
 	// Open or create the file to store the buffer data
-	t.file, err = os.OpenFile(t.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	t.file, err = os.OpenFile(t.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		fmt.Printf("Failed to open file %s: %v\n", t.name, err)
+		taskLog(t).Errorf("Failed to open file %s: %v", t.filePath, err)
 	}
 }
 
 func (t *ObserverBufferTask) Main(ctx context.Context) {
+	// Changes may not arrive for a long time, beat on a timer instead
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-ticker.C:
+			t.manager.Heartbeat(t, 3*time.Minute)
 		case data := <-t.manager.changeChan:
 			// When a change is detected, process the updated data
 			t.saveRowToFile(data)
@@ -53,8 +63,23 @@ func (t *ObserverBufferTask) saveRowToFile(data models.VMData) {
 	// Encode the buffer data to JSON and write to file
 	encoder := json.NewEncoder(t.file)
 	if err := encoder.Encode(data); err != nil {
-		fmt.Printf("Failed to encode data to file: %v\n", err)
+		taskLog(t).WithField("vmid", data.VMID).Errorf("Failed to encode data to file: %v", err)
+	}
+	if info, err := t.file.Stat(); err == nil {
+		telemetry.BufferFileSize.Set(float64(info.Size()))
+	}
+}
+
+// Health checks that the buffer file can still be written
+func (t *ObserverBufferTask) Health() error {
+	if t.file == nil {
+		return fmt.Errorf("buffer file %s is not open", t.filePath)
+	}
+	file, err := os.OpenFile(t.filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("buffer file is not writable: %w", err)
 	}
+	return file.Close()
 }
 
 func (t *ObserverBufferTask) String() string {
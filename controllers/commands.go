@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/models"
+	"billingo/proxmox"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rrdTimeframes are the timeframes of the Proxmox RRD and how far back they go
+var rrdTimeframes = []struct {
+	name   string
+	period time.Duration
+}{
+	{"hour", time.Hour},
+	{"day", 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"year", 365 * 24 * time.Hour},
+}
+
+// commandRunner runs the commands of the central side on an edge collector
+type commandRunner struct {
+	task *DeliveryTask
+	// seenLock guards the IDs of the commands accepted, a command is run once
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+}
+
+func newCommandRunner(task *DeliveryTask) *commandRunner {
+	return &commandRunner{task: task, seen: map[string]time.Time{}}
+}
+
+// accept checks the command is signed with the key of the central side,
+// addressed to the site of the collector, recent and not run yet. The
+// signature is verified on the payload as received.
+func (r *commandRunner) accept(command models.Command, payload []byte, site, publicKey string, maxAge time.Duration) error {
+	if err := models.VerifyPayload(payload, publicKey); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if command.Site != site {
+		return fmt.Errorf("addressed to site %q", command.Site)
+	}
+	now := time.Now()
+	if age := now.Sub(command.IssuedAt); age > maxAge || age < -maxAge {
+		return fmt.Errorf("issued at %s, outside of the accepted %s", command.IssuedAt.Format(time.RFC3339), maxAge)
+	}
+
+	r.seenLock.Lock()
+	defer r.seenLock.Unlock()
+	for id, seenAt := range r.seen {
+		// Older commands are rejected by their age
+		if now.Sub(seenAt) > 2*maxAge {
+			delete(r.seen, id)
+		}
+	}
+	if _, exists := r.seen[command.ID]; exists {
+		return fmt.Errorf("already run")
+	}
+	r.seen[command.ID] = now
+	return nil
+}
+
+// run runs the command and returns its result
+func (r *commandRunner) run(command models.Command) models.CommandResult {
+	var details map[string]interface{}
+	var err error
+	switch command.Type {
+	case models.CommandResendRange:
+		details, err = r.resend(command.From, command.To, models.VMKey{})
+	case models.CommandBackfill:
+		details, err = r.backfill(command.From, command.To, models.VMKey{Cluster: command.Cluster, VMID: command.VMID})
+	case models.CommandReportStatus:
+		details, err = r.reportStatus()
+	case models.CommandReloadConfig:
+		details, err = r.reloadConfig()
+	default:
+		err = fmt.Errorf("unknown command type %q", command.Type)
+	}
+
+	result := models.CommandResult{CommandID: command.ID, Status: models.CommandOK, Details: details, CompletedAt: time.Now().UTC()}
+	if err != nil {
+		result.Status = models.CommandFailed
+		result.Message = err.Error()
+	}
+	return result
+}
+
+// resend makes the rows of the period due again for delivery to the sink of
+// the task, only those of a VM when its VMID is not 0
+func (r *commandRunner) resend(from, to int64, vm models.VMKey) (map[string]interface{}, error) {
+	if from <= 0 || to < from {
+		return nil, fmt.Errorf("invalid period from %d to %d", from, to)
+	}
+	rows, err := models.ResendRange(r.task.db, r.task.sinkName, from, to, vm)
+	if err != nil {
+		return nil, err
+	}
+	taskLog(r.task).Infof("Resending %d rows from %d to %d on command", rows, from, to)
+	return map[string]interface{}{"rows": rows}, nil
+}
+
+// backfill collects the samples of the VM over the period from its Proxmox
+// cluster, saves the ones missing and resends all the samples of the period.
+// The cluster may only be left out when a single one is configured.
+func (r *commandRunner) backfill(from, to int64, vm models.VMKey) (map[string]interface{}, error) {
+	if vm.VMID <= 0 {
+		return nil, fmt.Errorf("a VM ID is required")
+	}
+	if from <= 0 || to < from {
+		return nil, fmt.Errorf("invalid period from %d to %d", from, to)
+	}
+	snapshot := r.task.conf.Snapshot()
+	if vm.Cluster == "" {
+		if len(snapshot.Proxmox.Clusters) != 1 {
+			return nil, fmt.Errorf("a cluster is required, %d are configured", len(snapshot.Proxmox.Clusters))
+		}
+		vm.Cluster = snapshot.Proxmox.Clusters[0].Name
+	}
+	var cluster *config.ProxmoxCluster
+	for i := range snapshot.Proxmox.Clusters {
+		if snapshot.Proxmox.Clusters[i].Name == vm.Cluster {
+			cluster = &snapshot.Proxmox.Clusters[i]
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("cluster %s is not configured", vm.Cluster)
+	}
+	info, exists := r.task.manager.GetVMInfo(vm)
+	if !exists {
+		return nil, fmt.Errorf("VM %d of cluster %s was not seen by the collector", vm.VMID, vm.Cluster)
+	}
+
+	// The shortest timeframe reaching back to the start has the finest samples
+	timeframe := rrdTimeframes[len(rrdTimeframes)-1].name
+	for _, candidate := range rrdTimeframes {
+		if time.Since(time.Unix(from, 0)) <= candidate.period {
+			timeframe = candidate.name
+			break
+		}
+	}
+	samples, err := proxmox.FetchRRDData(*cluster, info.Node, info.Type, vm.VMID, timeframe)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the RRD data of VM %d: %w", vm.VMID, err)
+	}
+	var rows []models.Data
+	for _, sample := range samples {
+		// Samples without CPU are taken while the VM is stopped, as in the collection
+		if int64(sample.Time) < from || int64(sample.Time) > to || sample.CPU == nil {
+			continue
+		}
+		rows = append(rows, models.Data{RRDData: sample, VMID: vm.VMID, Cluster: vm.Cluster, Node: info.Node})
+	}
+	saved, err := models.BackfillData(r.task.db, rows, snapshot.SinkNames())
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := r.resend(from, to, vm)
+	if err != nil {
+		return nil, err
+	}
+	details["timeframe"] = timeframe
+	details["backfilled"] = saved
+	return details, nil
+}
+
+// reportStatus reports the health of the tasks and the deliveries of each sink
+func (r *commandRunner) reportStatus() (map[string]interface{}, error) {
+	deliveries := map[string]interface{}{}
+	for _, sink := range r.task.conf.SinkNames() {
+		counts, err := models.CountSyncStatuses(r.task.db, sink)
+		if err != nil {
+			return nil, err
+		}
+		deliveries[sink] = counts
+	}
+	return map[string]interface{}{
+		"hostname":   hostname(),
+		"tasks":      r.task.manager.TasksHealth(),
+		"deliveries": deliveries,
+	}, nil
+}
+
+// reloadConfig reloads the configuration as on SIGHUP
+func (r *commandRunner) reloadConfig() (map[string]interface{}, error) {
+	changed, pending, err := r.task.manager.ReloadConfig(r.task.conf)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"changed": changed, "restart_required": pending}, nil
+}
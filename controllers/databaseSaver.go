@@ -31,7 +31,7 @@ func (t *DatabaseSaverTask) Setup(db *gorm.DB, manager *Manager) {
 	// Open the buffer file for reading
 	t.file, err = os.OpenFile(t.name, os.O_RDONLY, 0644)
 	if err != nil {
-		fmt.Printf("Failed to open buffer file %s: %v\n", t.name, err)
+		taskLog(t).Errorf("Failed to open buffer file %s: %v", t.name, err)
 	}
 }
 
@@ -48,7 +48,7 @@ func (t *DatabaseSaverTask) Main(ctx context.Context) {
 		default:
 			// Process the buffer file and save data to the database
 			if err := t.processBufferFile(); err != nil {
-				fmt.Printf("Error processing buffer file: %v\n", err)
+				taskLog(t).Errorf("Error processing buffer file: %v", err)
 			}
 		}
 		// Wait for an hour before processing the next batch
@@ -88,6 +88,7 @@ func (t *DatabaseSaverTask) processBufferFile() error {
 		data := models.Data{
 			RRDData: vmData.RRDData,
 			VMID:    vmData.VMID,
+			Node:    vmData.Node,
 		}
 		rows = append(rows, data)
 
@@ -119,6 +120,6 @@ func (t *DatabaseSaverTask) insertBatch(rows []models.Data) error {
 	if err := t.db.Create(&rows).Error; err != nil {
 		return fmt.Errorf("failed to insert batch into database: %v", err)
 	}
-	fmt.Printf("Successfully inserted %d rows into the database\n", len(rows))
+	taskLog(t).Infof("Successfully inserted %d rows into the database", len(rows))
 	return nil
 }
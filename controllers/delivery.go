@@ -0,0 +1,426 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/models"
+	"billingo/telemetry"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Sink is a destination of the collected data. The delivery of every row to
+// each sink is tracked in data_deliveries, see DeliveryTask.
+type Sink interface {
+	// Connect makes a single attempt to connect to the destination, it is
+	// retried by the task
+	Connect(ctx context.Context) error
+	// Send delivers a batch. It returns true once the sink confirmed the
+	// delivery, false when the confirmation comes later through the acks given
+	// to its SinkFactory.
+	Send(ctx context.Context, batch *SinkBatch) (bool, error)
+	// Close disconnects when the task stops
+	Close()
+	Health() error
+}
+
+// SinkBatch is a message to send and the rows it carries
+type SinkBatch struct {
+	// Route is the topic or subject of the batch, rendered from SinkOptions.Route
+	Route   string
+	IDs     []uint
+	Payload models.DataBatch
+}
+
+// SinkOptions are the delivery settings of a sink, read when its task starts
+type SinkOptions struct {
+	// Origin identifies the collector in the batch IDs and as the source of the batches
+	Origin string
+	// Route is a template with the TopicPlaceholders, the rows of a batch share its value
+	Route     string
+	BatchSize int
+	PageSize  int
+	// AckTimeout bounds the wait for the confirmation of a delivery
+	AckTimeout time.Duration
+	Retry      models.SyncRetry
+}
+
+// SinkFactory builds a sink from the configuration, nil when the sink is no
+// longer configured. acks marks the batches confirmed after Send returned.
+type SinkFactory func(task *DeliveryTask, snapshot config.Config, acks func(batchID string)) (Sink, SinkOptions)
+
+// DeliveryTask delivers the collected data to a sink, each batch is marked in
+// flight before it is sent and done once the sink confirms it. Failed batches
+// are retried with a backoff until their rows are dead.
+type DeliveryTask struct {
+	name     string
+	sinkName string
+	conf     *config.Config
+	factory  SinkFactory
+	// sections are the settings restarting the task when changed
+	sections []string
+	db       *gorm.DB
+	manager  *Manager
+
+	// sinkLock guards the sink, replaced when the task restarts
+	sinkLock   sync.Mutex
+	sink       Sink
+	options    SinkOptions
+	interval   time.Duration
+	retryDelay time.Duration
+	// deadRows is the number of dead rows as of the last round, -1 before the first
+	deadRows int64
+}
+
+// NewSinkTask creates a task delivering the collected data to the sink of the
+// configuration with the given name
+func NewSinkTask(name, sinkName string, conf *config.Config) *DeliveryTask {
+	return newDeliveryTask(name, sinkName, conf, newConfiguredSink, "sinks")
+}
+
+func newDeliveryTask(name, sinkName string, conf *config.Config, factory SinkFactory, sections ...string) *DeliveryTask {
+	return &DeliveryTask{
+		name:       name,
+		sinkName:   sinkName,
+		conf:       conf,
+		factory:    factory,
+		sections:   append(sections, "tasks.publish_interval_seconds"),
+		retryDelay: 5 * time.Second,
+	}
+}
+
+// newConfiguredSink builds the sink from the sinks of the configuration
+func newConfiguredSink(t *DeliveryTask, snapshot config.Config, acks func(string)) (Sink, SinkOptions) {
+	settings, exists := snapshot.Sink(t.sinkName)
+	if !exists {
+		return nil, SinkOptions{}
+	}
+	options := SinkOptions{
+		Origin:     fmt.Sprintf("billingo-%s-%s", hostname(), settings.Name),
+		BatchSize:  settings.BatchSize,
+		PageSize:   settings.PageSize,
+		AckTimeout: time.Duration(settings.TimeoutSeconds) * time.Second,
+		Retry: models.SyncRetry{
+			MaxAttempts: settings.MaxAttempts,
+			Backoff:     time.Duration(settings.RetryBackoffSeconds) * time.Second,
+			MaxBackoff:  time.Duration(settings.RetryMaxBackoffSeconds) * time.Second,
+		},
+	}
+	switch settings.Type {
+	case config.SinkHTTP:
+		return newHTTPSink(t.conf, settings), options
+	case config.SinkNATS:
+		options.Route = settings.Subject
+		return newNATSSink(t, settings), options
+	default:
+		return newFileSink(settings), options
+	}
+}
+
+func (t *DeliveryTask) Setup(db *gorm.DB, manager *Manager) {
+	t.db = db
+	t.manager = manager
+}
+
+func (t *DeliveryTask) String() string {
+	return t.name
+}
+
+// Reconfigure implements Reconfigurable, the sink is only built when the task
+// starts
+func (t *DeliveryTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, t.sections...) {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+// Main connects the sink and delivers the due rows periodically
+func (t *DeliveryTask) Main(ctx context.Context) {
+	snapshot := t.conf.Snapshot()
+	t.interval = time.Duration(snapshot.Tasks.PublishIntervalSeconds) * time.Second
+	t.deadRows = -1
+	sink, options := t.factory(t, snapshot, t.acknowledge)
+	if sink == nil {
+		// Removed by a reload, the task is only removed by a restart
+		taskLog(t).Warnf("Sink %s is no longer configured, its rows are kept pending", t.sinkName)
+		t.idle(ctx)
+		return
+	}
+	t.sinkLock.Lock()
+	t.sink, t.options = sink, options
+	t.sinkLock.Unlock()
+	defer sink.Close()
+
+	if !t.connect(ctx, sink) {
+		taskLog(t).Info("Stopping...")
+		return
+	}
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			taskLog(t).Info("Stopping...")
+			return
+		case <-ticker.C:
+			t.manager.Heartbeat(t, t.interval+5*time.Minute)
+			t.deliver(ctx, sink)
+			t.prune()
+		}
+	}
+}
+
+// Health reports the health of the sink
+func (t *DeliveryTask) Health() error {
+	t.sinkLock.Lock()
+	sink := t.sink
+	t.sinkLock.Unlock()
+	if sink == nil {
+		return fmt.Errorf("sink %s is not configured", t.sinkName)
+	}
+	return sink.Health()
+}
+
+// connect retries until the sink is connected and returns false if the
+// context is canceled first
+func (t *DeliveryTask) connect(ctx context.Context, sink Sink) bool {
+	for {
+		// Keep beating while retrying, an unreachable sink shows up in the readiness instead
+		t.manager.Heartbeat(t, time.Minute+2*t.retryDelay)
+		err := sink.Connect(ctx)
+		if err == nil {
+			taskLog(t).Infof("Connected to sink %s", t.sinkName)
+			return true
+		}
+		taskLog(t).Errorf("Failed to connect to sink %s: %v. Retrying in %v...", t.sinkName, err, t.retryDelay)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(t.retryDelay):
+		}
+	}
+}
+
+// idle keeps beating until the context is canceled
+func (t *DeliveryTask) idle(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	t.manager.Heartbeat(t, 2*time.Minute)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.manager.Heartbeat(t, 2*time.Minute)
+		}
+	}
+}
+
+// deliver sends the due rows page by page, so a large backlog after an outage
+// is never loaded at once. Each batch is marked in flight with a single update
+// before it is sent, and done once confirmed.
+func (t *DeliveryTask) deliver(ctx context.Context, sink Sink) {
+	entry := taskLog(t).WithField("sink", t.sinkName)
+	expired, err := models.ExpireInFlight(t.db, t.sinkName, fmt.Sprintf("not acknowledged within %v", t.options.AckTimeout), t.options.Retry)
+	if err != nil {
+		entry.Errorf("Error failing unacknowledged deliveries: %v", err)
+		return
+	}
+	if expired > 0 {
+		entry.Warnf("%d samples were not acknowledged within %v, they are retried", expired, t.options.AckTimeout)
+	}
+	if err := t.updateMetrics(); err != nil {
+		entry.Errorf("Error counting deliveries: %v", err)
+		return
+	}
+
+	var lastID uint
+	for ctx.Err() == nil {
+		page, err := models.DueDeliveries(t.db, t.sinkName, lastID, t.options.PageSize)
+		if err != nil {
+			entry.Errorf("Error fetching pending data: %v", err)
+			return
+		}
+		if len(page) == 0 {
+			return
+		}
+		lastID = page[len(page)-1].ID
+		// A large backlog takes many pages
+		t.manager.Heartbeat(t, t.interval+5*time.Minute)
+
+		batches, err := t.batches(page)
+		if err != nil {
+			entry.Errorf("Error grouping pending data: %v", err)
+			return
+		}
+		for _, batch := range batches {
+			entry := entry.WithField("route", batch.Route)
+			// Marked before sending, the acknowledgement may arrive first
+			if err := models.MarkSyncAttempt(t.db, t.sinkName, batch.IDs, batch.Payload.BatchID, t.options.AckTimeout); err != nil {
+				entry.Errorf("Failed to update the delivery of %d samples: %v", len(batch.IDs), err)
+				return
+			}
+			delivered, err := sink.Send(ctx, batch)
+			if err != nil {
+				telemetry.SinkSent.WithLabelValues(t.sinkName, "failure").Inc()
+				entry.Errorf("Failed to send %d samples: %v", len(batch.IDs), err)
+				if err := models.MarkSyncFailed(t.db, t.sinkName, batch.IDs, err.Error(), t.options.Retry); err != nil {
+					entry.Errorf("Failed to update the delivery of %d samples: %v", len(batch.IDs), err)
+				}
+				// The sink is likely unavailable, retry on the next round
+				return
+			}
+			telemetry.SinkSent.WithLabelValues(t.sinkName, "success").Inc()
+			if !delivered {
+				// Marked done by acknowledge
+				continue
+			}
+			if err := models.MarkSynced(t.db, t.sinkName, batch.IDs); err != nil {
+				entry.Errorf("Failed to update the delivery of %d samples: %v", len(batch.IDs), err)
+				return
+			}
+			entry.Debugf("Delivered %d samples", len(batch.IDs))
+		}
+	}
+}
+
+// acknowledge marks the rows of a batch confirmed by the sink as delivered
+func (t *DeliveryTask) acknowledge(batchID string) {
+	delivered, err := models.AcknowledgeBatch(t.db, t.sinkName, batchID)
+	if err != nil {
+		// Failed once the timeout expires, and retried
+		taskLog(t).Errorf("Failed to update the deliveries of batch %s: %v", batchID, err)
+		return
+	}
+	if delivered == 0 {
+		// Acknowledged already, the batch was sent again before the first acknowledgement arrived
+		taskLog(t).Debugf("Ignoring the acknowledgement of unknown batch %s", batchID)
+		return
+	}
+	taskLog(t).Debugf("Batch %s of %d samples acknowledged", batchID, delivered)
+}
+
+// updateMetrics counts the deliveries by status and raises an alert when rows
+// are dead since the previous round
+func (t *DeliveryTask) updateMetrics() error {
+	counts, err := models.CountSyncStatuses(t.db, t.sinkName)
+	if err != nil {
+		return err
+	}
+	for _, status := range models.SyncStatuses {
+		telemetry.SinkRows.WithLabelValues(t.sinkName, string(status)).Set(float64(counts[status]))
+	}
+
+	dead := counts[models.SyncStatusDead]
+	if t.deadRows >= 0 && dead > t.deadRows {
+		telemetry.SinkDeadLettered.WithLabelValues(t.sinkName).Add(float64(dead - t.deadRows))
+		taskLog(t).WithField("sink", t.sinkName).WithField("dead", dead).
+			Errorf("%d samples ran out of delivery attempts, list them on /sync/dead and requeue them once fixed", dead-t.deadRows)
+	}
+	t.deadRows = dead
+	return nil
+}
+
+// prune removes the deliveries done of the rows dropped by the retention
+func (t *DeliveryTask) prune() {
+	retentionDays := t.conf.Snapshot().Database.RetentionDays
+	if retentionDays <= 0 {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	if _, err := models.PruneDeliveries(t.db, cutoff); err != nil {
+		taskLog(t).Errorf("Error pruning deliveries: %v", err)
+	}
+}
+
+// batchID identifies a batch by its collector and rows, so the same rows
+// grouped the same way after a restart are recognized by the receiver
+func batchID(origin string, ids []uint) string {
+	hash := sha256.New()
+	hash.Write([]byte(origin))
+	for _, id := range ids {
+		binary.Write(hash, binary.BigEndian, uint64(id))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// batches groups the rows of a page by route, in batches of at most BatchSize
+// samples
+func (t *DeliveryTask) batches(page []models.Data) ([]*SinkBatch, error) {
+	customers, err := t.customers(page)
+	if err != nil {
+		return nil, err
+	}
+
+	var batches []*SinkBatch
+	open := map[string]*SinkBatch{}
+	for _, data := range page {
+		route := renderTopic(t.options.Route, data, customers(data))
+		batch, exists := open[route]
+		if !exists || len(batch.IDs) >= t.options.BatchSize {
+			batch = &SinkBatch{Route: route}
+			open[route] = batch
+			batches = append(batches, batch)
+		}
+		batch.IDs = append(batch.IDs, data.ID)
+		batch.Payload.Samples = append(batch.Payload.Samples, data.VMData())
+	}
+	for _, batch := range batches {
+		batch.Payload.BatchID = batchID(t.options.Origin, batch.IDs)
+		batch.Payload.Source = t.options.Origin
+	}
+	return batches, nil
+}
+
+// customers returns the customer owning the VM of a sample at its time, only
+// queried when the route needs it
+func (t *DeliveryTask) customers(page []models.Data) (func(models.Data) string, error) {
+	if !strings.Contains(t.options.Route, "{customer}") {
+		return func(models.Data) string { return "" }, nil
+	}
+
+	vmIDs := make([]int, 0, len(page))
+	for _, data := range page {
+		vmIDs = append(vmIDs, data.VMID)
+	}
+	var ownerships []models.VMOwnership
+	if err := t.db.Where("vm_id IN ?", vmIDs).Find(&ownerships).Error; err != nil {
+		return nil, err
+	}
+	return func(data models.Data) string {
+		for _, ownership := range ownerships {
+			if ownership.Owns(models.NewVMKey(data.SiteID, data.Cluster, data.VMID)) && ownership.Covers(int64(data.Time)) {
+				return strconv.FormatUint(uint64(ownership.CustomerID), 10)
+			}
+		}
+		return "unassigned"
+	}, nil
+}
+
+// topicLevel removes the characters that would change the structure of the
+// topic, or of the NATS subject
+var topicLevel = strings.NewReplacer("/", "_", "+", "_", "#", "_", "*", "_", ">", "_")
+
+// renderTopic replaces the placeholders of the topic template by the values of the sample
+func renderTopic(template string, data models.Data, customer string) string {
+	cluster := data.Cluster
+	if cluster == "" {
+		cluster = "unknown"
+	}
+	return strings.NewReplacer(
+		"{cluster}", topicLevel.Replace(cluster),
+		"{customer}", topicLevel.Replace(customer),
+		"{vmid}", strconv.Itoa(data.VMID),
+	).Replace(template)
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"billingo/models"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+var vmLabels = []string{"vmid", "name", "cluster", "node", "type", "customer"}
+
+// VMUsageCollector exports the latest RRDData held by the Manager as Prometheus
+// gauges labelled with the VM details and its current customer
+type VMUsageCollector struct {
+	manager  *Manager
+	db       *gorm.DB
+	gauges   map[string]*prometheus.Desc
+	fields   []string
+	lastSeen *prometheus.Desc
+}
+
+// NewVMUsageCollector creates a collector reading the state of the manager on every scrape
+func NewVMUsageCollector(manager *Manager, db *gorm.DB) *VMUsageCollector {
+	c := &VMUsageCollector{
+		manager: manager,
+		db:      db,
+		gauges:  make(map[string]*prometheus.Desc),
+		lastSeen: prometheus.NewDesc("billingo_vm_last_sample_age_seconds",
+			"Seconds since the latest sample of the VM.", vmLabels, nil),
+	}
+	for _, gauge := range []struct{ field, name, help string }{
+		{"cpu", "billingo_vm_cpu_ratio", "CPU usage of the VM relative to its vCPUs."},
+		{"mem", "billingo_vm_mem_bytes", "Memory used by the VM."},
+		{"disk", "billingo_vm_disk_bytes", "Disk space used by the VM."},
+		{"netin", "billingo_vm_netin_bytes_per_second", "Network traffic received by the VM."},
+		{"netout", "billingo_vm_netout_bytes_per_second", "Network traffic sent by the VM."},
+		{"diskread", "billingo_vm_diskread_bytes_per_second", "Disk reads of the VM."},
+		{"diskwrite", "billingo_vm_diskwrite_bytes_per_second", "Disk writes of the VM."},
+	} {
+		c.fields = append(c.fields, gauge.field)
+		c.gauges[gauge.field] = prometheus.NewDesc(gauge.name, gauge.help, vmLabels, nil)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *VMUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.gauges {
+		ch <- desc
+	}
+	ch <- c.lastSeen
+}
+
+// Collect implements prometheus.Collector
+func (c *VMUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	customers, err := c.currentCustomers()
+	if err != nil {
+		log.Errorf("Error fetching VM customers for the exporter: %v", err)
+	}
+
+	now := time.Now()
+	for key, data := range c.manager.GetAllVMData() {
+		info, _ := c.manager.GetVMInfo(key)
+		labels := []string{strconv.Itoa(key.VMID), info.Name, key.Cluster, info.Node, string(info.Type), customers(key)}
+
+		values := map[string]*float64{
+			"cpu":       data.CPU,
+			"mem":       data.Mem,
+			"disk":      data.Disk,
+			"netin":     data.NetIn,
+			"netout":    data.NetOut,
+			"diskread":  data.DiskRead,
+			"diskwrite": data.DiskWrite,
+		}
+		for _, field := range c.fields {
+			if value := values[field]; value != nil {
+				ch <- prometheus.MustNewConstMetric(c.gauges[field], prometheus.GaugeValue, *value, labels...)
+			}
+		}
+		age := now.Sub(time.Unix(int64(data.Time), 0)).Seconds()
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue, age, labels...)
+	}
+}
+
+// currentCustomers returns the name of the customer owning a VM of the local
+// collector now
+func (c *VMUsageCollector) currentCustomers() (func(models.VMKey) string, error) {
+	var rows []struct {
+		models.VMOwnership
+		Name string
+	}
+	now := time.Now()
+	err := c.db.Model(&models.VMOwnership{}).
+		Select("vm_ownerships.*, customers.name AS name").
+		Joins("JOIN customers ON customers.id = vm_ownerships.customer_id").
+		Where("vm_ownerships.site_id IS NULL").
+		Where("vm_ownerships.start_time <= ? AND (vm_ownerships.end_time IS NULL OR vm_ownerships.end_time > ?)", now, now).
+		Scan(&rows).Error
+
+	return func(key models.VMKey) string {
+		for _, row := range rows {
+			if row.Owns(key) {
+				return row.Name
+			}
+		}
+		return ""
+	}, err
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// fileSink appends each sample as a JSON line to a file, the delivery is
+// confirmed once the file is synced to disk
+type fileSink struct {
+	path string
+	// lock guards the file, written by Send and closed by Close
+	lock sync.Mutex
+	file *os.File
+}
+
+// fileSample is a line of the file, the batch ID lets a reader drop the
+// samples of a batch written twice
+type fileSample struct {
+	BatchID string `json:"batch_id"`
+	models.VMData
+}
+
+func newFileSink(settings config.SinkConfig) *fileSink {
+	return &fileSink{path: settings.Path}
+}
+
+// Connect opens the file for appending, creating it if needed
+func (f *fileSink) Connect(ctx context.Context) error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.file = file
+	return nil
+}
+
+func (f *fileSink) Send(ctx context.Context, batch *SinkBatch) (bool, error) {
+	var lines []byte
+	for _, sample := range batch.Payload.Samples {
+		line, err := json.Marshal(fileSample{BatchID: batch.Payload.BatchID, VMData: sample})
+		if err != nil {
+			return false, err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return false, fmt.Errorf("file %s is not open", f.path)
+	}
+	// A single write, the lines of a batch are not interleaved with others
+	if _, err := f.file.Write(lines); err != nil {
+		return false, err
+	}
+	if err := f.file.Sync(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *fileSink) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// Health reports whether the file is open
+func (f *fileSink) Health() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return fmt.Errorf("file %s is not open", f.path)
+	}
+	return nil
+}
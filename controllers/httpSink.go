@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"billingo/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// httpSink posts each batch as JSON to a webhook, a 2xx response confirms the
+// delivery. The batch ID is sent as Idempotency-Key so the receiver can ignore
+// a batch sent again.
+type httpSink struct {
+	name   string
+	url    string
+	conf   *config.Config
+	client *http.Client
+	// lastErr is the error of the last request, nil once one succeeds
+	lock    sync.Mutex
+	lastErr error
+}
+
+func newHTTPSink(conf *config.Config, settings config.SinkConfig) *httpSink {
+	return &httpSink{
+		name:   settings.Name,
+		url:    settings.URL,
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(settings.TimeoutSeconds) * time.Second},
+	}
+}
+
+// Connect has nothing to connect, every batch is a request
+func (h *httpSink) Connect(ctx context.Context) error {
+	return nil
+}
+
+func (h *httpSink) Send(ctx context.Context, batch *SinkBatch) (bool, error) {
+	payload, err := json.Marshal(batch.Payload)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", batch.Payload.BatchID)
+	// Read on every request to pick up rotated tokens
+	if settings, exists := h.conf.Sink(h.name); exists && settings.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+settings.Token)
+	}
+
+	err = h.post(req)
+	h.lock.Lock()
+	h.lastErr = err
+	h.lock.Unlock()
+	return err == nil, err
+}
+
+func (h *httpSink) post(req *http.Request) error {
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drained so the connection is reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, h.url)
+	}
+	return nil
+}
+
+func (h *httpSink) Close() {
+	h.client.CloseIdleConnections()
+}
+
+// Health reports the error of the last request
+func (h *httpSink) Health() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastErr
+}
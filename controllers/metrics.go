@@ -1,10 +1,11 @@
 package controllers
 
 import (
+	"billingo/config"
 	"billingo/models"
 	"billingo/proxmox"
+	"billingo/telemetry"
 	"context"
-	"fmt"
 	"sync"
 	"time"
 
@@ -15,10 +16,14 @@ type MetricsTask struct {
 	name    string
 	db      *gorm.DB
 	manager *Manager
+	conf    *config.Config
 }
 
-func NewMetrics(name string) *MetricsTask {
-	return &MetricsTask{name: name}
+// NewMetrics creates a task collecting the RRD data of every VM of the
+// configured clusters. The clusters are read on every run so rotated tokens
+// and reloaded cluster lists are used without a restart.
+func NewMetrics(name string, conf *config.Config) *MetricsTask {
+	return &MetricsTask{name: name, conf: conf}
 }
 
 func (t *MetricsTask) Setup(db *gorm.DB, manager *Manager) {
@@ -27,42 +32,24 @@ func (t *MetricsTask) Setup(db *gorm.DB, manager *Manager) {
 }
 
 func (t *MetricsTask) Main(ctx context.Context) {
-	ticker := time.NewTicker(50 * time.Minute)
+	tasks := t.conf.Snapshot().Tasks
+	interval := time.Duration(tasks.MetricsIntervalMinutes) * time.Minute
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-
-	resourceTypes := []models.ResourceType{models.QEMU, models.LXC}
-	timeframe := "hour"
+	t.manager.Heartbeat(t, 2*interval)
 
 	// Trigger the task logic immediately
-	go func() {
-		fmt.Printf("Task %s is running (initial run)\n", t.name)
-		nodes, err := proxmox.FetchNodes()
-		if err != nil {
-			fmt.Printf("Error fetching nodes: %v\n", err)
-			return
-		}
-
-		for _, node := range nodes {
-			go t.processNode(node.Node, timeframe, resourceTypes)
-		}
-	}()
+	taskLog(t).Info("Task is running (initial run)")
+	t.collect(tasks.RRDTimeframe)
 
 	for {
 		select {
 		case <-ticker.C:
-			// Perform task logic here
-			fmt.Printf("Task %s is running\n", t.name)
-			nodes, err := proxmox.FetchNodes()
-			if err != nil {
-				fmt.Printf("Error fetching nodes: %v\n", err)
-				continue
-			}
-
-			for _, node := range nodes {
-				go t.processNode(node.Node, timeframe, resourceTypes)
-			}
+			t.manager.Heartbeat(t, 2*interval)
+			taskLog(t).Info("Task is running")
+			t.collect(tasks.RRDTimeframe)
 		case <-ctx.Done():
-			fmt.Printf("Task %s is stopping\n", t.name)
+			taskLog(t).Info("Task is stopping")
 			return
 		}
 	}
@@ -72,12 +59,40 @@ func (t *MetricsTask) String() string {
 	return t.name
 }
 
+// Reconfigure implements Reconfigurable, the interval and timeframe are only
+// read when the task starts
+func (t *MetricsTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, "tasks.metrics_interval_minutes", "tasks.rrd_timeframe") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+// collect processes every node of every cluster in the background, a cluster
+// that cannot be reached does not hold back the others
+func (t *MetricsTask) collect(timeframe string) {
+	resourceTypes := []models.ResourceType{models.QEMU, models.LXC}
+	for _, cluster := range t.conf.Snapshot().Proxmox.Clusters {
+		go func(cluster config.ProxmoxCluster) {
+			nodes, err := proxmox.FetchNodes(cluster)
+			if err != nil {
+				taskLog(t).WithField("cluster", cluster.Name).Errorf("Error fetching nodes: %v", err)
+				return
+			}
+
+			for _, node := range nodes {
+				go t.processNode(cluster, node.Node, timeframe, resourceTypes)
+			}
+		}(cluster)
+	}
+}
+
 // processNode processes a node to fetch and update VM/container metrics.
-func (t *MetricsTask) processNode(node string, timeframe string, resourceTypes []models.ResourceType) {
+func (t *MetricsTask) processNode(cluster config.ProxmoxCluster, node string, timeframe string, resourceTypes []models.ResourceType) {
 	for _, resourceType := range resourceTypes {
-		resources, err := proxmox.FetchResources(node, resourceType)
+		resources, err := proxmox.FetchResources(cluster, node, resourceType)
 		if err != nil {
-			fmt.Printf("Error fetching resources of type %s on node %s: %v\n", resourceType, node, err)
+			taskLog(t).WithField("cluster", cluster.Name).WithField("node", node).Errorf("Error fetching resources of type %s: %v", resourceType, err)
 			continue
 		}
 
@@ -85,8 +100,15 @@ func (t *MetricsTask) processNode(node string, timeframe string, resourceTypes [
 		var wg sync.WaitGroup
 
 		for _, resource := range resources {
+			t.manager.SetVMInfo(models.VMInfo{
+				VMID:    resource.VMID,
+				Name:    resource.Name,
+				Cluster: cluster.Name,
+				Node:    node,
+				Type:    resourceType,
+			})
 			wg.Add(1)
-			go proxmox.RRDWorker(&wg, node, resourceType, resource.VMID, timeframe, results)
+			go proxmox.RRDWorker(&wg, cluster, node, resourceType, resource.VMID, timeframe, results)
 		}
 
 		go func() {
@@ -94,11 +116,11 @@ func (t *MetricsTask) processNode(node string, timeframe string, resourceTypes [
 			close(results)
 		}()
 
-		t.processResults(results, resourceType, node)
+		t.processResults(results, resourceType, cluster.Name)
 	}
 }
 
-func (t *MetricsTask) processResults(results chan map[int][]models.RRDData, resourceType models.ResourceType, node string) {
+func (t *MetricsTask) processResults(results chan map[int][]models.RRDData, resourceType models.ResourceType, cluster string) {
 	rrdResults := make(map[int][]models.RRDData)
 	for result := range results {
 		for vmid, data := range result {
@@ -107,16 +129,17 @@ func (t *MetricsTask) processResults(results chan map[int][]models.RRDData, reso
 	}
 
 	for vmid, data := range rrdResults {
-		// fmt.Printf("--- Dados históricos para %s ID %d no nó %s:\n", resourceType, vmid, node)
+		key := models.VMKey{Cluster: cluster, VMID: vmid}
 		for _, point := range data {
 			// Atualiza o timestamp para o VMID
-			vmRRDData, exists := t.manager.GetMetric(vmid)
+			vmRRDData, exists := t.manager.GetMetric(key)
 			if exists && vmRRDData.Time >= point.Time {
 				continue
 			}
 
 			if point.CPU != nil { // Verifica se CPU não é nil (ou seja, está online)
-				t.manager.SetMetric(vmid, point)
+				t.manager.SetMetric(key, point)
+				telemetry.RRDSamples.WithLabelValues(string(resourceType)).Inc()
 				// cpuUsage := (*point.CPU / *point.MaxCPU) * 100
 				// memUsage := (*point.Mem / *point.MaxMem) * 100
 				// diskUsage := (*point.Disk / *point.MaxDisk) * 100
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/models"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mqttClientID returns the configured client ID, or one derived from the host
+// name so the broker keeps the session of the client across restarts
+func mqttClientID(configured, role string) string {
+	if configured != "" {
+		return configured
+	}
+	return fmt.Sprintf("billingo-%s-%s", role, hostname())
+}
+
+// hostname returns the host name identifying the collector
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// mqttTLSConfig builds the TLS configuration of a client, nil when nothing is
+// configured so the client uses its defaults
+func mqttTLSConfig(conf config.MQTTTLSConfig) (*tls.Config, error) {
+	if conf == (config.MQTTTLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CAFile)
+		}
+	}
+	if conf.CertFile != "" {
+		// Read on every connection to pick up renewed certificates
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+			return &cert, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientTopic renders a topic template of the client, such as its status
+// topic, empty when disabled
+func clientTopic(template, clientID string) string {
+	return strings.ReplaceAll(template, "{client_id}", topicLevel.Replace(clientID))
+}
+
+// collectorStatus returns the payload announcing the status of a collector
+func collectorStatus(clientID, status string) []byte {
+	payload, _ := json.Marshal(models.CollectorStatus{ClientID: clientID, Status: status})
+	return payload
+}
@@ -1,133 +1,291 @@
 package controllers
 
 import (
+	"billingo/config"
 	"billingo/models"
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"gorm.io/gorm"
 )
 
-type MqttPublisher struct {
-	name       string
-	manager    *Manager
+// mqttSink publishes the collected data to the broker of the publisher
+// configuration. When an acknowledgement topic is set the batches are only
+// delivered once the central side acknowledged them.
+type mqttSink struct {
+	task     *DeliveryTask
+	conf     *config.Config
+	settings config.MQTTPublisherConfig
+	acks     func(batchID string)
+	// clientLock guards the client, replaced on every connection attempt
+	clientLock sync.Mutex
 	client     mqtt.Client
-	topic      string
-	brokerURL  string
-	username   string
-	password   string
-	retryDelay time.Duration
-	db         *gorm.DB
+	clientID   string
+	// statusTopic receives the retained online and offline status, empty when disabled
+	statusTopic string
+	// ackTopic receives the acknowledgements of the central side, empty when disabled
+	ackTopic string
+	// commandTopic receives the commands of the central side, empty when disabled
+	commandTopic string
+	commands     *commandRunner
+	// connectTimeout bounds each connection attempt, the client waits forever otherwise
+	connectTimeout time.Duration
 }
 
-func NewMQTTPublisherTask(name, brokerURL, topic, username, password string) *MqttPublisher {
-	return &MqttPublisher{
-		name:       name,
-		topic:      topic,
-		brokerURL:  brokerURL,
-		username:   username,
-		password:   password,
-		retryDelay: 5 * time.Second, // Retry every 5 seconds
+// NewMQTTPublisherTask creates a task publishing the collected data to the
+// broker of the publisher configuration
+func NewMQTTPublisherTask(name string, conf *config.Config) *DeliveryTask {
+	return newDeliveryTask(name, config.MQTTSinkName, conf, newMQTTSink, "mqtt.publisher")
+}
+
+// newMQTTSink builds the MQTT sink from the publisher configuration
+func newMQTTSink(t *DeliveryTask, snapshot config.Config, acks func(string)) (Sink, SinkOptions) {
+	publisher := snapshot.MQTT.Publisher
+	m := &mqttSink{
+		task:           t,
+		conf:           t.conf,
+		settings:       publisher,
+		acks:           acks,
+		clientID:       mqttClientID(publisher.ClientID, "publisher"),
+		connectTimeout: 30 * time.Second,
+	}
+	m.statusTopic = clientTopic(publisher.StatusTopic, m.clientID)
+	m.ackTopic = clientTopic(publisher.AckTopic, m.clientID)
+	if publisher.CommandPublicKey != "" {
+		m.commandTopic = clientTopic(publisher.CommandTopic, m.clientID)
+		m.commands = newCommandRunner(t)
+	} else if publisher.CommandTopic != "" {
+		taskLog(t).Info("Commands of the central side are disabled, no command public key is set")
+	}
+
+	ackTimeout := time.Duration(publisher.AckTimeoutSeconds) * time.Second
+	if m.ackTopic == "" {
+		// Bounds the publication, the rows of an interrupted one are failed
+		ackTimeout = m.connectTimeout
+	}
+	return m, SinkOptions{
+		Origin:     m.clientID,
+		Route:      publisher.Topic,
+		BatchSize:  publisher.BatchSize,
+		PageSize:   publisher.PageSize,
+		AckTimeout: ackTimeout,
+		Retry: models.SyncRetry{
+			MaxAttempts: publisher.MaxAttempts,
+			Backoff:     time.Duration(publisher.RetryBackoffSeconds) * time.Second,
+			MaxBackoff:  time.Duration(publisher.RetryMaxBackoffSeconds) * time.Second,
+		},
 	}
 }
 
-func (m *MqttPublisher) Setup(db *gorm.DB, manager *Manager) {
-	m.manager = manager
-	m.db = db
+// Health reports whether the publisher is connected to the broker
+func (m *mqttSink) Health() error {
+	client := m.current()
+	if client == nil || !client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker %s", m.settings.BrokerURL)
+	}
+	return nil
 }
 
-func (m *MqttPublisher) String() string {
-	return m.name
+func (m *mqttSink) current() mqtt.Client {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
+	return m.client
 }
 
-// Main function to handle the MQTT publishing task.
-func (m *MqttPublisher) Main(ctx context.Context) {
-	// Initialize MQTT client
-	m.connectToMqttBroker()
+// Connect connects to the MQTT broker with the credentials of the current
+// configuration
+func (m *mqttSink) Connect(ctx context.Context) error {
+	tlsConfig, err := mqttTLSConfig(m.settings.TLS)
+	if err != nil {
+		// The files are checked by the validation, they may have been removed since
+		return fmt.Errorf("loading the TLS configuration: %w", err)
+	}
 
-	// Main loop to process pending data
-	ticker := time.NewTicker(10 * time.Second) // Adjust interval as needed
-	defer ticker.Stop()
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(m.settings.BrokerURL)
+	// Read on every connection to pick up rotated credentials
+	opts.SetCredentialsProvider(func() (string, string) {
+		publisher := m.conf.Snapshot().MQTT.Publisher
+		return publisher.Username, publisher.Password
+	})
+	opts.SetClientID(m.clientID)
+	// A persistent session keeps the QoS 1 and 2 messages in flight across reconnections
+	opts.SetCleanSession(!m.settings.PersistentSession)
+	opts.SetConnectTimeout(m.connectTimeout)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("Shutting down MQTT publisher...")
-			return
-		case <-ticker.C:
-			// Fetch pending data and publish
-			m.processPendingData()
-		}
+	if m.statusTopic != "" {
+		// The broker announces the collector offline when the connection drops
+		opts.SetBinaryWill(m.statusTopic, collectorStatus(m.clientID, models.CollectorOffline), 1, true)
 	}
-}
+	if m.ackTopic != "" {
+		// A persistent session may deliver acknowledgements before the subscription is renewed
+		opts.SetDefaultPublishHandler(m.handleAck)
+	}
+	opts.SetOnConnectHandler(m.onConnect)
 
-func (m *MqttPublisher) processPendingData() {
-	var pendingData []models.Data
+	client := mqtt.NewClient(opts)
+	if m.commandTopic != "" {
+		// Commands may also be delivered before the subscription is renewed
+		client.AddRoute(m.commandTopic, m.handleCommand)
+	}
+	m.clientLock.Lock()
+	m.client = client
+	m.clientLock.Unlock()
 
-	// Fetch pending data from the database
-	if err := m.db.Where("sync_status = ?", "pending").Find(&pendingData).Error; err != nil {
-		log.Printf("Error fetching pending data: %v", err)
+	token := client.Connect()
+	if !token.WaitTimeout(m.connectTimeout) {
+		return fmt.Errorf("timed out connecting to broker")
+	}
+	return token.Error()
+}
+
+// Close announces the collector offline, the Last Will is not sent on a clean
+// disconnection
+func (m *mqttSink) Close() {
+	client := m.current()
+	if client == nil || !client.IsConnected() {
 		return
 	}
+	m.publishStatus(client, models.CollectorOffline)
+	client.Disconnect(250)
+}
 
-	for _, data := range pendingData {
-		if err := m.publishData(data); err != nil {
-			log.Printf("Failed to publish data (ID: %d): %v", data.ID, err)
-			continue
-		}
+// onConnect announces the collector online and subscribes to the acknowledgements,
+// on every connection
+func (m *mqttSink) onConnect(client mqtt.Client) {
+	m.publishStatus(client, models.CollectorOnline)
+	if m.ackTopic != "" {
+		m.subscribe(client, m.ackTopic, "acknowledgements", m.handleAck)
+	}
+	if m.commandTopic != "" {
+		m.subscribe(client, m.commandTopic, "commands", m.handleCommand)
+	}
+}
 
-		// Update sync_status to "success" after successful publication
-		if err := m.db.Model(&data).Update("sync_status", "success").Error; err != nil {
-			log.Printf("Failed to update sync_status for data (ID: %d): %v", data.ID, err)
-		}
+// subscribe subscribes to a topic of the central side with QoS 1
+func (m *mqttSink) subscribe(client mqtt.Client, topic, what string, handler mqtt.MessageHandler) {
+	token := client.Subscribe(topic, 1, handler)
+	if !token.WaitTimeout(m.connectTimeout) {
+		taskLog(m.task).Errorf("Timed out subscribing to the %s on %s", what, topic)
+	} else if token.Error() != nil {
+		taskLog(m.task).Errorf("Failed to subscribe to the %s on %s: %v", what, topic, token.Error())
 	}
 }
 
-// Connect to the MQTT broker with validation and credentials.
-func (m *MqttPublisher) connectToMqttBroker() {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(m.brokerURL)
-	opts.SetUsername(m.username)
-	opts.SetPassword(m.password)
-	opts.SetClientID(fmt.Sprintf("client-%d", time.Now().UnixNano()))
-	opts.SetCleanSession(true)
-
-	m.client = mqtt.NewClient(opts)
-
-	for {
-		token := m.client.Connect()
-		if token.Wait() && token.Error() == nil {
-			log.Println("Connected to MQTT broker")
+// publishStatus publishes the retained status of the collector on its status topic
+func (m *mqttSink) publishStatus(client mqtt.Client, status string) {
+	if m.statusTopic == "" {
+		return
+	}
+	token := client.Publish(m.statusTopic, 1, true, collectorStatus(m.clientID, status))
+	if !token.WaitTimeout(m.connectTimeout) {
+		taskLog(m.task).Warnf("Timed out publishing the %s status", status)
+	} else if token.Error() != nil {
+		taskLog(m.task).Warnf("Failed to publish the %s status: %v", status, token.Error())
+	}
+}
+
+// handleAck marks the rows of an acknowledged batch as delivered
+func (m *mqttSink) handleAck(client mqtt.Client, msg mqtt.Message) {
+	var ack models.BatchAck
+	if err := json.Unmarshal(msg.Payload(), &ack); err != nil || ack.BatchID == "" {
+		taskLog(m.task).WithField("topic", msg.Topic()).Warnf("Ignoring an invalid acknowledgement of %d bytes", len(msg.Payload()))
+		return
+	}
+	m.acks(ack.BatchID)
+}
+
+// handleCommand runs a command of the central side and publishes its signed
+// result on the reply topic of the command
+func (m *mqttSink) handleCommand(client mqtt.Client, msg mqtt.Message) {
+	entry := taskLog(m.task).WithField("topic", msg.Topic())
+	var command models.Command
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil || command.ID == "" {
+		entry.Warnf("Ignoring an invalid command of %d bytes", len(msg.Payload()))
+		return
+	}
+	// Read on every command to pick up a rotated key
+	publisher := m.conf.Snapshot().MQTT.Publisher
+	maxAge := time.Duration(publisher.CommandMaxAgeSeconds) * time.Second
+	if err := m.commands.accept(command, msg.Payload(), publisher.Site, publisher.CommandPublicKey, maxAge); err != nil {
+		entry.Warnf("Rejected command %s: %v", command.ID, err)
+		return
+	}
+
+	entry.Infof("Running command %s: %s", command.ID, command.Type)
+	// Commands may take a while, the handler must not block the next messages
+	go func() {
+		result := m.commands.run(command)
+		if result.Status != models.CommandOK {
+			entry.Warnf("Command %s failed: %s", command.ID, result.Message)
+		}
+		if command.ReplyTo == "" {
 			return
 		}
-		log.Printf("Failed to connect to broker: %v. Retrying in %v...", token.Error(), m.retryDelay)
-		time.Sleep(m.retryDelay)
-	}
+		key, err := models.ParsePrivateKey(m.conf.Snapshot().MQTT.Publisher.SigningKey)
+		if err == nil {
+			err = result.Sign(key)
+		}
+		if err != nil {
+			entry.Errorf("Failed to sign the result of command %s: %v", command.ID, err)
+			return
+		}
+		payload, err := json.Marshal(result)
+		if err != nil {
+			entry.Errorf("Failed to marshal the result of command %s: %v", command.ID, err)
+			return
+		}
+		token := client.Publish(command.ReplyTo, 1, false, payload)
+		if !token.WaitTimeout(m.connectTimeout) {
+			entry.Warnf("Timed out publishing the result of command %s", command.ID)
+		} else if token.Error() != nil {
+			entry.Warnf("Failed to publish the result of command %s: %v", command.ID, token.Error())
+		}
+	}()
 }
 
-// Publish the metric data to the MQTT broker.
-func (m *MqttPublisher) publishData(data models.Data) error {
-	if m.client == nil || !m.client.IsConnected() {
-		return fmt.Errorf("MQTT client is not connected")
+// Send publishes the samples of the batch in a single message, delivered once
+// acknowledged when an acknowledgement topic is set
+func (m *mqttSink) Send(ctx context.Context, batch *SinkBatch) (bool, error) {
+	client := m.current()
+	if client == nil || !client.IsConnected() {
+		return false, fmt.Errorf("MQTT client is not connected")
 	}
 
-	payload, err := json.Marshal(data)
+	batch.Payload.ReplyTo = m.ackTopic
+	batch.Payload.Signature = ""
+	payload, err := json.Marshal(batch.Payload)
 	if err != nil {
-		log.Printf("Failed to marshal data (ID: %d): %v", data.ID, err)
-		return err
+		return false, err
+	}
+	// Read on every batch to pick up a rotated key
+	if signingKey := m.conf.Snapshot().MQTT.Publisher.SigningKey; signingKey != "" {
+		key, err := models.ParsePrivateKey(signingKey)
+		if err != nil {
+			return false, fmt.Errorf("loading the signing key: %w", err)
+		}
+		if batch.Payload.Signature, err = models.SignPayload(payload, key); err != nil {
+			return false, fmt.Errorf("signing the batch: %w", err)
+		}
+		if payload, err = json.Marshal(batch.Payload); err != nil {
+			return false, err
+		}
 	}
 
-	token := m.client.Publish(m.topic, 2, false, payload) // QoS = 2
-	token.Wait()
-
+	token := client.Publish(batch.Route, byte(m.settings.QoS), false, payload)
+	if !token.WaitTimeout(m.connectTimeout) {
+		return false, fmt.Errorf("timed out publishing message")
+	}
 	if token.Error() != nil {
-		return fmt.Errorf("failed to publish message (ID: %d): %v", data.ID, token.Error())
+		return false, fmt.Errorf("failed to publish message: %v", token.Error())
 	}
 
-	log.Printf("Successfully published data (ID: %d) to MQTT", data.ID)
-	return nil
+	taskLog(m.task).WithField("topic", batch.Route).Debugf("Successfully published %d samples to MQTT", len(batch.IDs))
+	return m.ackTopic == "", nil
 }
@@ -1,135 +1,663 @@
 package controllers
 
 import (
+	"billingo/config"
 	"billingo/models"
+	"billingo/telemetry"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// MQTTSubscriber handles subscribing to an MQTT topic and saving data to the database.
+// MQTTSubscriber handles subscribing to an MQTT topic and saving data to the
+// database. The valid samples are buffered and inserted in batches into
+// data_raw, the messages are acknowledged to the broker once inserted.
 type MQTTSubscriber struct {
-	client mqtt.Client
-	db     *gorm.DB
-	topic  string
+	name    string
+	conf    *config.Config
+	db      *gorm.DB
+	manager *Manager
+	// lock guards the client and settings, replaced when the task restarts
+	lock             sync.Mutex
+	client           mqtt.Client
+	topic            string
+	deadLetterTopic  string
+	batchSize        int
+	flushInterval    time.Duration
+	requireSite      bool
+	resultTopic      string
+	requireSignature bool
+	subscribed       atomic.Bool
+
+	// sitesLock guards the registered sites, reloaded periodically
+	sitesLock     sync.Mutex
+	sites         []models.Site
+	sitesLoadedAt time.Time
+
+	// bufferLock guards the messages waiting to be inserted
+	bufferLock sync.Mutex
+	buffer     []*receivedMessage
+	buffered   int
+	// flush is signaled when the buffer reaches the batch size
+	flush chan struct{}
+}
+
+// receivedMessage is a message of the topic waiting to be inserted, it is
+// acknowledged to the broker and to the collector once inserted
+type receivedMessage struct {
+	msg      mqtt.Message
+	site     *models.Site
+	received *models.ReceivedBatch
+	rows     []models.DataRaw
+	replyTo  string
+}
+
+// NewMQTTSubscriber creates a new MQTTSubscriber for the broker and topic of
+// the subscriber configuration.
+func NewMQTTSubscriber(name string, conf *config.Config) *MQTTSubscriber {
+	return &MQTTSubscriber{name: name, conf: conf}
 }
 
-// NewMQTTSubscriber creates a new MQTTSubscriber.
-func NewMQTTSubscriber(broker, topic string) *MQTTSubscriber {
+// Setup prepares the client from the current configuration.
+func (s *MQTTSubscriber) Setup(db *gorm.DB, manager *Manager) {
+	s.db = db
+	s.manager = manager
+
+	subscriber := s.conf.Snapshot().MQTT.Subscriber
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(fmt.Sprintf("mqtt-subscriber-%d", time.Now().Unix()))
+	opts.AddBroker(subscriber.BrokerURL)
+	tlsConfig, err := mqttTLSConfig(subscriber.TLS)
+	if err != nil {
+		// Connecting fails and is retried by Main
+		taskLog(s).Errorf("Error loading the TLS configuration: %v", err)
+	} else if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	// Read on every connection to pick up rotated credentials
+	opts.SetCredentialsProvider(func() (string, string) {
+		subscriber := s.conf.Snapshot().MQTT.Subscriber
+		return subscriber.Username, subscriber.Password
+	})
+	opts.SetClientID(mqttClientID(subscriber.ClientID, "subscriber"))
+	// A persistent session keeps the messages sent while disconnected
+	opts.SetCleanSession(!subscriber.PersistentSession)
+	opts.SetResumeSubs(true)
 	opts.SetKeepAlive(60 * time.Second)
+	opts.SetConnectTimeout(30 * time.Second)
+	// The messages are acknowledged once inserted, the broker sends them again otherwise
+	opts.SetAutoAckDisabled(true)
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		log.Infof("Received message on topic %s: %s", msg.Topic(), string(msg.Payload()))
+		taskLog(s).WithField("topic", msg.Topic()).Debugf("Received unexpected message of %d bytes", len(msg.Payload()))
 	})
 	opts.OnConnectionLost = func(client mqtt.Client, err error) {
-		log.Warnf("Connection lost: %v", err)
+		taskLog(s).Warnf("Connection lost: %v", err)
 	}
 	opts.OnConnect = func(client mqtt.Client) {
-		log.Infof("Connected to broker: %s", broker)
+		taskLog(s).Infof("Connected to broker: %s", subscriber.BrokerURL)
 	}
-	client := mqtt.NewClient(opts)
 
-	return &MQTTSubscriber{
-		client: client,
-		topic:  topic,
-	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.client = mqtt.NewClient(opts)
+	s.topic = subscriber.Topic
+	s.deadLetterTopic = subscriber.DeadLetterTopic
+	s.batchSize = subscriber.BatchSize
+	s.flushInterval = time.Duration(subscriber.FlushIntervalSeconds) * time.Second
+	s.requireSite = subscriber.RequireSite
+	s.resultTopic = subscriber.ResultTopic
+	s.requireSignature = subscriber.RequireSignature
+	s.flush = make(chan struct{}, 1)
 }
 
-// Setup prepares the subscriber.
-func (s *MQTTSubscriber) Setup(db *gorm.DB, manager *Manager) {
-	s.db = db
-	go func() {
-		for {
-			if token := s.client.Connect(); token.Wait() && token.Error() != nil {
-				log.Errorf("Failed to connect to MQTT broker: %v", token.Error())
-				log.Infof("Retrying connection in 10 seconds...")
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			log.Infof("MQTTSubscriber connected to broker")
-			return // Exit the retry loop after successful connection
-		}
-	}()
+// Health reports whether the subscriber is connected and subscribed to its topic
+func (s *MQTTSubscriber) Health() error {
+	client, topic := s.current()
+	if client == nil || !client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	if !s.subscribed.Load() {
+		return fmt.Errorf("not subscribed to topic %s", topic)
+	}
+	return nil
 }
 
 // String returns a string representation of the MQTTSubscriber.
 func (s *MQTTSubscriber) String() string {
-	return fmt.Sprintf("MQTTSubscriber[topic=%s]", s.topic)
+	return s.name
 }
 
-// Main subscribes to the topic and saves received messages to the database.
+// Reconfigure implements Reconfigurable, the broker is only connected when
+// the task starts
+func (s *MQTTSubscriber) Reconfigure(changed []string) error {
+	if config.Changed(changed, "mqtt.subscriber") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+func (s *MQTTSubscriber) current() (mqtt.Client, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client, s.topic
+}
+
+// Main connects, subscribes to the topic and saves received messages to the database.
 func (s *MQTTSubscriber) Main(ctx context.Context) {
+	client, topic := s.current()
+	qos := byte(s.conf.Snapshot().MQTT.Subscriber.QoS)
+	if !s.connect(ctx, client) {
+		taskLog(s).Info("Stopping...")
+		return
+	}
+
 	for {
+		s.manager.Heartbeat(s, time.Minute)
+		// Attempt to subscribe
+		taskLog(s).Infof("Attempting to subscribe to topic: %s", topic)
+		filters := map[string]byte{topic: qos}
+		if s.resultTopic != "" {
+			filters[s.resultTopic+"/+"] = 1
+		}
+		token := client.SubscribeMultiple(filters, s.handleMessage)
+
+		// Check if subscription was successful
+		if token.WaitTimeout(30*time.Second) && token.Error() == nil {
+			break
+		}
+		taskLog(s).Errorf("Failed to subscribe to topic: %v", token.Error())
+		taskLog(s).Info("Retrying in 10 seconds...")
 		select {
 		case <-ctx.Done():
-			log.Infof("MQTTSubscriber stopping...")
-			// Unsubscribe and disconnect gracefully
-			if token := s.client.Unsubscribe(s.topic); token.Wait() && token.Error() != nil {
-				log.Warnf("Failed to unsubscribe from topic: %v", token.Error())
-			}
-			s.client.Disconnect(250)
+			taskLog(s).Info("Stopping...")
+			client.Disconnect(250)
 			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	taskLog(s).Infof("Successfully subscribed to topic: %s", topic)
+	s.subscribed.Store(true)
+
+	// Insert the buffered samples until the context is canceled
+	ticker := time.NewTicker(time.Minute)
+	flushTicker := time.NewTicker(s.flushInterval)
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			s.manager.Heartbeat(s, 3*time.Minute)
+		case <-flushTicker.C:
+			s.insertBuffer(client)
+		case <-s.flush:
+			s.insertBuffer(client)
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	ticker.Stop()
+	flushTicker.Stop()
+	s.subscribed.Store(false)
+
+	// Unsubscribe, insert what was received and disconnect gracefully
+	taskLog(s).Info("Stopping...")
+	topics := []string{topic}
+	if s.resultTopic != "" {
+		topics = append(topics, s.resultTopic+"/+")
+	}
+	if token := client.Unsubscribe(topics...); token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		taskLog(s).Warnf("Failed to unsubscribe from topic: %v", token.Error())
+	}
+	s.insertBuffer(client)
+	client.Disconnect(250)
+}
+
+// connect retries until connected to the broker and returns false if the
+// context is canceled first
+func (s *MQTTSubscriber) connect(ctx context.Context, client mqtt.Client) bool {
+	for {
+		s.manager.Heartbeat(s, 2*time.Minute)
+		token := client.Connect()
+		if token.WaitTimeout(time.Minute) && token.Error() == nil {
+			taskLog(s).Info("Connected to broker")
+			return true
+		}
+		taskLog(s).Errorf("Failed to connect to MQTT broker: %v", token.Error())
+		taskLog(s).Info("Retrying connection in 10 seconds...")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// handleMessage dispatches the messages of the subscribed topics
+func (s *MQTTSubscriber) handleMessage(client mqtt.Client, msg mqtt.Message) {
+	if s.resultTopic != "" && models.MatchTopic(s.resultTopic+"/+", msg.Topic()) {
+		s.saveResult(msg)
+		return
+	}
+	s.saveMessage(client, msg)
+}
+
+// SendCommand implements CommandSender, the command is signed and published on
+// the command topic of the site. Its result is received on the result topic
+// of the site.
+func (s *MQTTSubscriber) SendCommand(site models.Site, command *models.Command) error {
+	subscriber := s.conf.Snapshot().MQTT.Subscriber
+	if subscriber.CommandSigningKey == "" {
+		return fmt.Errorf("no command signing key is set")
+	}
+	key, err := models.ParsePrivateKey(subscriber.CommandSigningKey)
+	if err != nil {
+		return fmt.Errorf("loading the command signing key: %w", err)
+	}
+	if site.CommandTopic == "" {
+		return fmt.Errorf("site %s has no command topic", site.Name)
+	}
+	client, _ := s.current()
+	if client == nil || !client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+
+	command.Site = site.Name
+	command.ReplyTo = siteResultTopic(s.resultTopic, site.ID)
+	command.IssuedAt = time.Now().UTC()
+	if err := command.Sign(key); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	token := client.Publish(site.CommandTopic, 1, false, payload)
+	if !token.WaitTimeout(30 * time.Second) {
+		return fmt.Errorf("timed out publishing the command")
+	}
+	return token.Error()
+}
+
+// siteResultTopic returns the topic the results of the commands of the site
+// are published on
+func siteResultTopic(resultTopic string, siteID uint) string {
+	return fmt.Sprintf("%s/%d", resultTopic, siteID)
+}
+
+// saveResult records the result of a command sent to a site, received on the
+// result topic of the site and signed with its key
+func (s *MQTTSubscriber) saveResult(msg mqtt.Message) {
+	entry := taskLog(s).WithField("topic", msg.Topic())
+	var result models.CommandResult
+	if err := json.Unmarshal(msg.Payload(), &result); err != nil || result.CommandID == "" {
+		entry.Warnf("Ignoring an invalid command result of %d bytes", len(msg.Payload()))
+		msg.Ack()
+		return
+	}
+
+	siteID, err := strconv.ParseUint(strings.TrimPrefix(msg.Topic(), s.resultTopic+"/"), 10, 0)
+	if err != nil || siteID == 0 {
+		entry.Warnf("Ignoring the result of command %s, not published on the result topic of a site", result.CommandID)
+		msg.Ack()
+		return
+	}
+	var command models.SiteCommand
+	var site models.Site
+	err = s.db.Where("id = ?", result.CommandID).First(&command).Error
+	if err == nil {
+		err = s.db.Where("id = ?", siteID).First(&site).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		entry.Warnf("Received the result of unknown command %s", result.CommandID)
+		msg.Ack()
+		return
+	}
+	if err != nil {
+		// Not acknowledged, the broker sends it again on the next connection
+		entry.Errorf("Failed to load command %s: %v", result.CommandID, err)
+		return
+	}
+	// A site may only report the results of its own commands
+	if command.SiteID != site.ID {
+		entry.Warnf("Ignoring the result of command %s, sent to site %d and not %s", result.CommandID, command.SiteID, site.Name)
+		msg.Ack()
+		return
+	}
+	if err := models.VerifyPayload(msg.Payload(), site.PublicKey); err != nil {
+		entry.Warnf("Ignoring the result of command %s, invalid signature: %v", result.CommandID, err)
+		msg.Ack()
+		return
+	}
+
+	details, err := json.Marshal(result.Details)
+	if err != nil {
+		entry.Warnf("Failed to marshal the details of command %s: %v", result.CommandID, err)
+	}
+	update := s.db.Model(&command).Updates(map[string]interface{}{
+		"status":       result.Status,
+		"message":      result.Message,
+		"details":      string(details),
+		"completed_at": result.CompletedAt,
+	})
+	if update.Error != nil {
+		// Not acknowledged, the broker sends it again on the next connection
+		entry.Errorf("Failed to save the result of command %s: %v", result.CommandID, update.Error)
+		return
+	}
+	msg.Ack()
+}
+
+// saveMessage validates the samples of a message received on the topic and
+// buffers the valid ones to be inserted in the data_raw table. Messages carry a
+// models.DataBatch, or a single models.VMData when sent by older collectors.
+// The rejected messages and samples are published on the dead letter topic,
+// the payloads are never logged.
+func (s *MQTTSubscriber) saveMessage(client mqtt.Client, msg mqtt.Message) {
+	entry := taskLog(s).WithField("topic", msg.Topic())
+	site, err := s.resolveSite(msg.Topic())
+	if err != nil {
+		// Not acknowledged, the broker sends it again on the next connection
+		entry.Errorf("Failed to load the sites: %v", err)
+		return
+	}
+	if site == nil && s.requireSite {
+		entry.Warnf("Rejected a message of %d bytes from a topic not registered to a site", len(msg.Payload()))
+		telemetry.SubscriberSamples.WithLabelValues("rejected").Inc()
+		s.deadLetter(client, models.RejectedMessage{
+			Topic:   msg.Topic(),
+			Reasons: []string{"the topic is not registered to a site"},
+			Payload: msg.Payload(),
+		})
+		msg.Ack()
+		return
+	}
+
+	batch, err := parseBatch(msg.Payload())
+	if err != nil {
+		entry.Warnf("Rejected a message of %d bytes: %v", len(msg.Payload()), err)
+		telemetry.SubscriberSamples.WithLabelValues("rejected").Inc()
+		s.deadLetter(client, models.RejectedMessage{
+			Topic:   msg.Topic(),
+			Reasons: []string{err.Error()},
+			Payload: msg.Payload(),
+		})
+		// Sending it again would not make it valid
+		msg.Ack()
+		return
+	}
+	if err := s.verify(site, msg.Payload()); err != nil {
+		entry.Warnf("Quarantined batch %s of %d samples: %v", batch.BatchID, len(batch.Samples), err)
+		s.quarantine(msg, site, batch, err)
+		return
+	}
+
+	source := batch.Source
+	if source == "" {
+		// Older collectors are identified by their topic
+		source = msg.Topic()
+	}
+	now := time.Now()
+	message := &receivedMessage{msg: msg, site: site}
+	var rejected []models.VMData
+	var reasons []string
+	for _, vmData := range batch.Samples {
+		if err := vmData.Validate(now); err != nil {
+			rejected = append(rejected, vmData)
+			reasons = append(reasons, fmt.Sprintf("vmid %d at %d: %v", vmData.VMID, vmData.Time, err))
+			continue
+		}
+		row := models.DataRaw{
+			RRDData: vmData.RRDData,
+			VMID:    vmData.VMID,
+			Cluster: vmData.Cluster,
+			Node:    vmData.Node,
+			Topic:   msg.Topic(),
+			Source:  source,
+		}
+		if site != nil {
+			row.SiteID = &site.ID
+			if site.Cluster != "" {
+				row.Cluster = site.Cluster
+			}
+		}
+		message.rows = append(message.rows, row)
+	}
+	if len(rejected) > 0 {
+		entry.Warnf("Rejected %d of the %d samples of batch %s", len(rejected), len(batch.Samples), batch.BatchID)
+		telemetry.SubscriberSamples.WithLabelValues("rejected").Add(float64(len(rejected)))
+		s.deadLetter(client, models.RejectedMessage{
+			Topic:   msg.Topic(),
+			BatchID: batch.BatchID,
+			Reasons: reasons,
+			Samples: rejected,
+		})
+	}
+	if batch.BatchID != "" {
+		// The batch is acknowledged even if all of its samples were rejected
+		message.received = &models.ReceivedBatch{BatchID: batch.BatchID, Topic: msg.Topic(), Samples: len(message.rows)}
+		message.replyTo = batch.ReplyTo
+	}
+
+	s.bufferLock.Lock()
+	s.buffer = append(s.buffer, message)
+	s.buffered += len(message.rows)
+	full := s.buffered >= s.batchSize
+	s.bufferLock.Unlock()
+	if full {
+		select {
+		case s.flush <- struct{}{}:
 		default:
-			// Attempt to subscribe
-			log.Infof("Attempting to subscribe to topic: %s", s.topic)
-			token := s.client.Subscribe(s.topic, 1, func(client mqtt.Client, msg mqtt.Message) {
-				// Unmarshal the message payload into RRDData
-				var vmData models.VMData
-				if err := json.Unmarshal(msg.Payload(), &vmData); err != nil {
-					log.Errorf("Failed to unmarshal MQTT message payload: %v", err)
-					return
-				}
+		}
+	}
+}
+
+// verify checks the signature of a message against the public key of its site.
+// Unsigned messages are accepted from sites without a key unless signatures
+// are required.
+func (s *MQTTSubscriber) verify(site *models.Site, payload []byte) error {
+	if site == nil || site.PublicKey == "" {
+		if s.requireSignature {
+			return fmt.Errorf("no public key is registered for the site")
+		}
+		return nil
+	}
+	return models.VerifyPayload(payload, site.PublicKey)
+}
 
-				// Save to data_raw table
-				dataRaw := models.DataRaw{
-					RRDData: models.RRDData{
-						Time:      vmData.Time,
-						MaxCPU:    vmData.MaxCPU,
-						MaxDisk:   vmData.MaxDisk,
-						MaxMem:    vmData.MaxMem,
-						Disk:      vmData.Disk,
-						CPU:       vmData.CPU,
-						Mem:       vmData.Mem,
-						NetOut:    vmData.NetOut,
-						NetIn:     vmData.NetIn,
-						DiskRead:  vmData.DiskRead,
-						DiskWrite: vmData.DiskWrite,
-					},
-					VMID:  vmData.VMID,
-					Topic: s.topic,
+// quarantine keeps a message that could not be verified for inspection, it is
+// acknowledged once saved
+func (s *MQTTSubscriber) quarantine(msg mqtt.Message, site *models.Site, batch models.DataBatch, reason error) {
+	quarantined := models.QuarantinedMessage{
+		Topic:   msg.Topic(),
+		BatchID: batch.BatchID,
+		Reason:  reason.Error(),
+		Payload: msg.Payload(),
+	}
+	if site != nil {
+		quarantined.SiteID = &site.ID
+	}
+	if err := s.db.Create(&quarantined).Error; err != nil {
+		// Not acknowledged, the broker sends it again on the next connection
+		taskLog(s).WithField("topic", msg.Topic()).Errorf("Failed to quarantine batch %s: %v", batch.BatchID, err)
+		return
+	}
+	telemetry.SubscriberSamples.WithLabelValues("quarantined").Add(float64(len(batch.Samples)))
+	msg.Ack()
+}
+
+// parseBatch parses the payload of a message as a models.DataBatch, or as a
+// single models.VMData
+func parseBatch(payload []byte) (models.DataBatch, error) {
+	var batch models.DataBatch
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return batch, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if batch.Samples == nil {
+		var vmData models.VMData
+		if err := json.Unmarshal(payload, &vmData); err != nil {
+			return batch, fmt.Errorf("invalid sample: %w", err)
+		}
+		batch.Samples = []models.VMData{vmData}
+	}
+	return batch, nil
+}
+
+// insertBuffer inserts the buffered samples in a single transaction, a sample
+// received again from the same source is only stored once. The messages are
+// then acknowledged to the broker, and the batches to their collector. The
+// buffer is kept for the next attempt when the insert fails, the broker holds
+// the messages not acknowledged yet.
+func (s *MQTTSubscriber) insertBuffer(client mqtt.Client) {
+	s.bufferLock.Lock()
+	buffer := s.buffer
+	s.bufferLock.Unlock()
+	if len(buffer) == 0 {
+		return
+	}
+
+	var rows []models.DataRaw
+	var stored, duplicates int64
+	start := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		rows, duplicates = rows[:0], 0
+		seen := map[uint]int{}
+		for _, message := range buffer {
+			if message.site != nil {
+				seen[message.site.ID] += len(message.rows)
+			}
+			if message.received != nil {
+				received := *message.received
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&received)
+				if result.Error != nil {
+					return result.Error
 				}
-				if err := s.db.Create(&dataRaw).Error; err != nil {
-					log.Errorf("Failed to save data to database: %v", err)
-				} else {
-					log.Infof("Data saved to database: %v", dataRaw)
+				if result.RowsAffected == 0 {
+					// Already stored, the collector missed the acknowledgement
+					duplicates += int64(len(message.rows))
+					continue
 				}
-			})
-
-			// Check if subscription was successful
-			if token.Wait() && token.Error() != nil {
-				log.Errorf("Failed to subscribe to topic: %v", token.Error())
-				log.Infof("Retrying in 10 seconds...")
-				time.Sleep(10 * time.Second) // Retry after 10 seconds
-				continue
 			}
+			rows = append(rows, message.rows...)
+		}
+		for siteID, samples := range seen {
+			if err := models.RecordSiteSamples(tx, siteID, samples, start); err != nil {
+				return err
+			}
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		var columns []clause.Column
+		for _, column := range models.DataRawDedupColumns {
+			columns = append(columns, clause.Column{Name: column, Raw: true})
+		}
+		result := tx.Clauses(clause.OnConflict{Columns: columns, DoNothing: true}).CreateInBatches(&rows, 1000)
+		stored = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		telemetry.BatchInsertFailures.Inc()
+		taskLog(s).Errorf("Failed to save %d messages to database: %v", len(buffer), err)
+		return
+	}
+	telemetry.ObserveDuration(telemetry.BatchInsertDuration, start)
+	telemetry.BatchInsertRows.Add(float64(stored))
+	telemetry.SubscriberSamples.WithLabelValues("stored").Add(float64(stored))
+	telemetry.SubscriberSamples.WithLabelValues("duplicate").Add(float64(duplicates + int64(len(rows)) - stored))
+	taskLog(s).Debugf("Saved %d samples of %d messages to database", stored, len(buffer))
 
-			log.Infof("Successfully subscribed to topic: %s", s.topic)
+	s.bufferLock.Lock()
+	// Messages may have been received during the insert
+	s.buffer = s.buffer[len(buffer):]
+	for _, message := range buffer {
+		s.buffered -= len(message.rows)
+	}
+	s.bufferLock.Unlock()
 
-			// Block until the context is canceled
-			<-ctx.Done()
-			log.Infof("MQTTSubscriber stopping...")
-			if token := s.client.Unsubscribe(s.topic); token.Wait() && token.Error() != nil {
-				log.Warnf("Failed to unsubscribe from topic: %v", token.Error())
-			}
-			s.client.Disconnect(250)
-			return
+	for _, message := range buffer {
+		message.msg.Ack()
+		if message.received != nil && message.replyTo != "" {
+			s.acknowledge(client, message.replyTo, models.BatchAck{BatchID: message.received.BatchID, Samples: message.received.Samples})
+		}
+	}
+}
+
+// resolveSite returns the site registered for the topic, or nil. The sites are
+// reloaded every minute, and on an unknown topic at most every 10 seconds so
+// a site registered since is picked up quickly. An error is only returned
+// when the topic is unknown and the sites could not be reloaded.
+func (s *MQTTSubscriber) resolveSite(topic string) (*models.Site, error) {
+	s.sitesLock.Lock()
+	defer s.sitesLock.Unlock()
+
+	age := time.Since(s.sitesLoadedAt)
+	site := models.ResolveSite(s.sites, topic)
+	if age < time.Minute && (site != nil || age < 10*time.Second) {
+		return site, nil
+	}
+	var sites []models.Site
+	if err := s.db.Order("id").Find(&sites).Error; err != nil {
+		if site != nil {
+			// The previous sites are kept, they are likely still valid
+			taskLog(s).Warnf("Failed to reload the sites: %v", err)
+			return site, nil
+		}
+		return nil, err
+	}
+	s.sites = sites
+	s.sitesLoadedAt = time.Now()
+	return models.ResolveSite(s.sites, topic), nil
+}
+
+// deadLetter publishes a rejected message on the dead letter topic, it is
+// dropped when no topic is configured
+func (s *MQTTSubscriber) deadLetter(client mqtt.Client, rejected models.RejectedMessage) {
+	s.lock.Lock()
+	topic := s.deadLetterTopic
+	s.lock.Unlock()
+	if topic == "" {
+		return
+	}
+	rejected.RejectedAt = time.Now().UTC()
+	payload, err := json.Marshal(rejected)
+	if err != nil {
+		taskLog(s).Errorf("Failed to marshal rejected message: %v", err)
+		return
+	}
+	token := client.Publish(topic, 1, false, payload)
+	// Waiting in the message handler would block the delivery of the next messages
+	go func() {
+		if !token.WaitTimeout(time.Minute) {
+			taskLog(s).WithField("topic", topic).Warn("Timed out publishing a rejected message")
+		} else if token.Error() != nil {
+			taskLog(s).WithField("topic", topic).Warnf("Failed to publish a rejected message: %v", token.Error())
 		}
+	}()
+}
+
+// acknowledge publishes the acknowledgement of a stored batch on the reply topic
+// of the collector
+func (s *MQTTSubscriber) acknowledge(client mqtt.Client, replyTo string, ack models.BatchAck) {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		taskLog(s).Errorf("Failed to marshal acknowledgement: %v", err)
+		return
 	}
+	token := client.Publish(replyTo, 1, false, payload)
+	// Waiting in the message handler would block the delivery of the next messages
+	go func() {
+		if !token.WaitTimeout(time.Minute) {
+			taskLog(s).WithField("topic", replyTo).Warnf("Timed out acknowledging batch %s", ack.BatchID)
+		} else if token.Error() != nil {
+			taskLog(s).WithField("topic", replyTo).Warnf("Failed to acknowledge batch %s: %v", ack.BatchID, token.Error())
+		}
+	}()
 }
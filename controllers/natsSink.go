@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"billingo/config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink publishes each batch on a NATS subject. Through JetStream the
+// delivery is confirmed by the stream and the batch ID is the message ID, so
+// the stream drops a batch sent again. Otherwise it is confirmed once the
+// server received it.
+type natsSink struct {
+	task     *DeliveryTask
+	settings config.SinkConfig
+	timeout  time.Duration
+	// lock guards the connection, replaced on every connection attempt
+	lock sync.Mutex
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+func newNATSSink(t *DeliveryTask, settings config.SinkConfig) *natsSink {
+	return &natsSink{
+		task:     t,
+		settings: settings,
+		timeout:  time.Duration(settings.TimeoutSeconds) * time.Second,
+	}
+}
+
+// Connect connects to the NATS server, the client reconnects on its own once connected
+func (n *natsSink) Connect(ctx context.Context) error {
+	options := []nats.Option{
+		nats.Name(fmt.Sprintf("billingo-%s-%s", hostname(), n.settings.Name)),
+		nats.Timeout(n.timeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				taskLog(n.task).Warnf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			taskLog(n.task).Infof("Reconnected to NATS %s", conn.ConnectedUrlRedacted())
+		}),
+	}
+	if n.settings.Token != "" {
+		// Read on every connection to pick up rotated tokens
+		options = append(options, nats.TokenHandler(func() string {
+			settings, _ := n.task.conf.Sink(n.settings.Name)
+			return settings.Token
+		}))
+	}
+	conn, err := nats.Connect(n.settings.URL, options...)
+	if err != nil {
+		return err
+	}
+
+	var js nats.JetStreamContext
+	if n.settings.JetStream {
+		if js, err = conn.JetStream(nats.MaxWait(n.timeout)); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.conn, n.js = conn, js
+	return nil
+}
+
+func (n *natsSink) current() (*nats.Conn, nats.JetStreamContext) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.conn, n.js
+}
+
+func (n *natsSink) Send(ctx context.Context, batch *SinkBatch) (bool, error) {
+	conn, js := n.current()
+	if conn == nil || !conn.IsConnected() {
+		return false, fmt.Errorf("not connected to NATS")
+	}
+	payload, err := json.Marshal(batch.Payload)
+	if err != nil {
+		return false, err
+	}
+
+	if js != nil {
+		ctx, cancel := context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+		_, err := js.Publish(batch.Route, payload, nats.MsgId(batch.Payload.BatchID), nats.Context(ctx))
+		return err == nil, err
+	}
+	if err := conn.Publish(batch.Route, payload); err != nil {
+		return false, err
+	}
+	// Returns once the server processed the message
+	if err := conn.FlushTimeout(n.timeout); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (n *natsSink) Close() {
+	conn, _ := n.current()
+	if conn != nil {
+		// Sends the messages still buffered
+		conn.Drain()
+	}
+}
+
+// Health reports whether the client is connected
+func (n *natsSink) Health() error {
+	conn, _ := n.current()
+	if conn == nil || !conn.IsConnected() {
+		return fmt.Errorf("not connected to NATS %s", n.settings.URL)
+	}
+	return nil
+}
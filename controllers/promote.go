@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/models"
+	"billingo/telemetry"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PromoteRawDataTask folds the samples received by the MQTT subscriber from
+// data_raw into data, where they are billed and delivered to the sinks like the
+// samples collected locally
+type PromoteRawDataTask struct {
+	name    string
+	conf    *config.Config
+	db      *gorm.DB
+	manager *Manager
+}
+
+func NewPromoteRawDataTask(name string, conf *config.Config) *PromoteRawDataTask {
+	return &PromoteRawDataTask{name: name, conf: conf}
+}
+
+func (t *PromoteRawDataTask) Setup(db *gorm.DB, manager *Manager) {
+	t.db = db
+	t.manager = manager
+}
+
+func (t *PromoteRawDataTask) Main(ctx context.Context) {
+	subscriber := t.conf.Snapshot().MQTT.Subscriber
+	interval := time.Duration(subscriber.PromoteIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// A backlog is promoted in several rounds of the batch size
+		t.manager.Heartbeat(t, interval+15*time.Minute)
+		t.promote(ctx, subscriber.PromoteBatchSize)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconfigure implements Reconfigurable, the promotion settings are only read
+// when the task starts
+func (t *PromoteRawDataTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, "mqtt.subscriber") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+// promote promotes the pending rows in batches until none is left
+func (t *PromoteRawDataTask) promote(ctx context.Context, batchSize int) {
+	total := 0
+	for ctx.Err() == nil {
+		promoted, err := models.PromoteRawData(t.db, batchSize, t.conf.SinkNames())
+		if err != nil {
+			taskLog(t).Errorf("Failed to promote raw data: %v", err)
+			break
+		}
+		telemetry.PromotedRows.Add(float64(promoted))
+		total += promoted
+		if promoted < batchSize {
+			break
+		}
+	}
+	if total > 0 {
+		taskLog(t).Debugf("Promoted %d samples into data", total)
+	}
+}
+
+func (t *PromoteRawDataTask) String() string {
+	return t.name
+}
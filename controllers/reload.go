@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/logging"
+	"billingo/models"
+)
+
+// ReloadConfig reloads the configuration and applies it to the loggers, the
+// database policies and the tasks depending on the changed settings. It
+// returns the changed settings and, among them, the ones only applied on
+// restart. An invalid configuration is rejected and the current one is kept.
+func (m *Manager) ReloadConfig(conf *config.Config) (changed []string, pending []string, err error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	changed, err = conf.Reload()
+	if err != nil {
+		log.Errorf("Configuration not reloaded:\n%v", err)
+		return nil, nil, err
+	}
+	if len(changed) == 0 {
+		log.Info("Configuration reloaded, nothing changed")
+		return changed, nil, nil
+	}
+	log.WithField("changed", changed).Info("Configuration reloaded")
+
+	// Secrets may have changed as well, always configure the loggers again
+	if err := logging.Setup(conf.LoggingOptions()); err != nil {
+		log.Warnf("Invalid log configuration: %v", err)
+	}
+	if config.Changed(changed, "database.compression_interval_days", "database.retention_days") {
+		if err := models.ApplyPolicies(m.db, conf.Snapshot().Database); err != nil {
+			log.Errorf("Error applying the compression and retention settings: %v", err)
+		}
+	}
+	m.NotifyConfigChanged(changed)
+
+	pending = config.RequiresRestart(changed)
+	if len(pending) > 0 {
+		log.WithField("settings", pending).Warn("Some settings are only applied on restart")
+	}
+	return changed, pending, nil
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"billingo/config"
+	"billingo/logging"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SecretsRefreshTask resolves the secret references of the configuration
+// periodically, so credentials rotated in their file, environment or keystore
+// are picked up without a restart
+type SecretsRefreshTask struct {
+	name    string
+	conf    *config.Config
+	manager *Manager
+}
+
+func NewSecretsRefreshTask(name string, conf *config.Config) *SecretsRefreshTask {
+	return &SecretsRefreshTask{name: name, conf: conf}
+}
+
+func (t *SecretsRefreshTask) Setup(db *gorm.DB, manager *Manager) {
+	t.manager = manager
+}
+
+func (t *SecretsRefreshTask) Main(ctx context.Context) {
+	interval := time.Duration(t.conf.Snapshot().Secrets.RefreshIntervalSeconds) * time.Second
+	refresh := interval > 0
+	if !refresh {
+		// Disabled, keep beating until a reload enables it again
+		taskLog(t).Info("Secrets are not re-read, refresh_interval_seconds is 0")
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	t.manager.Heartbeat(t, 2*interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.manager.Heartbeat(t, 2*interval)
+			if refresh {
+				t.refresh()
+			}
+		}
+	}
+}
+
+// Reconfigure implements Reconfigurable, the interval is only read when the
+// task starts
+func (t *SecretsRefreshTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, "secrets.refresh_interval_seconds") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+func (t *SecretsRefreshTask) refresh() {
+	changed, err := t.conf.RefreshSecrets()
+	if err != nil {
+		// The previous values are kept, they may still be valid
+		taskLog(t).Errorf("Error re-reading secrets: %v", err)
+	}
+	if len(changed) > 0 {
+		logging.SetSecrets(t.conf.SecretValues())
+		taskLog(t).WithField("secrets", changed).Info("Secrets changed")
+	}
+}
+
+func (t *SecretsRefreshTask) String() string {
+	return t.name
+}
@@ -1,78 +1,141 @@
 package controllers
 
 import (
+	"billingo/logging"
 	"billingo/models"
+	"billingo/telemetry"
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
+var log = logging.For("controllers")
+
+// taskLog returns the logger of a task
+func taskLog(task Task) *logrus.Entry {
+	return log.WithField("task", task.String())
+}
+
 type Task interface {
 	Setup(db *gorm.DB, manager *Manager)
 	Main(ctx context.Context)
 	String() string
 }
 
+// HealthChecker is implemented by tasks able to report the state of the
+// dependencies they rely on, such as a broker connection or a file.
+type HealthChecker interface {
+	Health() error
+}
+
+// ErrRestartRequired is returned by Reconfigure when the task must be
+// restarted to apply the new configuration
+var ErrRestartRequired = errors.New("restart required")
+
+// Reconfigurable is implemented by tasks depending on settings that can be
+// reloaded. Reconfigure is called with the settings that changed, the task
+// either applies them while running or returns ErrRestartRequired.
+type Reconfigurable interface {
+	Reconfigure(changed []string) error
+}
+
+// CommandSender is implemented by the tasks able to send commands to the
+// collector of an edge site
+type CommandSender interface {
+	SendCommand(site models.Site, command *models.Command) error
+}
+
+// ErrNoCommandSender is returned by SendCommand when no task can send commands
+var ErrNoCommandSender = errors.New("no task sends commands, the MQTT subscriber is disabled")
+
+// TaskHealth is the liveness and health of a registered task
+type TaskHealth struct {
+	Name          string    `json:"name"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Alive         bool      `json:"alive"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// startupGrace is the time a task has to send its first heartbeat
+const startupGrace = 5 * time.Minute
+
+// stopTimeout is the time a task has to return once asked to stop for a restart
+const stopTimeout = time.Minute
+
+// taskRun stops a running task and tells when it returned
+type taskRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type heartbeat struct {
+	last     time.Time
+	deadline time.Time
+}
+
 type Manager struct {
-	vmRRDData  map[int]models.RRDData
+	vmRRDData  map[models.VMKey]models.RRDData
+	vmInfo     map[models.VMKey]models.VMInfo
 	db         *gorm.DB
 	lock       sync.RWMutex
 	ctx        context.Context
 	cancel     context.CancelFunc
 	tasks      []Task
 	changeChan chan models.VMData
+	beatsLock  sync.Mutex
+	heartbeats map[string]heartbeat
+	runsLock   sync.Mutex
+	runs       map[Task]taskRun
+	reloadLock sync.Mutex
 }
 
 func NewManager(ctx context.Context, db *gorm.DB) *Manager {
 	cCtx, cancel := context.WithCancel(ctx)
 	manager := &Manager{
-		vmRRDData:  make(map[int]models.RRDData),
+		vmRRDData:  make(map[models.VMKey]models.RRDData),
+		vmInfo:     make(map[models.VMKey]models.VMInfo),
 		db:         db,
 		ctx:        cCtx,
 		cancel:     cancel,
 		tasks:      []Task{},
 		changeChan: make(chan models.VMData, 300),
+		heartbeats: make(map[string]heartbeat),
+		runs:       make(map[Task]taskRun),
 	}
 
+	telemetry.WatchChangeQueue(func() int { return len(manager.changeChan) }, cap(manager.changeChan))
 	manager.LoadLatestMetrics()
 	return manager
 }
 
-// LoadLatestMetrics retrieves the latest metric for each distinct VM, ordering by time descending and limiting to 1 record per VM.
+// LoadLatestMetrics retrieves the latest metric for each distinct VM of each cluster, ordering by time descending and limiting to 1 record per VM.
 func (m *Manager) LoadLatestMetrics() {
 	var data []models.Data
 
 	// Query the latest RRDData for each distinct VM
 	err := m.db.
 		Model(&models.Data{}).
-		Select("vmid, max(time) as time").
-		Group("vmid").
-		Order("time desc").
+		Select("DISTINCT ON (cluster, vm_id) *").
+		Order("cluster, vm_id, time desc").
 		Find(&data).Error
 
 	if err != nil {
-		fmt.Printf("Error fetching latest metrics: %v\n", err)
+		log.Errorf("Error fetching latest metrics: %v", err)
 		return
 	}
 
 	// Populate the vmRRDData map with the latest data for each VM
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	for _, d := range data {
-		var latest models.RRDData
-		err := m.db.Where("vmid = ? AND time = ?", d.VMID, d.Time).First(&latest).Error
-		if err != nil {
-			fmt.Printf("Error fetching latest RRDData for VMID %d: %v\n", d.VMID, err)
-			continue
-		}
-
-		// Lock the map and set the latest RRDData for each VMID
-		m.lock.Lock()
-		m.vmRRDData[d.VMID] = latest
-		m.lock.Unlock()
-
-		fmt.Printf("Loaded latest RRDData for VMID %d: %+v\n", d.VMID, latest)
+		m.vmRRDData[models.VMKey{Cluster: d.Cluster, VMID: d.VMID}] = d.RRDData
 	}
+	log.Infof("Loaded latest RRDData for %d VMs", len(data))
 }
 
 // AddTask registers a new task with the Manager.
@@ -80,53 +143,174 @@ func (m *Manager) AddTask(task Task) {
 	m.tasks = append(m.tasks, task)
 }
 
+// SendCommand sends a command to the collector of an edge site through the
+// first task able to
+func (m *Manager) SendCommand(site models.Site, command *models.Command) error {
+	for _, task := range m.tasks {
+		if sender, ok := task.(CommandSender); ok {
+			return sender.SendCommand(site, command)
+		}
+	}
+	return ErrNoCommandSender
+}
+
 // StartAll starts all periodic tasks managed by the Manager.
 func (m *Manager) StartAll() {
+	m.runsLock.Lock()
+	defer m.runsLock.Unlock()
 	for _, task := range m.tasks {
-		task.Setup(m.db, m)
-		go task.Main(m.ctx)
+		m.start(task)
 	}
 }
 
+// start sets up and runs the task with its own context, the runs lock must be held
+func (m *Manager) start(task Task) {
+	m.Heartbeat(task, startupGrace)
+	task.Setup(m.db, m)
+	ctx, cancel := context.WithCancel(m.ctx)
+	run := taskRun{cancel: cancel, done: make(chan struct{})}
+	m.runs[task] = run
+	go func() {
+		defer close(run.done)
+		task.Main(ctx)
+	}()
+}
+
+// Restart stops the task, waiting for it to return, and starts it again
+func (m *Manager) Restart(task Task) error {
+	m.runsLock.Lock()
+	defer m.runsLock.Unlock()
+
+	if run, exists := m.runs[task]; exists {
+		run.cancel()
+		select {
+		case <-run.done:
+		case <-time.After(stopTimeout):
+			// Starting it anyway could run two instances of the task
+			return fmt.Errorf("task %s did not stop within %v", task, stopTimeout)
+		}
+	}
+	m.start(task)
+	return nil
+}
+
+// NotifyConfigChanged hands the changed settings to the tasks implementing
+// Reconfigurable, restarting those that cannot apply them while running
+func (m *Manager) NotifyConfigChanged(changed []string) {
+	for _, task := range m.tasks {
+		reconfigurable, ok := task.(Reconfigurable)
+		if !ok {
+			continue
+		}
+		err := reconfigurable.Reconfigure(changed)
+		switch {
+		case errors.Is(err, ErrRestartRequired):
+			taskLog(task).Info("Restarting task to apply the new configuration")
+			if err := m.Restart(task); err != nil {
+				taskLog(task).Errorf("Error restarting task: %v", err)
+			}
+		case err != nil:
+			taskLog(task).Errorf("Error applying the new configuration: %v", err)
+		}
+	}
+}
+
+// Heartbeat records that the task is making progress. The task is considered
+// stuck if it does not beat again within the given duration.
+func (m *Manager) Heartbeat(task Task, within time.Duration) {
+	m.beatsLock.Lock()
+	defer m.beatsLock.Unlock()
+	now := time.Now()
+	m.heartbeats[task.String()] = heartbeat{last: now, deadline: now.Add(within)}
+}
+
+// TasksHealth reports the liveness of every task, and the health of the tasks
+// implementing HealthChecker.
+func (m *Manager) TasksHealth() []TaskHealth {
+	now := time.Now()
+	health := make([]TaskHealth, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		m.beatsLock.Lock()
+		beat := m.heartbeats[task.String()]
+		m.beatsLock.Unlock()
+
+		status := TaskHealth{
+			Name:          task.String(),
+			LastHeartbeat: beat.last,
+			Alive:         now.Before(beat.deadline),
+		}
+		if !status.Alive {
+			status.Error = fmt.Sprintf("no heartbeat since %s", beat.last.Format(time.RFC3339))
+		} else if checker, ok := task.(HealthChecker); ok {
+			if err := checker.Health(); err != nil {
+				status.Error = err.Error()
+			}
+		}
+		health = append(health, status)
+	}
+	return health
+}
+
 // StopAll stops all periodic tasks.
 func (m *Manager) StopAll() {
 	m.cancel()
 }
 
-// GetMetric retrieves the metric for a given VM ID.
-func (m *Manager) GetMetric(vmID int) (models.RRDData, bool) {
+// GetMetric retrieves the metric for a given VM.
+func (m *Manager) GetMetric(key models.VMKey) (models.RRDData, bool) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	value, exists := m.vmRRDData[vmID]
+	value, exists := m.vmRRDData[key]
 	return value, exists
 }
 
-// SetMetric updates the metric for a given VM ID and triggers state change actions if needed.
-func (m *Manager) SetMetric(vmID int, value models.RRDData) {
+// SetMetric updates the metric for a given VM and triggers state change actions if needed.
+func (m *Manager) SetMetric(key models.VMKey, value models.RRDData) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	oldValue, exists := m.vmRRDData[vmID]
+	oldValue, exists := m.vmRRDData[key]
 	if !exists || oldValue.Time < value.Time {
-		m.vmRRDData[vmID] = value
-		// fmt.Printf("State %d has changed\n", vmID)
+		m.vmRRDData[key] = value
 		data := models.VMData{
 			RRDData: value,
-			VMID:    vmID,
+			VMID:    key.VMID,
+			Cluster: key.Cluster,
+			Node:    m.vmInfo[key].Node,
 		}
 		// Notify the observer with the updated data
 		select {
 		case m.changeChan <- data: // Send models.VMData to the channel
 		default:
+			telemetry.ChangeDrops.Inc()
 		}
 	} else {
-		fmt.Println(oldValue.Time, "", value.Time)
+		log.WithField("vmid", key.VMID).WithField("cluster", key.Cluster).Debugf("Ignoring sample at %d, latest is at %d", value.Time, oldValue.Time)
 	}
 }
 
-// GetAllVMData retrieves all vmRRDData stored in the manager.
-func (m *Manager) GetAllVMData() map[int]models.RRDData {
+// SetVMInfo records where a VM runs
+func (m *Manager) SetVMInfo(info models.VMInfo) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.vmInfo[info.Key()] = info
+}
+
+// GetVMInfo retrieves where a VM runs, if the collector has seen it
+func (m *Manager) GetVMInfo(key models.VMKey) (models.VMInfo, bool) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return m.vmRRDData
+	info, exists := m.vmInfo[key]
+	return info, exists
+}
+
+// GetAllVMData retrieves a copy of all vmRRDData stored in the manager.
+func (m *Manager) GetAllVMData() map[models.VMKey]models.RRDData {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	vmData := make(map[models.VMKey]models.RRDData, len(m.vmRRDData))
+	for key, data := range m.vmRRDData {
+		vmData[key] = data
+	}
+	return vmData
 }
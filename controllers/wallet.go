@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"billingo/billing"
+	"billingo/config"
+	"billingo/models"
+	"billingo/telemetry"
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WalletDebitTask debits the usage of the prepaid customers from their wallet
+// as it is collected
+type WalletDebitTask struct {
+	name    string
+	conf    *config.Config
+	db      *gorm.DB
+	manager *Manager
+}
+
+func NewWalletDebitTask(name string, conf *config.Config) *WalletDebitTask {
+	return &WalletDebitTask{name: name, conf: conf}
+}
+
+func (t *WalletDebitTask) Setup(db *gorm.DB, manager *Manager) {
+	t.db = db
+	t.manager = manager
+}
+
+func (t *WalletDebitTask) Main(ctx context.Context) {
+	interval := time.Duration(t.conf.Snapshot().Billing.WalletDebitIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		t.manager.Heartbeat(t, interval+15*time.Minute)
+		t.debit(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconfigure implements Reconfigurable, the interval is only read when the
+// task starts while the plans and the credit limit are read at each debit
+func (t *WalletDebitTask) Reconfigure(changed []string) error {
+	if config.Changed(changed, "billing.wallet_debit_interval_seconds") {
+		return ErrRestartRequired
+	}
+	return nil
+}
+
+// debit debits the usage of every prepaid customer, a customer failing to be
+// rated does not hold back the others
+func (t *WalletDebitTask) debit(ctx context.Context) {
+	var customers []uint
+	if err := t.db.Model(&models.Customer{}).Where("prepaid").Order("id").Pluck("id", &customers).Error; err != nil {
+		taskLog(t).Errorf("Failed to list the prepaid customers: %v", err)
+		return
+	}
+	if len(customers) == 0 {
+		telemetry.WalletsBelowLimit.Set(0)
+		return
+	}
+
+	settings := t.conf.Snapshot().Billing
+	plans, err := billing.LoadPlans(settings.PricePlansPath)
+	if err != nil {
+		taskLog(t).Errorf("Failed to load the price plans: %v", err)
+		return
+	}
+	settle := time.Duration(settings.WalletSettleHours) * time.Hour
+	now := time.Now()
+	belowLimit := 0
+	for _, customerID := range customers {
+		if ctx.Err() != nil {
+			return
+		}
+		posted, err := billing.DebitUsage(t.db, plans, settings.DefaultPlan, customerID, settle, now)
+		if err != nil {
+			taskLog(t).WithField("customer", customerID).Errorf("Failed to debit the usage: %v", err)
+			continue
+		}
+		telemetry.WalletDebits.Add(float64(len(posted)))
+
+		status, err := billing.GetWalletStatus(t.db, customerID, settings.WalletCreditLimit)
+		if err != nil {
+			taskLog(t).WithField("customer", customerID).Errorf("Failed to read the wallet balance: %v", err)
+			continue
+		}
+		if status.BelowLimit {
+			belowLimit++
+			if len(posted) > 0 {
+				taskLog(t).WithField("customer", customerID).Warnf("Wallet balance %.2f is below the credit limit of %.2f", status.Balance, status.CreditLimit)
+			}
+		}
+	}
+	telemetry.WalletsBelowLimit.Set(float64(belowLimit))
+}
+
+func (t *WalletDebitTask) String() string {
+	return t.name
+}
@@ -8,19 +8,48 @@ import (
 )
 
 type DataFilter struct {
-	VMIDs           []uint     `form:"vmids" json:"vmids"`
+	VMIDs           []int      `form:"vmids" json:"vmids"`
 	InitialDatetime *time.Time `form:"initial_datetime" json:"initial_datetime"`
 	FinalDatetime   *time.Time `form:"final_datetime" json:"final_datetime"`
 }
 
-func (filter *DataFilter) Filter(query *gorm.DB, VMIDs *uint) *gorm.DB {
+func (filter *DataFilter) Filter(query *gorm.DB) *gorm.DB {
 	if len(filter.VMIDs) > 0 {
-		query = query.Model(models.Data{}).Where("vm_id IN ?", []int{int(*VMIDs)}).Order("time DESC")
+		query = query.Where("vm_id IN ?", filter.VMIDs)
 	}
-	var emptytimedate *time.Time
-
-	if (filter.InitialDatetime != emptytimedate) && (filter.FinalDatetime != emptytimedate) {
-		query = query.Where("(start_time <= ? and finish_time >= ?) OR (start_time >= ? and start_time <= ?) OR (start_time <= ? and finish_time IS NULL) OR (start_time >= ? and finish_time >= ? and start_time <= ?) OR (start_time <= ? and finish_time <= ? and finish_time >= ?) ", filter.InitialDatetime, filter.FinalDatetime, filter.InitialDatetime, filter.FinalDatetime, filter.InitialDatetime, filter.InitialDatetime, filter.FinalDatetime, filter.FinalDatetime, filter.InitialDatetime, filter.FinalDatetime, filter.InitialDatetime)
+	// Samples store the time as a unix timestamp
+	if filter.InitialDatetime != nil {
+		query = query.Where("time >= ?", filter.InitialDatetime.Unix())
+	}
+	if filter.FinalDatetime != nil {
+		query = query.Where("time <= ?", filter.FinalDatetime.Unix())
 	}
 	return query
 }
+
+// TenantScope restricts the query to the samples taken while the VMs were owned
+// by the tenant, on the site and cluster of each ownership. Without ownerships
+// nothing is returned.
+func TenantScope(query *gorm.DB, ownerships []models.VMOwnership) *gorm.DB {
+	if len(ownerships) == 0 {
+		return query.Where("1 = 0")
+	}
+	scope := query.Session(&gorm.Session{NewDB: true})
+	for i, ownership := range ownerships {
+		window := query.Session(&gorm.Session{NewDB: true}).
+			Where("vm_id = ? AND time >= ?", ownership.VMID, ownership.StartTime.Unix())
+		window = models.SiteScope(window, ownership.SiteID)
+		if ownership.Cluster != "" {
+			window = window.Where("cluster = ?", ownership.Cluster)
+		}
+		if ownership.EndTime != nil {
+			window = window.Where("time < ?", ownership.EndTime.Unix())
+		}
+		if i == 0 {
+			scope = scope.Where(window)
+		} else {
+			scope = scope.Or(window)
+		}
+	}
+	return query.Where(scope)
+}
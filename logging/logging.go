@@ -0,0 +1,190 @@
+// Package logging configures the structured logger shared by every subsystem
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Options configures the loggers
+type Options struct {
+	// Level is the default level of every subsystem
+	Level string
+	// Format is either "text" or "json"
+	Format string
+	// Levels overrides the level per subsystem, as in "proxmox=debug,database=warn"
+	Levels string
+	// Secrets are redacted from every message and field
+	Secrets []string
+}
+
+var (
+	lock         sync.Mutex
+	loggers      = map[string]*logrus.Logger{}
+	levels       = map[string]logrus.Level{}
+	defaultLevel = logrus.InfoLevel
+	formatter    = &redactor{inner: &logrus.TextFormatter{DisableQuote: true}}
+)
+
+// For returns the logger of a subsystem. It can be called before Setup, the
+// logger picks up the configuration once it is applied.
+func For(subsystem string) *logrus.Entry {
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger, exists := loggers[subsystem]
+	if !exists {
+		logger = logrus.New()
+		logger.SetOutput(os.Stdout)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(levelOf(subsystem))
+		loggers[subsystem] = logger
+	}
+	return logger.WithField("subsystem", subsystem)
+}
+
+// Setup applies the options to every logger, it may be called again to
+// change the configuration at runtime.
+func Setup(opts Options) error {
+	var errs []error
+	level, err := parseLevel(opts.Level)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	overrides := map[string]logrus.Level{}
+	for _, pair := range strings.Split(opts.Levels, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		subsystem, value, found := strings.Cut(pair, "=")
+		if !found {
+			errs = append(errs, fmt.Errorf("invalid log level override %q, expected subsystem=level", pair))
+			continue
+		}
+		subsystemLevel, err := parseLevel(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		overrides[strings.TrimSpace(subsystem)] = subsystemLevel
+	}
+
+	var inner logrus.Formatter
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		inner = &logrus.TextFormatter{DisableQuote: true}
+	case "json":
+		inner = &logrus.JSONFormatter{}
+	default:
+		errs = append(errs, fmt.Errorf("invalid log format %q, expected text or json", opts.Format))
+		inner = &logrus.TextFormatter{DisableQuote: true}
+	}
+	formatter.configure(inner, opts.Secrets)
+
+	lock.Lock()
+	defer lock.Unlock()
+	defaultLevel = level
+	levels = overrides
+	for subsystem, logger := range loggers {
+		logger.SetLevel(levelOf(subsystem))
+	}
+	return errors.Join(errs...)
+}
+
+// levelOf returns the configured level of a subsystem, the lock must be held
+func levelOf(subsystem string) logrus.Level {
+	if level, exists := levels[subsystem]; exists {
+		return level
+	}
+	return defaultLevel
+}
+
+func parseLevel(value string) (logrus.Level, error) {
+	if strings.TrimSpace(value) == "" {
+		return logrus.InfoLevel, nil
+	}
+	level, err := logrus.ParseLevel(strings.TrimSpace(value))
+	if err != nil {
+		return logrus.InfoLevel, fmt.Errorf("invalid log level %q", value)
+	}
+	return level, nil
+}
+
+// secretPatterns catch credentials that are not known in advance, such as
+// the ones in connection strings or authorization headers
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:password|passwd|pwd|secret|token|api_key)\s*[=:]\s*)("[^"]*"|[^\s,;&"]+)`),
+	regexp.MustCompile(`(?i)(bearer\s+)([^\s,;"]+)`),
+}
+
+const redacted = "****"
+
+// redactor removes secrets from the message and fields of the entries before
+// handing them to the actual formatter
+type redactor struct {
+	lock    sync.RWMutex
+	inner   logrus.Formatter
+	secrets []string
+}
+
+// SetSecrets replaces the secrets redacted from the logs, as when they are rotated
+func SetSecrets(secrets []string) {
+	formatter.setSecrets(secrets)
+}
+
+func (r *redactor) configure(inner logrus.Formatter, secrets []string) {
+	r.lock.Lock()
+	r.inner = inner
+	r.lock.Unlock()
+	r.setSecrets(secrets)
+}
+
+func (r *redactor) setSecrets(secrets []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.secrets = nil
+	for _, secret := range secrets {
+		// Very short values would redact unrelated text
+		if len(secret) >= 4 {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+func (r *redactor) Format(entry *logrus.Entry) ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	clean := *entry
+	clean.Message = r.redact(entry.Message)
+	clean.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			clean.Data[key] = r.redact(v)
+		case error:
+			clean.Data[key] = r.redact(v.Error())
+		default:
+			clean.Data[key] = value
+		}
+	}
+	return r.inner.Format(&clean)
+}
+
+func (r *redactor) redact(text string) string {
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redacted)
+	}
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redacted)
+	}
+	return text
+}
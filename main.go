@@ -8,39 +8,36 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 
+	"billingo/auth"
 	"billingo/config"
 	"billingo/controllers"
+	"billingo/logging"
 	"billingo/models"
 	"billingo/routers"
+	"billingo/telemetry"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// setupLog configures log output level with "INFO" as default
+var log = logging.For("main")
+
+// setupLog configures the loggers of every subsystem with "INFO" as default
 func setupLog(conf *config.Config) {
 	executable, _ := os.Executable()
 	executable = filepath.FromSlash(executable)
 	directory := filepath.Dir(executable)
-	log.SetFormatter(&log.TextFormatter{
-		DisableQuote: true,
-	})
-	logLevel := strings.ToUpper(conf.LogLevel)
-	if logLevel == "DEBUG" {
-		log.SetLevel(log.DebugLevel)
-
-	} else if logLevel == "ERROR" {
-		log.SetLevel(log.ErrorLevel)
-
-	} else {
-		log.SetLevel(log.InfoLevel)
+	if err := logging.Setup(conf.LoggingOptions()); err != nil {
+		log.Warnf("Invalid log configuration: %v", err)
 	}
 
 	log.Infof("Executable: %v", executable)
 	log.Infof("Dir: %v", directory)
-	log.Infof("Log Level: %v", log.GetLevel())
+	log.Infof("Log Level: %v", conf.LogLevel)
 
 }
 
@@ -52,20 +49,29 @@ func run(conf *config.Config) {
 	log.Infof("Platform: %v", runtime.GOOS)
 
 	// Create router
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery(), routers.RequestLogger)
 	db := models.SetupModels(conf)
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	// Configure CORS middleware
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PATCH", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-	}))
+	// Configure CORS middleware. Credentials are only allowed for explicit origins,
+	// clients authenticate with a bearer token anyway.
+	corsConfig := cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PATCH", "DELETE"},
+		AllowHeaders:  []string{"Origin", "Authorization", "Content-Type"},
+		ExposeHeaders: []string{"Content-Length"},
+	}
+	if conf.CorsAllowedOrigins == "*" {
+		corsConfig.AllowAllOrigins = true
+	} else if conf.CorsAllowedOrigins != "" {
+		corsConfig.AllowOrigins = strings.Split(conf.CorsAllowedOrigins, ",")
+		corsConfig.AllowCredentials = true
+	}
+	if corsConfig.AllowAllOrigins || len(corsConfig.AllowOrigins) > 0 {
+		r.Use(cors.New(corsConfig))
+	}
 
 	// sqlDB, err := db.DB()
 	// if err != nil {
@@ -74,42 +80,96 @@ func run(conf *config.Config) {
 	manager := controllers.NewManager(ctx, db)
 
 	// Register tasks
-	manager.AddTask(controllers.NewMetrics("MetricsTask"))
-	manager.AddTask(controllers.NewObserverBuffer("ObserverBufferTask"))
-	manager.AddTask(controllers.NewBatchSaveToDatabaseTask("BatchSaveToDatabaseTask", "ObserverBufferTask", 3000))
-	// manager.AddTask(controllers.NewMQTTPublisherTask("MQTTPublisherTask", "mqtt://public.mqtt.pro:1883", "12345qwert54321", "ajbkvbp/device-test", "wNmDtwPghSTaBmJJ"))
-	manager.AddTask(controllers.NewMQTTPublisherTask("MQTTPublisherTask", "mqtt://localhost:1883", "12345qwert54321", "ajbkvbp/device-test", "wNmDtwPghSTaBmJJ"))
-	manager.AddTask(controllers.NewMQTTSubscriber("mqtt://localhost:1883", "12345qwert54321"))
+	tasks := conf.Tasks
+	if tasks.CollectorEnabled {
+		manager.AddTask(controllers.NewMetrics("MetricsTask", conf))
+		manager.AddTask(controllers.NewObserverBuffer("ObserverBufferTask", tasks.BufferPath))
+		manager.AddTask(controllers.NewBatchSaveToDatabaseTask("BatchSaveToDatabaseTask", tasks.BufferPath, conf))
+	}
+	if conf.MQTT.Publisher.Enabled {
+		manager.AddTask(controllers.NewMQTTPublisherTask("MQTTPublisherTask", conf))
+	}
+	for _, sink := range conf.Sinks {
+		manager.AddTask(controllers.NewSinkTask("SinkTask:"+sink.Name, sink.Name, conf))
+	}
+	if conf.MQTT.Subscriber.Enabled {
+		manager.AddTask(controllers.NewMQTTSubscriber("MQTTSubscriberTask", conf))
+		manager.AddTask(controllers.NewPromoteRawDataTask("PromoteRawDataTask", conf))
+	}
+	manager.AddTask(controllers.NewSecretsRefreshTask("SecretsRefreshTask", conf))
+	manager.AddTask(controllers.NewWalletDebitTask("WalletDebitTask", conf))
 
 	// manager.AddTask(controllers.NewDatabaseSaverTask("ObserverBufferTask"))
 
-	// Provide db and manager to context
+	// Internal metrics, collected for every route
+	r.Use(telemetry.Middleware)
+	r.GET("/metrics", gin.WrapH(telemetry.Handler()))
+
+	// Provide db, manager and config to context
 	r.Use(func(c *gin.Context) {
 		c.Set("db", db)
 		c.Set("manager", manager)
+		c.Set("config", conf)
 		c.Next()
 	})
 
+	// Latest usage of each VM, kept apart from the internal metrics. It names
+	// the customers, so unlike /metrics it requires authentication.
+	vmRegistry := prometheus.NewRegistry()
+	vmRegistry.MustRegister(controllers.NewVMUsageCollector(manager, db))
+	r.GET("/metrics/vms", routers.MetricsAuthentication, routers.RequireScope(auth.ScopeReadMetrics), gin.WrapH(promhttp.HandlerFor(vmRegistry, promhttp.HandlerOpts{})))
+
+	// Authentication and access control of the broker clients, the sites
+	// authenticate with the password generated for them
+	broker := r.Group("/broker", routers.BrokerAuthentication)
+	broker.POST("/user", routers.BrokerUser)
+	broker.POST("/superuser", routers.BrokerSuperuser)
+	broker.POST("/acl", routers.BrokerACL)
+
+	// Probes for the orchestrator
+	r.GET("/healthz", routers.Healthz)
+	r.GET("/readyz", routers.Readyz)
+
 	// Endpoints configuration
 	// r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-	// r.POST("/api/v1/auth/token", routers.Generate)
-	api := r.Group("/api/v1") //.Use(routers.Authentication).Use(limit.MaxAllowed(30))
+	r.POST("/api/v1/auth/token", routers.Generate)
+	api := r.Group("/api/v1").Use(routers.Authentication) //.Use(limit.MaxAllowed(30))
 	{
 		routers.GetEndpoints(api)
 	}
 
+	address := fmt.Sprintf(":%v", conf.GinPort)
 	go func() {
-		if err := r.Run(fmt.Sprintf(":%v", conf.GinPort)); err != nil {
+		if err := r.Run(address); err != nil {
 			log.Fatal(err)
 		}
 	}()
 
 	manager.StartAll()
-	<-c
+
+	// Reload the configuration on SIGHUP until stopped
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for running := true; running; {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading configuration")
+			manager.ReloadConfig(conf)
+		case <-c:
+			running = false
+		}
+	}
 	manager.StopAll()
 	cancel()
 }
 func main() {
-	conf := config.LoadConfig()
+	conf, err := config.LoadConfig()
+	if len(os.Args) > 1 {
+		runCommand(conf, err, os.Args[1], os.Args[2:])
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 	run(conf)
 }
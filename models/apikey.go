@@ -0,0 +1,38 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// APIKey is a credential that can be exchanged for an access token.
+// Only the hash of the key is stored, the plain key is shown once on creation.
+type APIKey struct {
+	BaseModel
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix" gorm:"uniqueIndex"`
+	Hash        string     `json:"-"`
+	Scopes      string     `json:"scopes"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	RotatedToID *uint      `json:"rotated_to_id"`
+	// CustomerID restricts the key to the VMs owned by the customer
+	CustomerID *uint `json:"customer_id" gorm:"index"`
+}
+
+// ScopeList returns the scopes granted to the key.
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// IsActive reports whether the key is neither revoked nor expired at the given time.
+func (k *APIKey) IsActive(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
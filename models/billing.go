@@ -0,0 +1,160 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Statuses of an invoice
+const (
+	InvoiceIssued = "issued"
+	// InvoiceSuperseded is an invoice replaced after its period was re-rated
+	InvoiceSuperseded = "superseded"
+)
+
+// Statuses of a re-rating
+const (
+	ReratingPending   = "pending"
+	ReratingApplied   = "applied"
+	ReratingDiscarded = "discarded"
+)
+
+// Invoice bills the rated usage of a customer over a period. LedgerHead is the
+// hash of the last ledger entry it was computed from.
+type Invoice struct {
+	BaseModel
+	CustomerID  uint      `json:"customer_id" gorm:"index;not null"`
+	PeriodStart time.Time `json:"period_start" gorm:"not null"`
+	PeriodEnd   time.Time `json:"period_end" gorm:"not null"`
+	Plan        string    `json:"plan"`
+	Currency    string    `json:"currency"`
+	Total       float64   `json:"total"`
+	Status      string    `json:"status"`
+	LedgerHead  string    `json:"ledger_head"`
+	// ReplacesID is the invoice superseded by this one
+	ReplacesID *uint         `json:"replaces_id"`
+	Lines      []InvoiceLine `json:"lines,omitempty"`
+}
+
+// InvoiceLine is the amount of a metric of a VM on an invoice
+type InvoiceLine struct {
+	ID          uint    `json:"id" gorm:"primary_key"`
+	InvoiceID   uint    `json:"invoice_id" gorm:"index;not null"`
+	SiteID      *uint   `json:"site_id,omitempty"`
+	Cluster     string  `json:"cluster,omitempty"`
+	VMID        int     `json:"vmid"`
+	Metric      string  `json:"metric"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Amount      float64 `json:"amount"`
+}
+
+// Rerating is the usage of an invoice period rated again after a correction,
+// compared line by line with the invoice. It is reviewed before it is applied,
+// applying it supersedes the invoice with one of the new amounts.
+type Rerating struct {
+	BaseModel
+	InvoiceID     uint         `json:"invoice_id" gorm:"index;not null"`
+	CustomerID    uint         `json:"customer_id" gorm:"index;not null"`
+	PeriodStart   time.Time    `json:"period_start"`
+	PeriodEnd     time.Time    `json:"period_end"`
+	Plan          string       `json:"plan"`
+	Currency      string       `json:"currency"`
+	PreviousTotal float64      `json:"previous_total"`
+	Total         float64      `json:"total"`
+	Delta         float64      `json:"delta"`
+	Status        string       `json:"status"`
+	NewInvoiceID  *uint        `json:"new_invoice_id"`
+	Lines         []RerateLine `json:"lines,omitempty"`
+}
+
+// RerateLine compares a line of the invoice with the same line rated again.
+// A removed line is no longer rated, a new line has no previous amounts.
+type RerateLine struct {
+	ID               uint    `json:"id" gorm:"primary_key"`
+	ReratingID       uint    `json:"rerating_id" gorm:"index;not null"`
+	SiteID           *uint   `json:"site_id,omitempty"`
+	Cluster          string  `json:"cluster,omitempty"`
+	VMID             int     `json:"vmid"`
+	Metric           string  `json:"metric"`
+	Description      string  `json:"description"`
+	PreviousQuantity float64 `json:"previous_quantity"`
+	PreviousAmount   float64 `json:"previous_amount"`
+	Quantity         float64 `json:"quantity"`
+	UnitPrice        float64 `json:"unit_price"`
+	Amount           float64 `json:"amount"`
+	Delta            float64 `json:"delta"`
+	Removed          bool    `json:"removed"`
+	SamplesDigest    string  `json:"-"`
+}
+
+// LedgerEntry is a rated usage record of the append-only ledger. The entries
+// of a customer are chained, the hash of each covers its content and the hash
+// of the previous entry. SamplesDigest is the digest of the samples of the VM
+// over the period, a later change to them is detected by the verification.
+type LedgerEntry struct {
+	ID            uint      `json:"id" gorm:"primary_key"`
+	CustomerID    uint      `json:"customer_id" gorm:"not null;uniqueIndex:idx_ledger_entries_customer_seq,priority:1"`
+	Seq           int64     `json:"seq" gorm:"not null;uniqueIndex:idx_ledger_entries_customer_seq,priority:2"`
+	InvoiceID     uint      `json:"invoice_id" gorm:"index"`
+	PeriodStart   time.Time `json:"period_start" gorm:"not null"`
+	PeriodEnd     time.Time `json:"period_end" gorm:"not null"`
+	SiteID        *uint     `json:"site_id,omitempty"`
+	Cluster       string    `json:"cluster,omitempty"`
+	VMID          int       `json:"vmid"`
+	Metric        string    `json:"metric"`
+	Quantity      float64   `json:"quantity"`
+	UnitPrice     float64   `json:"unit_price"`
+	Amount        float64   `json:"amount"`
+	SamplesDigest string    `json:"samples_digest"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash" gorm:"uniqueIndex"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// LastLedgerEntry returns the last entry of the customer, or nil for an empty ledger
+func LastLedgerEntry(db *gorm.DB, customerID uint) (*LedgerEntry, error) {
+	var entries []LedgerEntry
+	if err := db.Where("customer_id = ?", customerID).Order("seq DESC").Limit(1).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &entries[0], nil
+}
+
+// Subscription rates the usage of a customer with a price plan from
+// StartTime until EndTime, or without end. A subscription with a VMID only
+// covers that VM, of the site and cluster, and takes precedence over the
+// subscriptions of the customer. A plan change ends a subscription and starts
+// the next one.
+type Subscription struct {
+	BaseModel
+	CustomerID uint       `json:"customer_id" gorm:"index;not null"`
+	SiteID     *uint      `json:"site_id,omitempty"`
+	Cluster    string     `json:"cluster,omitempty"`
+	VMID       *int       `json:"vmid"`
+	Plan       string     `json:"plan" gorm:"not null"`
+	StartTime  time.Time  `json:"start_time" gorm:"not null"`
+	EndTime    *time.Time `json:"end_time"`
+}
+
+// ActiveAt reports whether the subscription covers the given time
+func (s Subscription) ActiveAt(at time.Time) bool {
+	return !at.Before(s.StartTime) && (s.EndTime == nil || at.Before(*s.EndTime))
+}
+
+// CustomerSubscriptions returns the subscriptions of the customer overlapping
+// the given period, the subscriptions of the customer before those of its VMs
+func CustomerSubscriptions(db *gorm.DB, customerID uint, from, to time.Time) ([]Subscription, error) {
+	var subscriptions []Subscription
+	err := db.Where("customer_id = ?", customerID).
+		Where("end_time IS NULL OR end_time > ?", from).
+		Where("start_time < ?", to).
+		Order("vm_id NULLS FIRST, start_time").
+		Find(&subscriptions).Error
+	return subscriptions, err
+}
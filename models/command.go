@@ -0,0 +1,112 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Types of the commands sent by the central side to the edge collectors
+const (
+	// CommandResendRange sends the samples of a period again
+	CommandResendRange = "resend_range"
+	// CommandBackfill collects the samples of a VM missing from a period and
+	// sends the samples of the VM of the period again
+	CommandBackfill = "backfill"
+	// CommandReportStatus reports the health of the tasks and the delivery state
+	CommandReportStatus = "report_status"
+	// CommandReloadConfig reloads the configuration of the collector
+	CommandReloadConfig = "reload_config"
+)
+
+// CommandTypes lists every command type
+var CommandTypes = []string{CommandResendRange, CommandBackfill, CommandReportStatus, CommandReloadConfig}
+
+// Statuses of a command
+const (
+	CommandSent   = "sent"
+	CommandOK     = "ok"
+	CommandFailed = "error"
+)
+
+// Command is the payload of a command sent to an edge collector, signed with
+// the command key of the central side. Site is the name of the site it is
+// addressed to. From and To are unix timestamps, the result is published on
+// ReplyTo. The VM is identified by its VMID in the Proxmox cluster named Cluster.
+type Command struct {
+	ID        string    `json:"id"`
+	Site      string    `json:"site"`
+	Type      string    `json:"type"`
+	From      int64     `json:"from,omitempty"`
+	To        int64     `json:"to,omitempty"`
+	Cluster   string    `json:"cluster,omitempty"`
+	VMID      int       `json:"vmid,omitempty"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// NewCommandID returns a random command ID
+func NewCommandID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Sign signs the command with the Ed25519 key of the central side, the
+// collectors verify it against its public key with VerifyPayload
+func (c *Command) Sign(key ed25519.PrivateKey) error {
+	c.Signature = ""
+	signature, err := signValue(c, key)
+	c.Signature = signature
+	return err
+}
+
+// CommandResult is the result of a command published by an edge collector,
+// signed with the signing key of its site
+type CommandResult struct {
+	CommandID   string                 `json:"command_id"`
+	Status      string                 `json:"status"`
+	Message     string                 `json:"message,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+	CompletedAt time.Time              `json:"completed_at"`
+	Signature   string                 `json:"signature,omitempty"`
+}
+
+// Sign signs the result with the Ed25519 key of the site, the central side
+// verifies it against the public key registered for the site
+func (r *CommandResult) Sign(key ed25519.PrivateKey) error {
+	r.Signature = ""
+	signature, err := signValue(r, key)
+	r.Signature = signature
+	return err
+}
+
+// signValue returns the signature of the JSON encoding of the value
+func signValue(value interface{}, key ed25519.PrivateKey) (string, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return SignPayload(payload, key)
+}
+
+// SiteCommand is a command sent to an edge site and its result
+type SiteCommand struct {
+	ID          string     `json:"id" gorm:"primaryKey"`
+	SiteID      uint       `json:"site_id" gorm:"index;not null"`
+	Type        string     `json:"type"`
+	From        int64      `json:"from,omitempty"`
+	To          int64      `json:"to,omitempty"`
+	Cluster     string     `json:"cluster,omitempty"`
+	VMID        int        `json:"vmid,omitempty"`
+	Status      string     `json:"status"`
+	Message     string     `json:"message,omitempty"`
+	Details     string     `json:"details,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Customer is a tenant owning VMs
+type Customer struct {
+	BaseModel
+	Name  string `json:"name" gorm:"not null"`
+	Email string `json:"email"`
+	// PricePlan is the plan the usage of the customer is rated with, the
+	// default plan of the billing configuration when empty
+	PricePlan string `json:"price_plan"`
+	// Timezone is the IANA name of the zone the time windows of the prices
+	// are evaluated in, UTC when empty
+	Timezone string `json:"timezone"`
+	// Prepaid customers have their usage debited from their wallet as it is
+	// collected
+	Prepaid bool `json:"prepaid"`
+}
+
+// Location returns the timezone of the customer
+func (c Customer) Location() (*time.Location, error) {
+	return time.LoadLocation(c.Timezone)
+}
+
+// VMOwnership assigns a VM to a customer for a period. An open EndTime means
+// the customer still owns the VM. The VM is identified by its VMID in the
+// Proxmox cluster of the edge site, SiteID is nil for the VMs collected
+// locally. The ownerships recorded before the clusters were told apart have
+// no cluster and cover the VMID on every cluster of the site.
+type VMOwnership struct {
+	BaseModel
+	CustomerID uint       `json:"customer_id" gorm:"index;not null"`
+	SiteID     *uint      `json:"site_id" gorm:"index"`
+	Cluster    string     `json:"cluster"`
+	VMID       int        `json:"vmid" gorm:"index;not null"`
+	StartTime  time.Time  `json:"start_time" gorm:"not null"`
+	EndTime    *time.Time `json:"end_time"`
+}
+
+// Covers reports whether the ownership includes the unix timestamp
+func (o *VMOwnership) Covers(timestamp int64) bool {
+	return o.StartTime.Unix() <= timestamp && (o.EndTime == nil || timestamp < o.EndTime.Unix())
+}
+
+// Owns reports whether the ownership is of the VM
+func (o *VMOwnership) Owns(key VMKey) bool {
+	return key.Matches(o.SiteID, o.Cluster, o.VMID)
+}
+
+// LockVM serializes the changes of the ownerships of the VMID on the site,
+// on any of its clusters, until the end of the transaction
+func LockVM(tx *gorm.DB, siteID *uint, vmid int) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", fmt.Sprintf("vm_ownership:%d:%d", siteKey(siteID), vmid)).Error
+}
+
+// OverlappingOwnerships selects the ownerships of the VM overlapping the
+// period, open ended for a nil end. An ownership without cluster covers the
+// VMID on every cluster of the site.
+func OverlappingOwnerships(db *gorm.DB, siteID *uint, cluster string, vmid int, from time.Time, to *time.Time) *gorm.DB {
+	query := SiteScope(db.Model(&VMOwnership{}), siteID).
+		Where("vm_id = ? AND (cluster = ? OR cluster = '' OR ? = '')", vmid, cluster, cluster).
+		Where("end_time IS NULL OR end_time > ?", from)
+	if to != nil {
+		query = query.Where("start_time < ?", *to)
+	}
+	return query
+}
+
+// CustomerOwnerships returns the ownerships of the customer overlapping the
+// given period. A nil bound leaves that side of the period open.
+func CustomerOwnerships(db *gorm.DB, customerID uint, from, to *time.Time) ([]VMOwnership, error) {
+	query := db.Where("customer_id = ?", customerID)
+	if from != nil {
+		query = query.Where("end_time IS NULL OR end_time > ?", from)
+	}
+	if to != nil {
+		query = query.Where("start_time <= ?", to)
+	}
+	var ownerships []VMOwnership
+	err := query.Order("vm_id, start_time").Find(&ownerships).Error
+	return ownerships, err
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Discount reduces the lines of the invoices matching its scope by a
+// percentage or a fixed amount per invoice period, while it is valid. An
+// empty scope matches every line, a discount without customer applies to
+// every customer. A discount of a VM applies to the VMID on the site and
+// cluster, on every cluster of the site without cluster. Discounts granted by
+// a coupon reference it.
+type Discount struct {
+	BaseModel
+	CustomerID  *uint      `json:"customer_id" gorm:"index"`
+	SiteID      *uint      `json:"site_id,omitempty"`
+	Cluster     string     `json:"cluster,omitempty"`
+	VMID        *int       `json:"vmid"`
+	Plan        string     `json:"plan,omitempty"`
+	Metric      string     `json:"metric,omitempty"`
+	Description string     `json:"description"`
+	Percent     float64    `json:"percent,omitempty"`
+	Amount      float64    `json:"amount,omitempty"`
+	ValidFrom   time.Time  `json:"valid_from"`
+	ValidTo     *time.Time `json:"valid_to"`
+	CouponID    *uint      `json:"coupon_id,omitempty" gorm:"index"`
+}
+
+// Coupon is a code redeemed by customers for a discount lasting DurationDays,
+// or without end when zero. It cannot be redeemed after ExpiresAt nor more
+// than MaxRedemptions times when set.
+type Coupon struct {
+	BaseModel
+	Code           string     `json:"code" gorm:"uniqueIndex;not null"`
+	Description    string     `json:"description"`
+	Plan           string     `json:"plan,omitempty"`
+	Metric         string     `json:"metric,omitempty"`
+	Percent        float64    `json:"percent,omitempty"`
+	Amount         float64    `json:"amount,omitempty"`
+	DurationDays   int        `json:"duration_days"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxRedemptions int        `json:"max_redemptions"`
+	Redemptions    int        `json:"redemptions"`
+}
+
+// Commitment is a committed use of a customer: Quantity units of a metric per
+// hour, such as vCPUs for the vCPU-hours, from StartTime until EndTime at a
+// reduced unit price. The committed usage is charged even when not used.
+type Commitment struct {
+	BaseModel
+	CustomerID  uint      `json:"customer_id" gorm:"index;not null"`
+	Metric      string    `json:"metric" gorm:"not null"`
+	Quantity    float64   `json:"quantity"`
+	UnitPrice   float64   `json:"unit_price"`
+	Description string    `json:"description"`
+	StartTime   time.Time `json:"start_time" gorm:"not null"`
+	EndTime     time.Time `json:"end_time" gorm:"not null"`
+}
+
+// CustomerDiscounts returns the discounts of the customer, and those of every
+// customer, valid during part of the given period
+func CustomerDiscounts(db *gorm.DB, customerID uint, from, to time.Time) ([]Discount, error) {
+	var discounts []Discount
+	err := db.Where("customer_id = ? OR customer_id IS NULL", customerID).
+		Where("valid_to IS NULL OR valid_to > ?", from).
+		Where("valid_from < ?", to).
+		Order("id").
+		Find(&discounts).Error
+	return discounts, err
+}
+
+// CustomerCommitments returns the commitments of the customer overlapping the given period
+func CustomerCommitments(db *gorm.DB, customerID uint, from, to time.Time) ([]Commitment, error) {
+	var commitments []Commitment
+	err := db.Where("customer_id = ? AND end_time > ? AND start_time < ?", customerID, from, to).
+		Order("id").
+		Find(&commitments).Error
+	return commitments, err
+}
@@ -1,17 +1,19 @@
 package models
 
 import (
-	"log"
+	"fmt"
+	"strings"
 
 	"gorm.io/gorm"
 )
 
-// AddSyncStatusMigration adds the sync_status column to the data table.
-func AddSyncStatusMigration(db *gorm.DB) {
-	log.Println("Running AddSyncStatusMigration...")
+// AddSyncStatesMigration creates the sync_status_enum type with all the sync
+// states, or adds the states missing from an existing type. It runs before the
+// tables are migrated, the status of data_deliveries uses the type.
+func AddSyncStatesMigration(db *gorm.DB) {
+	log.Info("Running AddSyncStatesMigration...")
 
-	// Add the ENUM type and the column
-	queryAddColumn := `
+	queryCreateType := `
 		DO $$
 		BEGIN
 			IF NOT EXISTS (
@@ -19,29 +21,140 @@ func AddSyncStatusMigration(db *gorm.DB) {
 			) THEN
 				CREATE TYPE sync_status_enum AS ENUM ('pending', 'success');
 			END IF;
-
-			IF NOT EXISTS (
-				SELECT 1 FROM information_schema.columns 
-				WHERE table_name = 'data' AND column_name = 'sync_status'
-			) THEN
-				ALTER TABLE data ADD COLUMN sync_status sync_status_enum DEFAULT 'pending';
-			END IF;
 		END $$;
 	`
+	if err := db.Exec(queryCreateType).Error; err != nil {
+		log.Panicf("Failed to create sync_status_enum: %v", err)
+	}
+
+	// ADD VALUE cannot run in the DO block, it must not be in a transaction
+	for _, status := range SyncStatuses {
+		if err := db.Exec(fmt.Sprintf("ALTER TYPE sync_status_enum ADD VALUE IF NOT EXISTS '%s'", status)).Error; err != nil {
+			log.Panicf("Failed to add %s to sync_status_enum: %v", status, err)
+		}
+	}
+
+	log.Info("AddSyncStatesMigration completed successfully.")
+}
 
-	// Execute the query to add the column
-	if err := db.Exec(queryAddColumn).Error; err != nil {
-		log.Panicf("Failed to add sync_status column: %v", err)
+// AddDataDeliveriesMigration creates the data_deliveries table, moving the
+// sync state of the rows not synced yet from the data table to their delivery
+// to the MQTT publisher. The sync columns of the data table are dropped then,
+// or on the next start when they could not be.
+func AddDataDeliveriesMigration(db *gorm.DB, sink string) {
+	migrated := db.Migrator().HasTable(&DataDelivery{})
+	if migrated && !db.Migrator().HasColumn("data", "sync_status") {
+		return
 	}
+	log.Info("Running AddDataDeliveriesMigration...")
 
-	// Update existing rows to have the default value
-	queryUpdateDefault := `
-		UPDATE data SET sync_status = 'pending' WHERE sync_status IS NULL;
+	if !migrated {
+		if err := db.Migrator().CreateTable(&DataDelivery{}); err != nil {
+			log.Panicf("Failed to create data_deliveries: %v", err)
+		}
+	}
+	if !migrated && db.Migrator().HasColumn("data", "sync_status") {
+		// The attempts and retries were tracked on the data table for a while
+		columns := "0, '', NULL, ''"
+		if db.Migrator().HasColumn("data", "sync_batch") {
+			columns = "sync_attempts, sync_error, next_sync_at, sync_batch"
+		}
+		queryCopy := fmt.Sprintf(`
+			INSERT INTO data_deliveries (data_id, sink, status, attempts, error, next_attempt_at, batch_id, created_at, updated_at)
+			SELECT id, ?, COALESCE(sync_status, 'pending'), %s, NOW(), NOW()
+			FROM data WHERE sync_status IS DISTINCT FROM 'success';
+		`, columns)
+		result := db.Exec(queryCopy, sink)
+		if result.Error != nil {
+			log.Panicf("Failed to copy the sync status to data_deliveries: %v", result.Error)
+		}
+		log.Infof("Moved the sync status of %d rows to data_deliveries", result.RowsAffected)
+	}
+
+	queryDropColumns := `
+		ALTER TABLE data
+			DROP COLUMN IF EXISTS sync_status,
+			DROP COLUMN IF EXISTS sync_attempts,
+			DROP COLUMN IF EXISTS sync_error,
+			DROP COLUMN IF EXISTS next_sync_at,
+			DROP COLUMN IF EXISTS sync_batch;
 	`
+	if err := db.Exec(queryDropColumns).Error; err != nil {
+		// Compressed chunks may refuse it, the columns are unused
+		log.Warnf("Failed to drop the sync columns of data: %v", err)
+	}
+
+	log.Info("AddDataDeliveriesMigration completed successfully.")
+}
+
+// dataRawDedupIndex is the unique index storing a sample of data_raws once
+var dataRawDedupIndex = "idx_data_raws_source_site_cluster_vm_time"
+
+// DataRawDedupColumns are the columns of dataRawDedupIndex, the conflict target
+// of the inserts into data_raws. The samples collected locally have no site.
+var DataRawDedupColumns = []string{"source", "(COALESCE(site_id, 0))", "cluster", "vm_id", "time"}
+
+// AddDataRawDedupMigration stores a sample of data_raws once per source, site,
+// cluster, VM and time. The source of the rows received before it was tracked
+// is their topic, the duplicated rows are removed keeping the first one
+// received. It only runs until the unique index exists, it replaces the
+// previous one missing the site and the cluster.
+func AddDataRawDedupMigration(db *gorm.DB) {
+	if db.Migrator().HasIndex("data_raws", dataRawDedupIndex) {
+		return
+	}
+	log.Info("Running AddDataRawDedupMigration...")
+
+	if err := db.Exec(`UPDATE data_raws SET source = topic WHERE source = '' OR source IS NULL`).Error; err != nil {
+		log.Panicf("Failed to set the source of data_raws: %v", err)
+	}
+
+	queryDeleteDuplicates := `
+		DELETE FROM data_raws d USING data_raws k
+		WHERE d.source = k.source AND d.site_id IS NOT DISTINCT FROM k.site_id AND d.cluster = k.cluster
+			AND d.vm_id = k.vm_id AND d.time = k.time AND d.id > k.id;
+	`
+	if err := db.Exec(queryDeleteDuplicates).Error; err != nil {
+		log.Panicf("Failed to remove the duplicated rows of data_raws: %v", err)
+	}
+
+	queryIndex := fmt.Sprintf(`
+		CREATE UNIQUE INDEX IF NOT EXISTS %s ON data_raws(%s);
+		DROP INDEX IF EXISTS idx_data_raws_source_vm_time;
+	`, dataRawDedupIndex, strings.Join(DataRawDedupColumns, ", "))
+	if err := db.Exec(queryIndex).Error; err != nil {
+		log.Panicf("Failed to create the unique index of data_raws: %v", err)
+	}
+
+	log.Info("AddDataRawDedupMigration completed successfully.")
+}
+
+// AddAppendOnlyMigration makes a table append-only, its rows can no longer be
+// updated or deleted and the table cannot be truncated
+func AddAppendOnlyMigration(db *gorm.DB, table string) {
+	log.Infof("Running AddAppendOnlyMigration on %s...", table)
+
+	queryFunction := `
+		CREATE OR REPLACE FUNCTION reject_append_only_change() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'table % is append-only', TG_TABLE_NAME;
+		END $$ LANGUAGE plpgsql;
+	`
+	if err := db.Exec(queryFunction).Error; err != nil {
+		log.Panicf("Failed to create the append-only trigger function: %v", err)
+	}
 
-	if err := db.Exec(queryUpdateDefault).Error; err != nil {
-		log.Panicf("Failed to set default values for sync_status: %v", err)
+	queryTriggers := fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS %[1]s_append_only ON %[1]s;
+		CREATE TRIGGER %[1]s_append_only BEFORE UPDATE OR DELETE ON %[1]s
+			FOR EACH ROW EXECUTE FUNCTION reject_append_only_change();
+		DROP TRIGGER IF EXISTS %[1]s_append_only_truncate ON %[1]s;
+		CREATE TRIGGER %[1]s_append_only_truncate BEFORE TRUNCATE ON %[1]s
+			FOR EACH STATEMENT EXECUTE FUNCTION reject_append_only_change();
+	`, table)
+	if err := db.Exec(queryTriggers).Error; err != nil {
+		log.Panicf("Failed to make %s append-only: %v", table, err)
 	}
 
-	log.Println("AddSyncStatusMigration completed successfully.")
+	log.Infof("AddAppendOnlyMigration on %s completed successfully.", table)
 }
@@ -1,5 +1,15 @@
 package models
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
 type RRDData struct {
 	Time      int      `json:"time"`
 	MaxCPU    *float64 `json:"maxcpu,omitempty"`
@@ -16,27 +26,234 @@ type RRDData struct {
 
 type VMData struct {
 	RRDData
-	VMID int `json:"vmid"`
+	VMID    int    `json:"vmid"`
+	Cluster string `json:"cluster,omitempty"`
+	// Node is the Proxmox node the VM ran on when sampled
+	Node string `json:"node,omitempty"`
+}
+
+// maxClockSkew is how far in the future the time of a sample may be, the
+// clocks of the edge sites drift
+const maxClockSkew = time.Hour
+
+// Validate checks that the sample identifies a VM and a time, and that its
+// metrics are plausible
+func (v VMData) Validate(now time.Time) error {
+	var errs []error
+	if v.VMID <= 0 {
+		errs = append(errs, fmt.Errorf("vmid: %d is not a VM ID", v.VMID))
+	}
+	if v.Time <= 0 {
+		errs = append(errs, fmt.Errorf("time: %d is not a unix timestamp", v.Time))
+	} else if time.Unix(int64(v.Time), 0).After(now.Add(maxClockSkew)) {
+		errs = append(errs, fmt.Errorf("time: %d is in the future", v.Time))
+	}
+	metrics := []struct {
+		name  string
+		value *float64
+	}{
+		{"maxcpu", v.MaxCPU}, {"maxdisk", v.MaxDisk}, {"maxmem", v.MaxMem},
+		{"disk", v.Disk}, {"cpu", v.CPU}, {"mem", v.Mem},
+		{"netout", v.NetOut}, {"netin", v.NetIn}, {"diskread", v.DiskRead}, {"diskwrite", v.DiskWrite},
+	}
+	for _, metric := range metrics {
+		if metric.value != nil && (math.IsNaN(*metric.value) || math.IsInf(*metric.value, 0) || *metric.value < 0) {
+			errs = append(errs, fmt.Errorf("%s: %v is not a valid value", metric.name, *metric.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DataBatch is the payload of the messages published by the edge collectors,
+// a message may carry many samples of many VMs. Source identifies the
+// collector. When ReplyTo is set the central side publishes a BatchAck on it
+// once the samples are stored. Signature is the Ed25519 signature of the
+// batch by the key of the site, see SignPayload.
+type DataBatch struct {
+	BatchID   string   `json:"batch_id,omitempty"`
+	Source    string   `json:"source,omitempty"`
+	ReplyTo   string   `json:"reply_to,omitempty"`
+	Samples   []VMData `json:"samples"`
+	Signature string   `json:"signature,omitempty"`
+}
+
+// QuarantinedMessage is a message whose signature could not be verified
+// against the key of its site, kept for inspection instead of being stored
+type QuarantinedMessage struct {
+	BaseModel
+	SiteID  *uint  `json:"site_id" gorm:"index"`
+	Topic   string `json:"topic"`
+	BatchID string `json:"batch_id,omitempty"`
+	Reason  string `json:"reason"`
+	Payload []byte `json:"payload"`
 }
 
-// SyncStatusEnum defines the possible values for the SyncStatus field.
+// RejectedMessage is published on the dead letter topic of the subscriber for
+// the messages, or the samples of a message, rejected by the validation
+type RejectedMessage struct {
+	Topic      string    `json:"topic"`
+	BatchID    string    `json:"batch_id,omitempty"`
+	Reasons    []string  `json:"reasons"`
+	Payload    []byte    `json:"payload,omitempty"`
+	Samples    []VMData  `json:"samples,omitempty"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+// BatchAck acknowledges a DataBatch stored by the central side
+type BatchAck struct {
+	BatchID string `json:"batch_id"`
+	Samples int    `json:"samples"`
+}
+
+// ReceivedBatch records the batches stored by the central side, so a batch
+// sent again after a lost acknowledgement is not stored twice
+type ReceivedBatch struct {
+	BatchID   string    `gorm:"primaryKey" json:"batch_id"`
+	Topic     string    `json:"topic"`
+	Samples   int       `json:"samples"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SyncStatusEnum defines the possible values for the status of a delivery.
 type SyncStatusEnum string
 
+// A delivery is pending until published, in flight until acknowledged by the
+// sink and failed when the publication or the acknowledgement failed. Failed
+// deliveries are retried with a backoff, and dead once out of attempts.
 const (
-	SyncStatusPending SyncStatusEnum = "pending"
-	SyncStatusSuccess SyncStatusEnum = "success"
+	SyncStatusPending  SyncStatusEnum = "pending"
+	SyncStatusInFlight SyncStatusEnum = "in_flight"
+	SyncStatusSuccess  SyncStatusEnum = "success"
+	SyncStatusFailed   SyncStatusEnum = "failed"
+	SyncStatusDead     SyncStatusEnum = "dead"
 )
 
+// SyncStatuses lists the values of the sync_status_enum type
+var SyncStatuses = []SyncStatusEnum{SyncStatusPending, SyncStatusInFlight, SyncStatusSuccess, SyncStatusFailed, SyncStatusDead}
+
+// Data is a sample collected by the edge, or promoted from data_raws by the
+// central side with the source and topic it was received from. Its delivery to
+// each sink is tracked by a DataDelivery.
 type Data struct {
 	BaseModel
 	RRDData
-	VMID       int            `json:"vmid"`
-	SyncStatus SyncStatusEnum `json:"sync_status" gorm:"type:enum('pending', 'success');default:'pending'"`
+	VMID    int    `json:"vmid"`
+	Cluster string `json:"cluster"`
+	Node    string `json:"node,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	SiteID  *uint  `json:"site_id,omitempty"`
 }
 
+// DataRaw is a sample received by the central side. A sample is stored once
+// per source, VM and time, and promoted into data by the promotion job.
 type DataRaw struct {
 	BaseModel
 	RRDData
-	VMID  int    `json:"vmid"`
-	Topic string `json:"topic"`
+	VMID    int    `json:"vmid"`
+	Cluster string `json:"cluster"`
+	Node    string `json:"node"`
+	Topic   string `json:"topic"`
+	// Source is the collector of the sample, the topic for older collectors
+	Source     string     `json:"source"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty" gorm:"index"`
+	// SiteID is the edge site registered for the topic
+	SiteID *uint `json:"site_id,omitempty" gorm:"index"`
+}
+
+// VMData returns the sample as sent by the edge collectors
+func (d Data) VMData() VMData {
+	return VMData{RRDData: d.RRDData, VMID: d.VMID, Cluster: d.Cluster, Node: d.Node}
+}
+
+// Data returns the sample to promote into data
+func (d DataRaw) Data() Data {
+	return Data{RRDData: d.RRDData, VMID: d.VMID, Cluster: d.Cluster, Node: d.Node, Source: d.Source, Topic: d.Topic, SiteID: d.SiteID}
+}
+
+// PromoteRawData moves up to limit rows of data_raw not promoted yet into data,
+// along their deliveries to the sinks, and returns the number of rows promoted.
+// Concurrent promotions skip the rows locked by each other.
+func PromoteRawData(db *gorm.DB, limit int, sinks []string) (int, error) {
+	var promoted int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var raw []DataRaw
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("promoted_at IS NULL").Order("id").Limit(limit).Find(&raw).Error
+		if err != nil || len(raw) == 0 {
+			return err
+		}
+
+		rows := make([]Data, len(raw))
+		ids := make([]uint, len(raw))
+		for i, r := range raw {
+			rows[i] = r.Data()
+			ids[i] = r.ID
+		}
+		if err := tx.CreateInBatches(&rows, 1000).Error; err != nil {
+			return err
+		}
+		if err := EnqueueDeliveries(tx, rows, sinks); err != nil {
+			return err
+		}
+		if err := tx.Model(&DataRaw{}).Where("id IN ?", ids).Update("promoted_at", time.Now()).Error; err != nil {
+			return err
+		}
+		promoted = len(rows)
+		return nil
+	})
+	return promoted, err
+}
+
+// BackfillData saves the rows not saved yet, a VM of a cluster having a single
+// sample at a time, along their deliveries to the sinks. It returns the number
+// of rows saved.
+func BackfillData(db *gorm.DB, rows []Data, sinks []string) (int, error) {
+	var saved int
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The period of the rows of each VM
+		periods := map[VMKey][2]int{}
+		for _, row := range rows {
+			key := VMKey{Cluster: row.Cluster, VMID: row.VMID}
+			period, exists := periods[key]
+			if !exists || row.Time < period[0] {
+				period[0] = row.Time
+			}
+			if !exists || row.Time > period[1] {
+				period[1] = row.Time
+			}
+			periods[key] = period
+		}
+		existing := map[VMKey]map[int]bool{}
+		for key, period := range periods {
+			var times []int
+			err := tx.Model(&Data{}).
+				Where("cluster = ? AND vm_id = ? AND time BETWEEN ? AND ?", key.Cluster, key.VMID, period[0], period[1]).
+				Pluck("time", &times).Error
+			if err != nil {
+				return err
+			}
+			existing[key] = make(map[int]bool, len(times))
+			for _, t := range times {
+				existing[key][t] = true
+			}
+		}
+		var missing []Data
+		for _, row := range rows {
+			key := VMKey{Cluster: row.Cluster, VMID: row.VMID}
+			if !existing[key][row.Time] {
+				existing[key][row.Time] = true
+				missing = append(missing, row)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if err := tx.CreateInBatches(&missing, 1000).Error; err != nil {
+			return err
+		}
+		saved = len(missing)
+		return EnqueueDeliveries(tx, missing, sinks)
+	})
+	return saved, err
 }
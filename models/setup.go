@@ -2,53 +2,103 @@ package models
 
 import (
 	"billingo/config"
+	"billingo/logging"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/sirupsen/logrus"
 	"gorm.io/driver/postgres" // using postgres sql
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
+var log = logging.For("database")
+
 // SetupModels setup database
 func SetupModels(conf *config.Config) *gorm.DB {
 	// Load variables
-	dbName := conf.DBName
-	dbHost := conf.DBHost
-	dbPort := conf.DBPort
-	dbUser := conf.DBUser
-	dbPwd := conf.DBPassword
-	interval := conf.CompressionIntervalDays
-
-	// Create postgresql url
-	postgresConn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s", dbHost, dbPort, dbUser, dbName, dbPwd)
-	fmt.Println("postgresConn :>>", postgresConn)
+	dbName := conf.Database.Name
+	dbHost := conf.Database.Host
+	dbPort := conf.Database.Port
+	dbUser := conf.Database.User
+
+	// Create postgresql url, the password is set on each new connection so a
+	// rotated one is used without a restart
+	postgresConn := fmt.Sprintf("host=%s port=%s user=%s dbname=%s", dbHost, dbPort, dbUser, dbName)
+	log.WithField("host", dbHost).WithField("port", dbPort).WithField("dbname", dbName).Info("Connecting to database")
+	connConfig, err := pgx.ParseConfig(postgresConn)
+	if err != nil {
+		log.WithError(err).Panic("Invalid database configuration")
+	}
+	sqlDB := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(func(ctx context.Context, cc *pgx.ConnConfig) error {
+		cc.Password = conf.Snapshot().Database.Password
+		return nil
+	}))
 
 	// Open connection
-	db, err := gorm.Open(postgres.Open(postgresConn), &gorm.Config{
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
 		SkipDefaultTransaction: true,
-		// Logger:                 logger.Default.LogMode(logger.Silent),
+		Logger: logger.New(log, logger.Config{
+			SlowThreshold:             time.Second,
+			LogLevel:                  logger.Warn,
+			IgnoreRecordNotFoundError: true,
+		}),
 	})
 	if err != nil {
-		fmt.Println(err)
-		panic("Failed to connect to database:")
+		log.WithError(err).Panic("Failed to connect to database")
 	}
 
+	// The types used by the tables
+	AddSyncStatesMigration(db)
+
 	// Create tables, if not yet
-	db.AutoMigrate(&Data{}, &DataRaw{})
+	db.AutoMigrate(&Data{}, &DataRaw{}, &ReceivedBatch{}, &APIKey{}, &Customer{}, &VMOwnership{}, &Site{}, &SiteCommand{}, &QuarantinedMessage{},
+		&Invoice{}, &InvoiceLine{}, &LedgerEntry{}, &Rerating{}, &RerateLine{}, &Subscription{},
+		&Discount{}, &Coupon{}, &Commitment{}, &WalletTransaction{}, &WalletPosting{})
 
 	// Apply additional migrations
-	AddSyncStatusMigration(db)
+	AddDataDeliveriesMigration(db, config.MQTTSinkName)
+	AddDataRawDedupMigration(db)
+	AddAppendOnlyMigration(db, "ledger_entries")
+	AddAppendOnlyMigration(db, "wallet_transactions")
+	AddAppendOnlyMigration(db, "wallet_postings")
+	db.AutoMigrate(&DataDelivery{})
 
 	setupHypertables(db)
 	setupIndexes(db)
-	if interval > 0 {
-		setupCompression(db, interval)
+	if err := ApplyPolicies(db, conf.Snapshot().Database); err != nil {
+		log.Panic(err)
 	}
 	return db
 }
 
+// ApplyPolicies applies the compression and retention settings to the data
+// table, it is also called when the configuration is reloaded
+func ApplyPolicies(db *gorm.DB, database config.DatabaseConfig) (err error) {
+	// The setup helpers panic, a reload must not bring the service down
+	defer func() {
+		if r := recover(); r != nil {
+			if entry, ok := r.(*logrus.Entry); ok {
+				err = errors.New(entry.Message)
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	if database.CompressionIntervalDays > 0 {
+		setupCompression(db, database.CompressionIntervalDays)
+	}
+	setupRetention(db, database.RetentionDays)
+	return nil
+}
+
 // setupHypertables creates Timescale Hypertable for data table
 //   - this will create a warning on the log, but we can ignore it.
 func setupHypertables(db *gorm.DB) {
@@ -99,7 +149,7 @@ func getTimescaleDBLicense(db *gorm.DB) string {
 	// Execute the query and fetch the license value
 	err := db.Raw(query).Scan(&license).Error
 	if err != nil {
-		fmt.Printf("Error querying TimescaleDB license: %v\n", err)
+		log.Errorf("Error querying TimescaleDB license: %v", err)
 		return "unknown" // Return "unknown" if the query fails
 	}
 
@@ -139,6 +189,23 @@ func setupCompression(db *gorm.DB, interval int) {
 
 }
 
+// setupRetention replaces the retention policy of the data table, no policy
+// is kept when days is 0
+func setupRetention(db *gorm.DB, days int) {
+	if getTimescaleDBLicense(db) == "apache" {
+		if days > 0 {
+			log.Warn("The apache license of TimescaleDB does not support retention policies, the data is kept forever")
+		}
+		return
+	}
+
+	execDB(db, `SELECT remove_retention_policy('data', if_exists => TRUE);`)
+	if days > 0 {
+		log.Infof("Retention Policy of %d days for data table", days)
+		execDB(db, fmt.Sprintf(`SELECT add_retention_policy('data', INTERVAL '%d days');`, days))
+	}
+}
+
 // execDB will run a SQL query and panic if an error occurs
 func execDB(db *gorm.DB, sql string) {
 	if err := db.Exec(sql).Error; err != nil {
@@ -154,7 +221,11 @@ func execDB(db *gorm.DB, sql string) {
 
 func InitTestDB() *gorm.DB {
 	os.Setenv("ENVIRONMENT", "TESTING")
-	gormDb := SetupModels(config.LoadConfig())
+	conf, err := config.LoadConfig()
+	if err != nil {
+		panic(fmt.Errorf("init_db invalid config: %w", err))
+	}
+	gormDb := SetupModels(conf)
 	db, err := gormDb.DB()
 	if err != nil {
 		panic(fmt.Errorf("init_db failed to get db instance: %w", err))
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// canonicalJSON re-encodes a JSON payload with the keys of its objects sorted,
+// without the given top level key. The signer and the verifier may encode the
+// same value with different types, the signature covers the canonical form.
+func canonicalJSON(payload []byte, without string) ([]byte, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return nil, err
+	}
+	if object, ok := value.(map[string]interface{}); ok && without != "" {
+		delete(object, without)
+	}
+	return json.Marshal(value)
+}
+
+// ParsePrivateKey decodes a base64 Ed25519 private key, either its 32 bytes
+// seed or the 64 bytes key
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("invalid Ed25519 private key of %d bytes", len(raw))
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 public key of %d bytes", len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// SignPayload returns the base64 Ed25519 signature of a JSON payload, its
+// signature field excluded
+func SignPayload(payload []byte, key ed25519.PrivateKey) (string, error) {
+	canonical, err := canonicalJSON(payload, "signature")
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, canonical)), nil
+}
+
+// VerifyPayload checks the signature field of a JSON payload against the
+// base64 Ed25519 public key
+func VerifyPayload(payload []byte, publicKey string) error {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	var signed struct {
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return err
+	}
+	if signed.Signature == "" {
+		return errors.New("the payload is not signed")
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	canonical, err := canonicalJSON(payload, "signature")
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, canonical, signature) {
+		return errors.New("the signature does not match")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Site is an edge site publishing its samples to the central broker. The
+// samples received on the topic of the site are attributed to it, the VM IDs
+// of different sites may collide.
+type Site struct {
+	BaseModel
+	// Name identifies the site, DisplayName is shown to the users
+	Name        string `json:"name" gorm:"uniqueIndex;not null"`
+	DisplayName string `json:"display_name"`
+	// Topic is the topic the site publishes on, it may be an MQTT filter
+	Topic string `json:"topic" gorm:"uniqueIndex;not null"`
+	// CommandTopic is the topic the collector of the site receives the commands on
+	CommandTopic string `json:"command_topic"`
+	// Cluster replaces the cluster of the samples of the site when set
+	Cluster string `json:"cluster"`
+	// Username and the hash of the password the site authenticates with on
+	// the broker, the password is shown once when generated and checked by
+	// the /broker endpoints the broker authenticates its clients with
+	Username     string `json:"username" gorm:"uniqueIndex;not null"`
+	PasswordHash string `json:"-"`
+	// PublicKey is the base64 Ed25519 key the batches of the site are signed with
+	PublicKey string `json:"public_key"`
+	// ResellerID is the customer reselling the site
+	ResellerID *uint `json:"reseller_id" gorm:"index"`
+	// LastSeenAt and Samples are updated as the samples of the site are received
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	Samples    int64      `json:"samples"`
+}
+
+// SiteStats is the reception rate of a site
+type SiteStats struct {
+	SiteID uint `json:"site_id"`
+	// Samples received over the last hour
+	SamplesLastHour int64   `json:"samples_last_hour"`
+	SamplesPerMin   float64 `json:"samples_per_minute"`
+}
+
+// MatchTopic reports whether the topic matches the MQTT filter, where + matches
+// a single level and a trailing # any number of levels
+func MatchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidTopicFilter reports whether the MQTT filter is well formed, the
+// wildcards must take a whole level and # must be the last one
+func ValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveSite returns the site publishing on the topic, or nil. A site
+// registered with the exact topic is preferred over one matching it with a
+// filter, the longest filter wins between several.
+func ResolveSite(sites []Site, topic string) *Site {
+	var match *Site
+	for i := range sites {
+		site := &sites[i]
+		if site.Topic == topic {
+			return site
+		}
+		if MatchTopic(site.Topic, topic) && (match == nil || len(site.Topic) > len(match.Topic)) {
+			match = site
+		}
+	}
+	return match
+}
+
+// RecordSiteSamples updates the last seen time and the sample count of a site
+func RecordSiteSamples(db *gorm.DB, siteID uint, samples int, seenAt time.Time) error {
+	return db.Model(&Site{}).Where("id = ?", siteID).Updates(map[string]interface{}{
+		"last_seen_at": gorm.Expr("GREATEST(last_seen_at, ?)", seenAt),
+		"samples":      gorm.Expr("samples + ?", samples),
+	}).Error
+}
+
+// CountSiteSamples returns the reception rate of every site that sent samples
+// over the last hour
+func CountSiteSamples(db *gorm.DB, now time.Time) ([]SiteStats, error) {
+	var stats []SiteStats
+	err := db.Model(&DataRaw{}).
+		Select("site_id, COUNT(*) AS samples_last_hour").
+		Where("site_id IS NOT NULL AND created_at > ?", now.Add(-time.Hour)).
+		Group("site_id").Order("site_id").Scan(&stats).Error
+	for i := range stats {
+		stats[i].SamplesPerMin = float64(stats[i].SamplesLastHour) / 60
+	}
+	return stats, err
+}
+
+// SiteScope restricts the query to the rows of the site, those collected
+// locally for a nil site
+func SiteScope(query *gorm.DB, siteID *uint) *gorm.DB {
+	if siteID == nil {
+		return query.Where("site_id IS NULL")
+	}
+	return query.Where("site_id = ?", *siteID)
+}
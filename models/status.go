@@ -0,0 +1,14 @@
+package models
+
+// Collector statuses published on the status topic of the edge collectors
+const (
+	CollectorOnline  = "online"
+	CollectorOffline = "offline"
+)
+
+// CollectorStatus announces an edge collector connecting to the broker, or
+// going offline as its Last Will
+type CollectorStatus struct {
+	ClientID string `json:"client_id"`
+	Status   string `json:"status"`
+}
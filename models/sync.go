@@ -0,0 +1,191 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DataDelivery tracks the delivery of a row of data to a sink, each sink
+// retries its deliveries on its own
+type DataDelivery struct {
+	ID     uint           `gorm:"primary_key" json:"id"`
+	DataID uint           `gorm:"not null;uniqueIndex:idx_data_deliveries_data_sink,priority:1" json:"data_id"`
+	Sink   string         `gorm:"not null;uniqueIndex:idx_data_deliveries_data_sink,priority:2;index:idx_data_deliveries_sink_status" json:"sink"`
+	Status SyncStatusEnum `gorm:"type:sync_status_enum;not null;default:'pending';index:idx_data_deliveries_sink_status" json:"status"`
+	// Attempts counts the publications of the row, Error is the reason of the last failure
+	Attempts int    `gorm:"not null;default:0" json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// NextAttemptAt is when a failed delivery is retried, or when an in flight
+	// delivery is failed for lack of acknowledgement
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	// BatchID is the batch of the last publication, as acknowledged by the sink
+	BatchID   string    `gorm:"index" json:"batch_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SyncRetry is the retry policy of the deliveries failed
+type SyncRetry struct {
+	// MaxAttempts is the number of publications before a delivery is dead
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled after each attempt up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// EnqueueDeliveries creates the pending deliveries of the rows to each sink,
+// in the transaction saving the rows so none is missed
+func EnqueueDeliveries(tx *gorm.DB, rows []Data, sinks []string) error {
+	if len(rows) == 0 || len(sinks) == 0 {
+		return nil
+	}
+	deliveries := make([]DataDelivery, 0, len(rows)*len(sinks))
+	for _, sink := range sinks {
+		for _, row := range rows {
+			deliveries = append(deliveries, DataDelivery{DataID: row.ID, Sink: sink, Status: SyncStatusPending})
+		}
+	}
+	return tx.CreateInBatches(&deliveries, 1000).Error
+}
+
+// DueDeliveries returns the rows due for delivery to the sink, pending or
+// failed and past their retry time, in id order after the given id
+func DueDeliveries(db *gorm.DB, sink string, afterID uint, limit int) ([]Data, error) {
+	var rows []Data
+	err := db.Model(&Data{}).
+		Joins("JOIN data_deliveries ON data_deliveries.data_id = data.id").
+		Where("data_deliveries.sink = ? AND data_deliveries.status IN ?", sink, []SyncStatusEnum{SyncStatusPending, SyncStatusFailed}).
+		Where("data_deliveries.next_attempt_at IS NULL OR data_deliveries.next_attempt_at <= ?", time.Now()).
+		Where("data.id > ?", afterID).
+		Order("data.id").Limit(limit).Find(&rows).Error
+	return rows, err
+}
+
+// deliveries returns the deliveries of the rows to the sink
+func deliveries(db *gorm.DB, sink string, ids []uint) *gorm.DB {
+	return db.Model(&DataDelivery{}).Where("sink = ? AND data_id IN ?", sink, ids)
+}
+
+// MarkSyncAttempt marks the deliveries in flight as the batch, they are failed
+// if not acknowledged before the timeout
+func MarkSyncAttempt(db *gorm.DB, sink string, ids []uint, batchID string, timeout time.Duration) error {
+	return deliveries(db, sink, ids).Updates(map[string]any{
+		"status":          SyncStatusInFlight,
+		"attempts":        gorm.Expr("attempts + 1"),
+		"batch_id":        batchID,
+		"next_attempt_at": time.Now().Add(timeout),
+	}).Error
+}
+
+// MarkSynced marks the deliveries as done
+func MarkSynced(db *gorm.DB, sink string, ids []uint) error {
+	return deliveries(db, sink, ids).Updates(map[string]any{
+		"status":          SyncStatusSuccess,
+		"error":           "",
+		"next_attempt_at": nil,
+	}).Error
+}
+
+// AcknowledgeBatch marks the deliveries of the batch as done and returns their
+// number. A late acknowledgement also recovers deliveries failed or dead meanwhile.
+func AcknowledgeBatch(db *gorm.DB, sink, batchID string) (int64, error) {
+	result := db.Model(&DataDelivery{}).
+		Where("sink = ? AND batch_id = ? AND status <> ?", sink, batchID, SyncStatusSuccess).
+		Updates(map[string]any{
+			"status":          SyncStatusSuccess,
+			"error":           "",
+			"next_attempt_at": nil,
+		})
+	return result.RowsAffected, result.Error
+}
+
+// MarkSyncFailed records the failure of the deliveries, they are retried after
+// the backoff or dead once out of attempts
+func MarkSyncFailed(db *gorm.DB, sink string, ids []uint, reason string, retry SyncRetry) error {
+	return deliveries(db, sink, ids).Updates(failedUpdate(reason, retry)).Error
+}
+
+// ExpireInFlight fails the deliveries in flight not acknowledged before their
+// timeout and returns their number
+func ExpireInFlight(db *gorm.DB, sink, reason string, retry SyncRetry) (int64, error) {
+	result := db.Model(&DataDelivery{}).
+		Where("sink = ? AND status = ? AND next_attempt_at <= ?", sink, SyncStatusInFlight, time.Now()).
+		Updates(failedUpdate(reason, retry))
+	return result.RowsAffected, result.Error
+}
+
+// failedUpdate computes the state of failed deliveries from their attempts,
+// the backoff doubles from the first attempt
+func failedUpdate(reason string, retry SyncRetry) map[string]any {
+	return map[string]any{
+		"status": gorm.Expr("CASE WHEN attempts >= ? THEN ?::sync_status_enum ELSE ?::sync_status_enum END",
+			retry.MaxAttempts, SyncStatusDead, SyncStatusFailed),
+		"error": reason,
+		"next_attempt_at": gorm.Expr("NOW() + LEAST(? * POWER(2, GREATEST(attempts - 1, 0)), ?) * INTERVAL '1 second'",
+			retry.Backoff.Seconds(), retry.MaxBackoff.Seconds()),
+	}
+}
+
+// DeadDeliveries returns the dead deliveries, of every sink when sink is empty
+func DeadDeliveries(db *gorm.DB, sink string) *gorm.DB {
+	query := db.Model(&DataDelivery{}).Where("status = ?", SyncStatusDead)
+	if sink != "" {
+		query = query.Where("sink = ?", sink)
+	}
+	return query
+}
+
+// RequeueDead makes dead deliveries pending again with their attempts reset,
+// of every sink when sink is empty and of every row when no ids are given. It
+// returns their number.
+func RequeueDead(db *gorm.DB, sink string, ids []uint) (int64, error) {
+	query := DeadDeliveries(db, sink)
+	if len(ids) > 0 {
+		query = query.Where("data_id IN ?", ids)
+	}
+	result := query.Updates(map[string]any{
+		"status":          SyncStatusPending,
+		"attempts":        0,
+		"error":           "",
+		"next_attempt_at": nil,
+	})
+	return result.RowsAffected, result.Error
+}
+
+// CountSyncStatuses returns the number of deliveries to the sink in each state
+func CountSyncStatuses(db *gorm.DB, sink string) (map[SyncStatusEnum]int64, error) {
+	var rows []struct {
+		Status SyncStatusEnum
+		Count  int64
+	}
+	err := db.Model(&DataDelivery{}).Select("status, COUNT(*) AS count").
+		Where("sink = ?", sink).Group("status").Scan(&rows).Error
+	counts := make(map[SyncStatusEnum]int64, len(SyncStatuses))
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, err
+}
+
+// PruneDeliveries removes the deliveries done before the cutoff, their rows
+// are dropped by the retention policy
+func PruneDeliveries(db *gorm.DB, cutoff time.Time) (int64, error) {
+	result := db.Where("status = ? AND updated_at < ?", SyncStatusSuccess, cutoff).Delete(&DataDelivery{})
+	return result.RowsAffected, result.Error
+}
+
+// ResendRange makes the rows of the period due again for delivery to the sink,
+// whatever their state, and returns their number. The rows of a single VM are
+// resent when its VMID is not 0. Rows without a delivery to the sink get one.
+func ResendRange(db *gorm.DB, sink string, from, to int64, vm VMKey) (int64, error) {
+	query := `
+		INSERT INTO data_deliveries (data_id, sink, status, attempts, created_at, updated_at)
+		SELECT id, @sink, 'pending', 0, NOW(), NOW() FROM data
+		WHERE time BETWEEN @from AND @to AND (@vmid = 0 OR (vm_id = @vmid AND cluster = @cluster))
+		ON CONFLICT (data_id, sink) DO UPDATE SET
+			status = 'pending', attempts = 0, error = '', next_attempt_at = NULL, batch_id = '', updated_at = NOW()
+	`
+	result := db.Exec(query, map[string]any{"sink": sink, "from": from, "to": to, "vmid": vm.VMID, "cluster": vm.Cluster})
+	return result.RowsAffected, result.Error
+}
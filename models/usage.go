@@ -0,0 +1,47 @@
+package models
+
+import "gorm.io/gorm"
+
+// SampleInterval is the number of seconds covered by each collected sample.
+// The "hour" RRD timeframe of Proxmox holds one sample per minute, with rates
+// averaged per second.
+const SampleInterval = 60
+
+// Usage summarizes the samples of a VM over a period
+type Usage struct {
+	VMID           int     `json:"vmid"`
+	Samples        int64   `json:"samples"`
+	CPUAvg         float64 `json:"cpu_avg"`
+	CPUMax         float64 `json:"cpu_max"`
+	CPUHours       float64 `json:"cpu_hours"`
+	MemAvg         float64 `json:"mem_avg"`
+	MemMax         float64 `json:"mem_max"`
+	DiskMax        float64 `json:"disk_max"`
+	NetInBytes     float64 `json:"netin_bytes"`
+	NetOutBytes    float64 `json:"netout_bytes"`
+	DiskReadBytes  float64 `json:"diskread_bytes"`
+	DiskWriteBytes float64 `json:"diskwrite_bytes"`
+}
+
+// SummarizeUsage aggregates the samples selected by the query per VM
+func SummarizeUsage(query *gorm.DB) ([]Usage, error) {
+	var usage []Usage
+	err := query.Model(&Data{}).
+		Select(`vm_id,
+			count(*) AS samples,
+			coalesce(avg(cpu), 0) AS cpu_avg,
+			coalesce(max(cpu), 0) AS cpu_max,
+			coalesce(sum(cpu * max_cpu), 0) * ? / 3600 AS cpu_hours,
+			coalesce(avg(mem), 0) AS mem_avg,
+			coalesce(max(mem), 0) AS mem_max,
+			coalesce(max(disk), 0) AS disk_max,
+			coalesce(sum(net_in), 0) * ? AS net_in_bytes,
+			coalesce(sum(net_out), 0) * ? AS net_out_bytes,
+			coalesce(sum(disk_read), 0) * ? AS disk_read_bytes,
+			coalesce(sum(disk_write), 0) * ? AS disk_write_bytes`,
+			SampleInterval, SampleInterval, SampleInterval, SampleInterval, SampleInterval).
+		Group("vm_id").
+		Order("vm_id").
+		Scan(&usage).Error
+	return usage, err
+}
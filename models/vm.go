@@ -1,11 +1,95 @@
 package models
 
+import "strconv"
+
 type VM struct {
 	VMID   int    `json:"vmid"`
 	Name   string `json:"name"`
 	Status string `json:"status"`
 }
 
+// VMKey identifies a VM among the edge sites and their Proxmox clusters, the
+// VMIDs of two clusters may collide. SiteID is 0 for the VMs collected locally.
+type VMKey struct {
+	SiteID  uint
+	Cluster string
+	VMID    int
+}
+
+// NewVMKey returns the key of a VM of the site, nil for the local collector
+func NewVMKey(siteID *uint, cluster string, vmid int) VMKey {
+	return VMKey{SiteID: siteKey(siteID), Cluster: cluster, VMID: vmid}
+}
+
+// siteKey returns the ID of the site, 0 for the local collector
+func siteKey(siteID *uint) uint {
+	if siteID == nil {
+		return 0
+	}
+	return *siteID
+}
+
+// Site returns the site of the VM, nil for the local collector
+func (k VMKey) Site() *uint {
+	if k.SiteID == 0 {
+		return nil
+	}
+	siteID := k.SiteID
+	return &siteID
+}
+
+// Matches reports whether the key is the VM of a record naming it by site,
+// cluster and VMID. An empty cluster matches the VMID on every cluster of the
+// site, as recorded before the clusters were told apart.
+func (k VMKey) Matches(siteID *uint, cluster string, vmid int) bool {
+	return k.VMID == vmid && k.SiteID == siteKey(siteID) && (cluster == "" || cluster == k.Cluster)
+}
+
+// Less orders the keys by site, cluster and VMID
+func (k VMKey) Less(other VMKey) bool {
+	if k.SiteID != other.SiteID {
+		return k.SiteID < other.SiteID
+	}
+	if k.Cluster != other.Cluster {
+		return k.Cluster < other.Cluster
+	}
+	return k.VMID < other.VMID
+}
+
+// String names the VM in the messages
+func (k VMKey) String() string {
+	text, _ := k.MarshalText()
+	return string(text)
+}
+
+// MarshalText implements encoding.TextMarshaler, the key is written as
+// site/cluster/vmid, without the site for the local collector and as the bare
+// VMID for the samples without cluster
+func (k VMKey) MarshalText() ([]byte, error) {
+	text := strconv.Itoa(k.VMID)
+	if k.Cluster != "" {
+		text = k.Cluster + "/" + text
+	}
+	if k.SiteID != 0 {
+		text = strconv.FormatUint(uint64(k.SiteID), 10) + "/" + text
+	}
+	return []byte(text), nil
+}
+
+// VMInfo describes where a VM runs, as last seen by the collector
+type VMInfo struct {
+	VMID    int          `json:"vmid"`
+	Name    string       `json:"name"`
+	Cluster string       `json:"cluster"`
+	Node    string       `json:"node"`
+	Type    ResourceType `json:"type"`
+}
+
+// Key returns the key of the VM
+func (i VMInfo) Key() VMKey {
+	return VMKey{Cluster: i.Cluster, VMID: i.VMID}
+}
+
 type ResourceType string
 
 const (
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Kinds of wallet transaction
+const (
+	WalletTopUp = "top_up"
+	// WalletUsage debits the rated usage of a billing cycle, or credits it
+	// back when the usage was rated again lower
+	WalletUsage      = "usage"
+	WalletRefund     = "refund"
+	WalletAdjustment = "adjustment"
+)
+
+// Accounts of the wallet ledger, each customer has its own set of accounts
+const (
+	// AccountWallet is the prepaid balance owed to the customer
+	AccountWallet = "wallet"
+	// AccountCash is the money received from or paid back to the customer
+	AccountCash = "cash"
+	// AccountRevenue is the usage debited from the wallet
+	AccountRevenue = "revenue"
+	// AccountAdjustments is the balance granted or withdrawn manually
+	AccountAdjustments = "adjustments"
+)
+
+// WalletTransaction is a movement of the wallet of a customer, recorded as
+// postings adding up to zero. Amount is credited to the wallet when positive
+// and debited when negative. The IdempotencyKey identifies the request that
+// created it, so a retried request does not move the balance twice. The usage
+// debits cover the billing cycle starting at PeriodStart.
+type WalletTransaction struct {
+	ID             uint            `json:"id" gorm:"primary_key"`
+	CustomerID     uint            `json:"customer_id" gorm:"index;not null"`
+	Kind           string          `json:"kind" gorm:"not null"`
+	IdempotencyKey string          `json:"idempotency_key" gorm:"uniqueIndex;not null"`
+	Description    string          `json:"description"`
+	Amount         float64         `json:"amount"`
+	PeriodStart    *time.Time      `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time      `json:"period_end,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Postings       []WalletPosting `json:"postings,omitempty" gorm:"foreignKey:TransactionID"`
+}
+
+// WalletPosting is one side of a wallet transaction, a debit when Amount is
+// positive and a credit when negative
+type WalletPosting struct {
+	ID            uint      `json:"id" gorm:"primary_key"`
+	TransactionID uint      `json:"transaction_id" gorm:"index;not null"`
+	CustomerID    uint      `json:"customer_id" gorm:"index:idx_wallet_postings_account;not null"`
+	Account       string    `json:"account" gorm:"index:idx_wallet_postings_account;not null"`
+	Amount        float64   `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// WalletBalance returns the balance of the wallet of the customer, what the
+// wallet account owes the customer
+func WalletBalance(db *gorm.DB, customerID uint) (float64, error) {
+	var balance float64
+	err := db.Model(&WalletPosting{}).
+		Where("customer_id = ? AND account = ?", customerID, AccountWallet).
+		Select("COALESCE(-SUM(amount), 0)").
+		Scan(&balance).Error
+	return balance, err
+}
+
+// DebitedUsage returns the usage already debited from the wallet of the
+// customer for the billing cycle starting at periodStart
+func DebitedUsage(db *gorm.DB, customerID uint, periodStart time.Time) (float64, error) {
+	var debited float64
+	err := db.Model(&WalletTransaction{}).
+		Where("customer_id = ? AND kind = ? AND period_start = ?", customerID, WalletUsage, periodStart).
+		Select("COALESCE(-SUM(amount), 0)").
+		Scan(&debited).Error
+	return debited, err
+}
@@ -1,14 +1,34 @@
 package proxmox
 
 import (
+	"billingo/config"
+	"billingo/logging"
 	"billingo/models"
+	"billingo/telemetry"
 	"billingo/utils"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
-func FetchNodes() ([]models.Node, error) {
-	body, err := utils.FetchJSON("/nodes")
+var log = logging.For("proxmox")
+
+// fetch requests the Proxmox API of the cluster recording the call under the
+// endpoint label, which must not contain node names or VM IDs to keep the
+// metric cardinality low
+func fetch(cluster config.ProxmoxCluster, endpoint string, url string) ([]byte, error) {
+	defer telemetry.ObserveDuration(telemetry.ProxmoxRequestDuration.WithLabelValues(cluster.Name, endpoint), time.Now())
+	body, err := utils.FetchJSON(cluster.URL, cluster.Token, url, time.Duration(cluster.TimeoutSeconds)*time.Second)
+	if err != nil {
+		telemetry.ProxmoxRequests.WithLabelValues(cluster.Name, endpoint, "error").Inc()
+		return nil, err
+	}
+	telemetry.ProxmoxRequests.WithLabelValues(cluster.Name, endpoint, "success").Inc()
+	return body, nil
+}
+
+func FetchNodes(cluster config.ProxmoxCluster) ([]models.Node, error) {
+	body, err := fetch(cluster, "nodes", "/nodes")
 	if err != nil {
 		return nil, err
 	}
@@ -23,9 +43,9 @@ func FetchNodes() ([]models.Node, error) {
 	return response.Data, nil
 }
 
-func FetchResources(node string, resourceType models.ResourceType) ([]models.VM, error) {
+func FetchResources(cluster config.ProxmoxCluster, node string, resourceType models.ResourceType) ([]models.VM, error) {
 	url := fmt.Sprintf("/nodes/%s/%s", node, resourceType)
-	body, err := utils.FetchJSON(url)
+	body, err := fetch(cluster, string(resourceType), url)
 	if err != nil {
 		return nil, err
 	}
@@ -39,3 +59,9 @@ func FetchResources(node string, resourceType models.ResourceType) ([]models.VM,
 
 	return response.Data, nil
 }
+
+// Ping checks that the Proxmox API of the cluster is reachable and accepts the token
+func Ping(cluster config.ProxmoxCluster) error {
+	_, err := fetch(cluster, "version", "/version")
+	return err
+}
@@ -1,27 +1,29 @@
 package proxmox
 
 import (
+	"billingo/config"
 	"billingo/models"
-	"billingo/utils"
 	"encoding/json"
 	"fmt"
 	"sync"
 )
 
-func RRDWorker(wg *sync.WaitGroup, node string, resourceType models.ResourceType, vmid int, timeframe string, results chan<- map[int][]models.RRDData) {
+func RRDWorker(wg *sync.WaitGroup, cluster config.ProxmoxCluster, node string, resourceType models.ResourceType, vmid int, timeframe string, results chan<- map[int][]models.RRDData) {
 	defer wg.Done()
 
-	data, err := fetchRRDData(node, resourceType, vmid, timeframe)
+	data, err := FetchRRDData(cluster, node, resourceType, vmid, timeframe)
 	if err != nil {
-		fmt.Printf("Erro ao buscar dados RRD para VMID %d: %v\n", vmid, err)
+		log.WithField("cluster", cluster.Name).WithField("node", node).WithField("vmid", vmid).Errorf("Error fetching RRD data: %v", err)
 		return
 	}
 	results <- map[int][]models.RRDData{vmid: data}
 }
 
-func fetchRRDData(node string, resourceType models.ResourceType, vmid int, timeframe string) ([]models.RRDData, error) {
+// FetchRRDData returns the RRD samples of a VM over the timeframe, one of
+// hour, day, week, month or year back from now
+func FetchRRDData(cluster config.ProxmoxCluster, node string, resourceType models.ResourceType, vmid int, timeframe string) ([]models.RRDData, error) {
 	url := fmt.Sprintf("/nodes/%s/%s/%d/rrddata?timeframe=%s", node, resourceType, vmid, timeframe)
-	body, err := utils.FetchJSON(url)
+	body, err := fetch(cluster, "rrddata", url)
 	if err != nil {
 		return nil, err
 	}
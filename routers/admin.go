@@ -0,0 +1,35 @@
+package routers
+
+import (
+	"billingo/config"
+	"billingo/controllers"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReloadConfig reloads the configuration as on SIGHUP
+// @Summary Reload the configuration
+// @Produce json
+// @Tags Admin
+// @Success 200 {object} object{changed=[]string,restart_required=[]string}
+// @Failure 422 {object} object{error=string}
+// @Router /admin/reload [post]
+func ReloadConfig(c *gin.Context) {
+	manager := c.MustGet("manager").(*controllers.Manager)
+	conf := c.MustGet("config").(*config.Config)
+
+	changed, pending, err := manager.ReloadConfig(conf)
+	if err != nil {
+		// The current configuration is kept
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed, "restart_required": pending})
+}
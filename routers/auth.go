@@ -0,0 +1,132 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/config"
+	"billingo/models"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type tokenRequest struct {
+	APIKey string `json:"api_key" binding:"required"`
+}
+
+// Generate exchanges an API key for an access token
+// @Summary Issue an access token
+// @Accept json
+// @Produce json
+// @Tags Auth
+// @Success 200 {object} object{token=string,expires_at=string}
+// @Failure 400,401 {object} object{error=string}
+// @Router /auth/token [post]
+func Generate(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	var request tokenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	prefix, err := auth.KeyPrefix(request.APIKey)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	var key models.APIKey
+	if err := db.Where("prefix = ?", prefix).First(&key).Error; err != nil || !auth.VerifyKey(request.APIKey, &key) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": auth.ErrInvalidKey.Error()})
+		return
+	}
+	now := time.Now()
+	if !key.IsActive(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "api key is revoked or expired"})
+		return
+	}
+
+	settings := conf.Snapshot()
+	token, expiresAt, err := auth.GenerateToken(settings.SecretKey, &key, time.Duration(settings.TokenTTLMinutes)*time.Minute)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	db.Model(&key).Update("last_used_at", now)
+
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": expiresAt})
+}
+
+// Authentication validates the bearer token of the request and the API key it
+// was issued from, aborting with 401 otherwise. The identity of the caller is
+// set as "principal".
+func Authentication(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	header := c.GetHeader("Authorization")
+	token, found := strings.CutPrefix(header, "Bearer ")
+	if !found || token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+		return
+	}
+
+	claims, err := auth.ParseToken(conf.Snapshot().SecretKey, token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Tokens are short lived, but revoking the key must take effect immediately
+	keyID, err := claims.KeyID()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	var key models.APIKey
+	if err := db.First(&key, keyID).Error; err != nil || !key.IsActive(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "api key is revoked or expired"})
+		return
+	}
+
+	c.Set("principal", &auth.Principal{
+		KeyID:      key.ID,
+		Scopes:     key.ScopeList(),
+		CustomerID: key.CustomerID,
+	})
+	c.Next()
+}
+
+// RequireScope aborts with 403 unless the authenticated token grants the scope
+func RequireScope(scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := c.MustGet("principal").(*auth.Principal)
+		if !principal.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + string(scope)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// MetricsAuthentication authenticates the scrapes of /metrics/vms, with the
+// metrics token of the configuration or else an access token. A scrape with
+// the metrics token is only granted the metrics:read scope.
+func MetricsAuthentication(c *gin.Context) {
+	conf := c.MustGet("config").(*config.Config)
+
+	metricsToken := conf.Snapshot().MetricsToken
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if found && metricsToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) == 1 {
+		c.Set("principal", &auth.Principal{Scopes: []string{string(auth.ScopeReadMetrics)}})
+		c.Next()
+		return
+	}
+	Authentication(c)
+}
@@ -0,0 +1,215 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/config"
+	"billingo/models"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Access requested to a topic by the broker, as sent by the HTTP backend of
+// mosquitto-go-auth
+const (
+	brokerRead      = 1
+	brokerWrite     = 2
+	brokerReadWrite = 3
+	brokerSubscribe = 4
+)
+
+type brokerUserRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	Password string `json:"password" form:"password"`
+	ClientID string `json:"clientid" form:"clientid"`
+}
+
+type brokerACLRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	ClientID string `json:"clientid" form:"clientid"`
+	Topic    string `json:"topic" form:"topic" binding:"required"`
+	Acc      int    `json:"acc" form:"acc" binding:"required"`
+}
+
+// BrokerAuthentication authenticates the broker with the broker token of the
+// configuration, the /broker endpoints are disabled without one
+func BrokerAuthentication(c *gin.Context) {
+	conf := c.MustGet("config").(*config.Config)
+
+	brokerToken := conf.Snapshot().MQTT.Subscriber.BrokerAuthToken
+	if brokerToken == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "broker authentication is disabled"})
+		return
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(brokerToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid broker token"})
+		return
+	}
+	c.Next()
+}
+
+// brokerDenied answers the broker that the client is refused
+func brokerDenied(c *gin.Context, reason string) {
+	c.JSON(http.StatusForbidden, gin.H{"ok": false, "error": reason})
+}
+
+// brokerSite loads the site of the username, nil when there is none
+func brokerSite(db *gorm.DB, username string) (*models.Site, error) {
+	var site models.Site
+	err := db.Where("username = ?", username).First(&site).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+// isCentralClient reports whether the username is the one of the central
+// subscriber, which sends the commands and the acknowledgements to every site
+func isCentralClient(conf config.Config, username string) bool {
+	return conf.MQTT.Subscriber.Username != "" && username == conf.MQTT.Subscriber.Username
+}
+
+// BrokerUser checks the password of a client of the broker: the password
+// generated for a site or the one of the central subscriber
+// @Summary Authenticate a broker client
+// @Accept json
+// @Produce json
+// @Tags Broker
+// @Success 200 {object} object{ok=bool}
+// @Failure 400,403,500 {object} object{ok=bool,error=string}
+// @Router /broker/user [post]
+func BrokerUser(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	var request brokerUserRequest
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	snapshot := conf.Snapshot()
+	if isCentralClient(snapshot, request.Username) {
+		if subtle.ConstantTimeCompare([]byte(request.Password), []byte(snapshot.MQTT.Subscriber.Password)) != 1 {
+			brokerDenied(c, "invalid credentials")
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+		return
+	}
+
+	site, err := brokerSite(db, request.Username)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if site == nil || site.PasswordHash == "" ||
+		subtle.ConstantTimeCompare([]byte(auth.HashKey(request.Password)), []byte(site.PasswordHash)) != 1 {
+		requestLog(c).WithField("username", request.Username).Warn("Refused a broker client with invalid credentials")
+		brokerDenied(c, "invalid credentials")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// BrokerSuperuser grants every topic to the central subscriber only
+// @Summary Check a broker superuser
+// @Accept json
+// @Produce json
+// @Tags Broker
+// @Success 200 {object} object{ok=bool}
+// @Failure 400,403 {object} object{ok=bool,error=string}
+// @Router /broker/superuser [post]
+func BrokerSuperuser(c *gin.Context) {
+	conf := c.MustGet("config").(*config.Config)
+
+	var request brokerUserRequest
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	if !isCentralClient(conf.Snapshot(), request.Username) {
+		brokerDenied(c, "not a superuser")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// BrokerACL checks the access of a site to a topic. A site publishes on its
+// topic, its result topic and the status topic of its collector, and
+// subscribes to its command topic and the acknowledgement topic of its
+// collector. The central subscriber may use every topic.
+// @Summary Check the access of a broker client to a topic
+// @Accept json
+// @Produce json
+// @Tags Broker
+// @Success 200 {object} object{ok=bool}
+// @Failure 400,403,500 {object} object{ok=bool,error=string}
+// @Router /broker/acl [post]
+func BrokerACL(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	var request brokerACLRequest
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"ok": false, "error": err.Error()})
+		return
+	}
+	snapshot := conf.Snapshot()
+	if isCentralClient(snapshot, request.Username) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+		return
+	}
+
+	site, err := brokerSite(db, request.Username)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if site == nil {
+		brokerDenied(c, "unknown client")
+		return
+	}
+	subscriber := snapshot.MQTT.Subscriber
+	clientTopic := func(template string) string {
+		if template == "" || request.ClientID == "" {
+			return ""
+		}
+		return strings.ReplaceAll(template, "{client_id}", request.ClientID)
+	}
+	canRead := func() bool {
+		return (site.CommandTopic != "" && request.Topic == site.CommandTopic) ||
+			(clientTopic(subscriber.SiteAckTopic) != "" && request.Topic == clientTopic(subscriber.SiteAckTopic))
+	}
+	canWrite := func() bool {
+		// A site publishing on a filter may use any topic it matches, not the
+		// filter itself
+		return (!strings.ContainsAny(request.Topic, "+#") && models.MatchTopic(site.Topic, request.Topic)) ||
+			(subscriber.ResultTopic != "" && request.Topic == fmt.Sprintf("%s/%d", subscriber.ResultTopic, site.ID)) ||
+			(clientTopic(subscriber.SiteStatusTopic) != "" && request.Topic == clientTopic(subscriber.SiteStatusTopic))
+	}
+
+	var allowed bool
+	switch request.Acc {
+	case brokerRead, brokerSubscribe:
+		allowed = canRead()
+	case brokerWrite:
+		allowed = canWrite()
+	case brokerReadWrite:
+		allowed = canRead() && canWrite()
+	}
+	if !allowed {
+		requestLog(c).WithField("site", site.Name).Warnf("Refused access %d to topic %s", request.Acc, request.Topic)
+		brokerDenied(c, "topic not allowed")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -0,0 +1,241 @@
+package routers
+
+import (
+	"billingo/billing"
+	"billingo/models"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type customerRequest struct {
+	Name      string `json:"name" binding:"required"`
+	Email     string `json:"email"`
+	PricePlan string `json:"price_plan"`
+	Timezone  string `json:"timezone"`
+	Prepaid   bool   `json:"prepaid"`
+}
+
+type ownershipRequest struct {
+	// SiteID is the edge site of the VM, none for the VMs collected locally
+	SiteID    *uint      `json:"site_id"`
+	Cluster   string     `json:"cluster" binding:"required"`
+	VMID      int        `json:"vmid" binding:"required"`
+	StartTime time.Time  `json:"start_time" binding:"required"`
+	EndTime   *time.Time `json:"end_time"`
+}
+
+type endOwnershipRequest struct {
+	EndTime time.Time `json:"end_time" binding:"required"`
+}
+
+// errVMOwned is returned when assigning a VM owned during the period
+var errVMOwned = errors.New("the VM is already owned during this period")
+
+// checkVMFree returns errVMOwned when the VM is owned during part of the
+// period, open ended for a nil end
+func checkVMFree(tx *gorm.DB, siteID *uint, cluster string, vmid int, from time.Time, to *time.Time) error {
+	var count int64
+	if err := models.OverlappingOwnerships(tx, siteID, cluster, vmid, from, to).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errVMOwned
+	}
+	return nil
+}
+
+// ListCustomers list all customers
+// @Summary List all customers
+// @Produce json
+// @Tags Customers
+// @Success 200 {object} object{items=[]models.Customer}
+// @Failure 500 {object} object{error=string}
+// @Router /customers [get]
+func ListCustomers(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customers []models.Customer
+	if err := db.Order("id").Find(&customers).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": customers})
+}
+
+// CreateCustomer creates a customer
+// @Summary Create a customer
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 201 {object} object{item=models.Customer}
+// @Failure 400,500 {object} object{error=string}
+// @Router /customers [post]
+func CreateCustomer(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request customerRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	customer := models.Customer{Name: request.Name, Email: request.Email, PricePlan: request.PricePlan, Timezone: request.Timezone, Prepaid: request.Prepaid}
+	if _, err := customer.Location(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid timezone: " + err.Error()})
+		return
+	}
+	if err := db.Create(&customer).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": customer})
+}
+
+// ListCustomerVMs list the VM ownerships of a customer
+// @Summary List the VMs of a customer
+// @Produce json
+// @Tags Customers
+// @Success 200 {object} object{items=[]models.VMOwnership}
+// @Failure 404,500 {object} object{error=string}
+// @Router /customers/{id}/vms [get]
+func ListCustomerVMs(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	ownerships, err := models.CustomerOwnerships(db, customer.ID, nil, nil)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": ownerships})
+}
+
+// AssignCustomerVM assigns a VM to a customer from the given start time, the
+// periods already invoiced to the customer cannot change
+// @Summary Assign a VM to a customer
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 201 {object} object{item=models.VMOwnership}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/vms [post]
+func AssignCustomerVM(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var request ownershipRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.EndTime != nil && !request.EndTime.After(request.StartTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be after start_time"})
+		return
+	}
+
+	if request.SiteID != nil {
+		if err := db.First(&models.Site{}, *request.SiteID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "site not found"})
+			return
+		}
+	}
+
+	ownership := models.VMOwnership{
+		CustomerID: customer.ID,
+		SiteID:     request.SiteID,
+		Cluster:    request.Cluster,
+		VMID:       request.VMID,
+		StartTime:  request.StartTime,
+		EndTime:    request.EndTime,
+	}
+	err := billing.ChangeUninvoiced(db, customer.ID, request.StartTime, request.EndTime, func(tx *gorm.DB) error {
+		// A VM has a single owner at any time, the customers assigning it
+		// concurrently are serialized on the VM
+		if err := models.LockVM(tx, request.SiteID, request.VMID); err != nil {
+			return err
+		}
+		if err := checkVMFree(tx, request.SiteID, request.Cluster, request.VMID, request.StartTime, request.EndTime); err != nil {
+			return err
+		}
+		return tx.Create(&ownership).Error
+	})
+	switch {
+	case errors.Is(err, errVMOwned), errors.Is(err, billing.ErrPeriodInvoiced):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": ownership})
+}
+
+// EndCustomerVM ends the ownership of a VM by a customer, the periods already
+// invoiced to the customer cannot change
+// @Summary End the ownership of a VM
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 200 {object} object{item=models.VMOwnership}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/vms/{ownership} [patch]
+func EndCustomerVM(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var ownership models.VMOwnership
+	if err := db.Where("customer_id = ?", c.Param("id")).First(&ownership, c.Param("ownership")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ownership not found"})
+		return
+	}
+
+	var request endOwnershipRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.EndTime.After(ownership.StartTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be after start_time"})
+		return
+	}
+
+	// The VM changes hands between the previous and the new end
+	from, to := request.EndTime, ownership.EndTime
+	if to != nil && to.Before(from) {
+		from, to = *to, &request.EndTime
+	}
+	err := billing.ChangeUninvoiced(db, ownership.CustomerID, from, to, func(tx *gorm.DB) error {
+		if err := models.LockVM(tx, ownership.SiteID, ownership.VMID); err != nil {
+			return err
+		}
+		// The VM may be owned by another customer after the previous end
+		if ownership.EndTime != nil && request.EndTime.After(*ownership.EndTime) {
+			if err := checkVMFree(tx, ownership.SiteID, ownership.Cluster, ownership.VMID, *ownership.EndTime, &request.EndTime); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&ownership).Update("end_time", request.EndTime).Error
+	})
+	if errors.Is(err, billing.ErrPeriodInvoiced) || errors.Is(err, errVMOwned) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": ownership})
+}
@@ -26,8 +26,22 @@ func ListData(c *gin.Context) {
 	}
 
 	var data []models.Data
-	query := db.Model(&models.Data{}) //.Where("is_active", true)
-	dataFilter.Filter(query, nil).Order("time DESC").Find(&data)
+	query := dataFilter.Filter(db.Model(&models.Data{})) //.Where("is_active", true)
+
+	// Tenants only see the samples of the period they owned each VM
+	ownerships, isTenant, err := tenantOwnerships(c, db, dataFilter.InitialDatetime, dataFilter.FinalDatetime)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if isTenant {
+		query = filters.TenantScope(query, ownerships)
+	}
+
+	if err := query.Order("time DESC").Find(&data).Error; err != nil {
+		serverError(c, err)
+		return
+	}
 
 	// Set response
 	c.JSON(http.StatusOK, gin.H{"items": data})
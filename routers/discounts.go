@@ -0,0 +1,354 @@
+package routers
+
+import (
+	"billingo/billing"
+	"billingo/models"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type discountRequest struct {
+	CustomerID  *uint      `json:"customer_id"`
+	SiteID      *uint      `json:"site_id"`
+	Cluster     string     `json:"cluster"`
+	VMID        *int       `json:"vmid"`
+	Plan        string     `json:"plan"`
+	Metric      string     `json:"metric"`
+	Description string     `json:"description"`
+	Percent     float64    `json:"percent"`
+	Amount      float64    `json:"amount"`
+	ValidFrom   time.Time  `json:"valid_from" binding:"required"`
+	ValidTo     *time.Time `json:"valid_to"`
+}
+
+type endDiscountRequest struct {
+	ValidTo time.Time `json:"valid_to" binding:"required"`
+}
+
+type couponRequest struct {
+	Code           string     `json:"code" binding:"required"`
+	Description    string     `json:"description"`
+	Plan           string     `json:"plan"`
+	Metric         string     `json:"metric"`
+	Percent        float64    `json:"percent"`
+	Amount         float64    `json:"amount"`
+	DurationDays   int        `json:"duration_days"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxRedemptions int        `json:"max_redemptions"`
+}
+
+type redeemRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type commitmentRequest struct {
+	CustomerID  uint      `json:"customer_id" binding:"required"`
+	Metric      string    `json:"metric" binding:"required"`
+	Quantity    float64   `json:"quantity" binding:"required"`
+	UnitPrice   float64   `json:"unit_price"`
+	Description string    `json:"description"`
+	StartTime   time.Time `json:"start_time" binding:"required"`
+	EndTime     time.Time `json:"end_time" binding:"required"`
+}
+
+// customerExists reports whether the customer exists
+func customerExists(db *gorm.DB, id uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.Customer{}).Where("id = ?", id).Count(&count).Error
+	return count > 0, err
+}
+
+// ListDiscounts list the discounts
+// @Summary List the discounts
+// @Produce json
+// @Tags Discounts
+// @Param customer_id query int false "Customer ID"
+// @Success 200 {object} object{items=[]models.Discount}
+// @Failure 500 {object} object{error=string}
+// @Router /discounts [get]
+func ListDiscounts(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := db.Order("id")
+	if customerID := c.Query("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	var discounts []models.Discount
+	if err := query.Find(&discounts).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": discounts})
+}
+
+// CreateDiscount creates a discount, of every customer when none is given
+// @Summary Create a discount
+// @Accept json
+// @Produce json
+// @Tags Discounts
+// @Success 201 {object} object{item=models.Discount}
+// @Failure 400,500 {object} object{error=string}
+// @Router /discounts [post]
+func CreateDiscount(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request discountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := billing.ValidateDiscount(request.Percent, request.Amount, request.Metric); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.ValidTo != nil && !request.ValidTo.After(request.ValidFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid_to must be after valid_from"})
+		return
+	}
+	if request.CustomerID != nil {
+		exists, err := customerExists(db, *request.CustomerID)
+		if err != nil {
+			serverError(c, err)
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "customer not found"})
+			return
+		}
+	}
+
+	discount := models.Discount{
+		CustomerID:  request.CustomerID,
+		SiteID:      request.SiteID,
+		Cluster:     request.Cluster,
+		VMID:        request.VMID,
+		Plan:        request.Plan,
+		Metric:      request.Metric,
+		Description: request.Description,
+		Percent:     request.Percent,
+		Amount:      request.Amount,
+		ValidFrom:   request.ValidFrom,
+		ValidTo:     request.ValidTo,
+	}
+	if err := db.Create(&discount).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": discount})
+}
+
+// EndDiscount ends a discount, the invoices already issued keep it
+// @Summary End a discount
+// @Accept json
+// @Produce json
+// @Tags Discounts
+// @Success 200 {object} object{item=models.Discount}
+// @Failure 400,404,500 {object} object{error=string}
+// @Router /discounts/{id} [patch]
+func EndDiscount(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var discount models.Discount
+	if err := db.First(&discount, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "discount not found"})
+		return
+	}
+
+	var request endDiscountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.ValidTo.After(discount.ValidFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "valid_to must be after valid_from"})
+		return
+	}
+
+	if err := db.Model(&discount).Update("valid_to", request.ValidTo).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": discount})
+}
+
+// ListCoupons list the coupons
+// @Summary List the coupons
+// @Produce json
+// @Tags Discounts
+// @Success 200 {object} object{items=[]models.Coupon}
+// @Failure 500 {object} object{error=string}
+// @Router /coupons [get]
+func ListCoupons(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var coupons []models.Coupon
+	if err := db.Order("id").Find(&coupons).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": coupons})
+}
+
+// CreateCoupon creates a coupon code
+// @Summary Create a coupon
+// @Accept json
+// @Produce json
+// @Tags Discounts
+// @Success 201 {object} object{item=models.Coupon}
+// @Failure 400,409,500 {object} object{error=string}
+// @Router /coupons [post]
+func CreateCoupon(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request couponRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := billing.ValidateDiscount(request.Percent, request.Amount, request.Metric); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.DurationDays < 0 || request.MaxRedemptions < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration_days and max_redemptions must not be negative"})
+		return
+	}
+
+	coupon := models.Coupon{
+		Code:           strings.TrimSpace(request.Code),
+		Description:    request.Description,
+		Plan:           request.Plan,
+		Metric:         request.Metric,
+		Percent:        request.Percent,
+		Amount:         request.Amount,
+		DurationDays:   request.DurationDays,
+		ExpiresAt:      request.ExpiresAt,
+		MaxRedemptions: request.MaxRedemptions,
+	}
+	var count int64
+	if err := db.Model(&models.Coupon{}).Where("code = ?", coupon.Code).Count(&count).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a coupon with this code already exists"})
+		return
+	}
+	if err := db.Create(&coupon).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": coupon})
+}
+
+// RedeemCustomerCoupon redeems a coupon code for a customer
+// @Summary Redeem a coupon
+// @Accept json
+// @Produce json
+// @Tags Discounts
+// @Success 201 {object} object{item=models.Discount}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/coupons [post]
+func RedeemCustomerCoupon(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var request redeemRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	discount, err := billing.RedeemCoupon(db, customer.ID, request.Code, time.Now())
+	switch {
+	case errors.Is(err, billing.ErrCouponInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, billing.ErrCouponRedeemed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": discount})
+}
+
+// ListCommitments list the committed-use contracts
+// @Summary List the commitments
+// @Produce json
+// @Tags Discounts
+// @Param customer_id query int false "Customer ID"
+// @Success 200 {object} object{items=[]models.Commitment}
+// @Failure 500 {object} object{error=string}
+// @Router /commitments [get]
+func ListCommitments(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := db.Order("id")
+	if customerID := c.Query("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	var commitments []models.Commitment
+	if err := query.Find(&commitments).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": commitments})
+}
+
+// CreateCommitment creates a committed-use contract of a customer
+// @Summary Create a commitment
+// @Accept json
+// @Produce json
+// @Tags Discounts
+// @Success 201 {object} object{item=models.Commitment}
+// @Failure 400,500 {object} object{error=string}
+// @Router /commitments [post]
+func CreateCommitment(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request commitmentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	commitment := models.Commitment{
+		CustomerID:  request.CustomerID,
+		Metric:      request.Metric,
+		Quantity:    request.Quantity,
+		UnitPrice:   request.UnitPrice,
+		Description: request.Description,
+		StartTime:   request.StartTime,
+		EndTime:     request.EndTime,
+	}
+	if err := billing.ValidateCommitment(commitment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	exists, err := customerExists(db, commitment.CustomerID)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "customer not found"})
+		return
+	}
+
+	if err := db.Create(&commitment).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": commitment})
+}
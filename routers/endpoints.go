@@ -1,6 +1,9 @@
 package routers
 
 import (
+	"billingo/auth"
+	"billingo/config"
+
 	limit "github.com/aviddiviner/gin-limit"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -12,13 +15,15 @@ type GinRouter struct {
 }
 
 // Setup api endpoints for tests
-func SetupEndpoints(db *gorm.DB) GinRouter {
+func SetupEndpoints(db *gorm.DB, conf *config.Config) GinRouter {
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
 		c.Set("db", db)
+		c.Set("config", conf)
 		c.Next()
 	})
-	api := r.Use(limit.MaxAllowed(30))
+	r.POST("/auth/token", Generate)
+	api := r.Use(Authentication).Use(limit.MaxAllowed(30))
 	{
 		api = GetEndpoints(api)
 	}
@@ -27,8 +32,63 @@ func SetupEndpoints(db *gorm.DB) GinRouter {
 }
 
 func GetEndpoints(api gin.IRoutes) gin.IRoutes {
-	api.GET("/data", ListData)
-	api.GET("/manager", ListManagerRRDData)
+	api.GET("/data", RequireScope(auth.ScopeReadUsage), ListData)
+	api.GET("/usage", RequireScope(auth.ScopeReadUsage), ListUsage)
+	api.GET("/manager", RequireScope(auth.ScopeReadUsage), ListManagerRRDData)
+
+	api.GET("/customers", RequireScope(auth.ScopeManageCustomers), ListCustomers)
+	api.POST("/customers", RequireScope(auth.ScopeManageCustomers), CreateCustomer)
+	api.GET("/customers/:id/vms", RequireScope(auth.ScopeManageCustomers), ListCustomerVMs)
+	api.POST("/customers/:id/vms", RequireScope(auth.ScopeManageCustomers), AssignCustomerVM)
+	api.PATCH("/customers/:id/vms/:ownership", RequireScope(auth.ScopeManageCustomers), EndCustomerVM)
+	api.GET("/customers/:id/subscriptions", RequireScope(auth.ScopeManageCustomers), ListCustomerSubscriptions)
+	api.POST("/customers/:id/subscriptions", RequireScope(auth.ScopeManageCustomers), CreateCustomerSubscription)
+	api.POST("/customers/:id/subscriptions/change", RequireScope(auth.ScopeManageCustomers), ChangeCustomerPlan)
+	api.PATCH("/customers/:id/subscriptions/:subscription", RequireScope(auth.ScopeManageCustomers), EndCustomerSubscription)
+
+	api.GET("/invoices", RequireScope(auth.ScopeReadInvoices), ListInvoices)
+	api.POST("/invoices", RequireScope(auth.ScopeManageInvoices), CreateInvoice)
+	api.GET("/invoices/:id", RequireScope(auth.ScopeReadInvoices), GetInvoice)
+	api.POST("/invoices/:id/rerate", RequireScope(auth.ScopeManageInvoices), RerateInvoice)
+	api.GET("/reratings", RequireScope(auth.ScopeManageInvoices), ListReratings)
+	api.GET("/reratings/:id", RequireScope(auth.ScopeManageInvoices), GetRerating)
+	api.POST("/reratings/:id/apply", RequireScope(auth.ScopeManageInvoices), ApplyRerating)
+	api.POST("/reratings/:id/discard", RequireScope(auth.ScopeManageInvoices), DiscardRerating)
+	api.GET("/ledger/verify", RequireScope(auth.ScopeManageInvoices), VerifyLedger)
+
+	api.GET("/discounts", RequireScope(auth.ScopeManageInvoices), ListDiscounts)
+	api.POST("/discounts", RequireScope(auth.ScopeManageInvoices), CreateDiscount)
+	api.PATCH("/discounts/:id", RequireScope(auth.ScopeManageInvoices), EndDiscount)
+	api.GET("/coupons", RequireScope(auth.ScopeManageInvoices), ListCoupons)
+	api.POST("/coupons", RequireScope(auth.ScopeManageInvoices), CreateCoupon)
+	api.POST("/customers/:id/coupons", RequireScope(auth.ScopeManageInvoices), RedeemCustomerCoupon)
+	api.GET("/commitments", RequireScope(auth.ScopeManageInvoices), ListCommitments)
+	api.POST("/commitments", RequireScope(auth.ScopeManageInvoices), CreateCommitment)
+
+	api.GET("/customers/:id/wallet", RequireScope(auth.ScopeReadInvoices), GetCustomerWallet)
+	api.GET("/customers/:id/wallet/transactions", RequireScope(auth.ScopeReadInvoices), ListWalletTransactions)
+	api.POST("/customers/:id/wallet/transactions", RequireScope(auth.ScopeManageInvoices), CreateWalletTransaction)
+
+	api.GET("/keys", RequireScope(auth.ScopeAdmin), ListAPIKeys)
+	api.POST("/keys", RequireScope(auth.ScopeAdmin), CreateAPIKey)
+	api.POST("/keys/:id/rotate", RequireScope(auth.ScopeAdmin), RotateAPIKey)
+	api.DELETE("/keys/:id", RequireScope(auth.ScopeAdmin), RevokeAPIKey)
+
+	api.GET("/sites", RequireScope(auth.ScopeAdmin), ListSites)
+	api.POST("/sites", RequireScope(auth.ScopeAdmin), CreateSite)
+	api.GET("/sites/stats", RequireScope(auth.ScopeAdmin), ListSiteStats)
+	api.PATCH("/sites/:id", RequireScope(auth.ScopeAdmin), UpdateSite)
+	api.POST("/sites/:id/password", RequireScope(auth.ScopeAdmin), RotateSitePassword)
+	api.DELETE("/sites/:id", RequireScope(auth.ScopeAdmin), DeleteSite)
+	api.GET("/sites/:id/commands", RequireScope(auth.ScopeAdmin), ListSiteCommands)
+	api.POST("/sites/:id/commands", RequireScope(auth.ScopeAdmin), SendSiteCommand)
+	api.GET("/quarantine", RequireScope(auth.ScopeAdmin), ListQuarantine)
+	api.DELETE("/quarantine/:id", RequireScope(auth.ScopeAdmin), DeleteQuarantined)
+
+	api.GET("/sync/dead", RequireScope(auth.ScopeAdmin), ListDeadDeliveries)
+	api.POST("/sync/dead/requeue", RequireScope(auth.ScopeAdmin), RequeueDeadDeliveries)
+
+	api.POST("/admin/reload", RequireScope(auth.ScopeAdmin), ReloadConfig)
 
 	return api
 }
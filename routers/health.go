@@ -0,0 +1,137 @@
+package routers
+
+import (
+	"billingo/config"
+	"billingo/controllers"
+	"billingo/proxmox"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// checkTimeout bounds each dependency check of the readiness probe
+const checkTimeout = 5 * time.Second
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Healthz reports whether every task is still making progress. It does not
+// check the dependencies, restarting the instance would not fix them.
+// @Summary Liveness probe
+// @Produce json
+// @Tags Health
+// @Success 200 {object} object{status=string,tasks=[]controllers.TaskHealth}
+// @Failure 503 {object} object{status=string,tasks=[]controllers.TaskHealth}
+// @Router /healthz [get]
+func Healthz(c *gin.Context) {
+	manager := c.MustGet("manager").(*controllers.Manager)
+
+	tasks := manager.TasksHealth()
+	status := http.StatusOK
+	for _, task := range tasks {
+		if !task.Alive {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, gin.H{"status": statusText(status), "tasks": tasks})
+}
+
+// Readyz reports whether the instance and its dependencies are able to work
+// @Summary Readiness probe
+// @Produce json
+// @Tags Health
+// @Success 200 {object} object{status=string,checks=object,tasks=[]controllers.TaskHealth}
+// @Failure 503 {object} object{status=string,checks=object,tasks=[]controllers.TaskHealth}
+// @Router /readyz [get]
+func Readyz(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	manager := c.MustGet("manager").(*controllers.Manager)
+	conf := c.MustGet("config").(*config.Config)
+
+	checks := map[string]func(ctx context.Context) error{
+		"postgres": func(ctx context.Context) error {
+			sqlDB, err := db.DB()
+			if err != nil {
+				return err
+			}
+			return sqlDB.PingContext(ctx)
+		},
+		"timescaledb": func(ctx context.Context) error {
+			var version string
+			err := db.WithContext(ctx).Raw("SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'").Scan(&version).Error
+			if err == nil && version == "" {
+				err = errors.New("timescaledb extension is not installed")
+			}
+			return err
+		},
+	}
+	for _, cluster := range conf.Snapshot().Proxmox.Clusters {
+		cluster := cluster
+		checks["proxmox:"+cluster.Name] = func(ctx context.Context) error {
+			return proxmox.Ping(cluster)
+		}
+	}
+
+	results := make(map[string]checkResult, len(checks))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.Request.Context(), checkTimeout)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() { done <- check(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = fmt.Errorf("timed out after %v", checkTimeout)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			results[name] = newCheckResult(err)
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	// MQTT connections and the buffer file are reported by their tasks
+	tasks := manager.TasksHealth()
+	for _, task := range tasks {
+		if !task.Alive || task.Error != "" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, gin.H{"status": statusText(status), "checks": results, "tasks": tasks})
+}
+
+func newCheckResult(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: "failed", Error: err.Error()}
+	}
+	return checkResult{Status: "ok"}
+}
+
+func statusText(status int) string {
+	if status == http.StatusOK {
+		return "ok"
+	}
+	return "unavailable"
+}
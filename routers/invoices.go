@@ -0,0 +1,290 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/billing"
+	"billingo/config"
+	"billingo/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type invoiceRequest struct {
+	CustomerID  uint      `json:"customer_id" binding:"required"`
+	PeriodStart time.Time `json:"period_start" binding:"required"`
+	PeriodEnd   time.Time `json:"period_end" binding:"required"`
+}
+
+// tenantInvoices restricts the invoices to the customer of a tenant
+func tenantInvoices(c *gin.Context, db *gorm.DB) *gorm.DB {
+	principal := c.MustGet("principal").(*auth.Principal)
+	if principal.IsTenant() {
+		return db.Where("customer_id = ?", *principal.CustomerID)
+	}
+	return db
+}
+
+// ListInvoices list the invoices, a tenant only sees its own
+// @Summary List the invoices
+// @Produce json
+// @Tags Invoices
+// @Param customer_id query int false "Customer ID"
+// @Success 200 {object} object{items=[]models.Invoice}
+// @Failure 500 {object} object{error=string}
+// @Router /invoices [get]
+func ListInvoices(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := tenantInvoices(c, db).Order("id")
+	if customerID := c.Query("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	var invoices []models.Invoice
+	if err := query.Find(&invoices).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": invoices})
+}
+
+// GetInvoice returns an invoice with its lines
+// @Summary Get an invoice
+// @Produce json
+// @Tags Invoices
+// @Success 200 {object} object{item=models.Invoice}
+// @Failure 404 {object} object{error=string}
+// @Router /invoices/{id} [get]
+func GetInvoice(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var invoice models.Invoice
+	query := tenantInvoices(c, db).Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id") })
+	if err := query.First(&invoice, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invoice not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": invoice})
+}
+
+// CreateInvoice rates the usage of a customer over a period and issues the invoice
+// @Summary Issue an invoice
+// @Accept json
+// @Produce json
+// @Tags Invoices
+// @Success 201 {object} object{item=models.Invoice}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /invoices [post]
+func CreateInvoice(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	var request invoiceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.PeriodEnd.After(request.PeriodStart) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period_end must be after period_start"})
+		return
+	}
+
+	settings := conf.Snapshot()
+	plans, err := billing.LoadPlans(settings.Billing.PricePlansPath)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	invoice, err := billing.GenerateInvoice(db, plans, settings.Billing.DefaultPlan, request.CustomerID, request.PeriodStart, request.PeriodEnd)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	case errors.Is(err, billing.ErrPeriodInvoiced), errors.Is(err, billing.ErrPrepaidCustomer):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": invoice})
+}
+
+// VerifyLedger re-checks the hash chain of the ledger and the invoice heads
+// @Summary Verify the ledger
+// @Produce json
+// @Tags Invoices
+// @Param customer_id query int false "Only verify the ledger of this customer"
+// @Param samples query bool false "Also verify the digests of the rated samples"
+// @Success 200 {object} billing.LedgerReport
+// @Failure 400,500 {object} object{error=string}
+// @Router /ledger/verify [get]
+func VerifyLedger(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customerID *uint
+	if raw := c.Query("customer_id"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid customer_id"})
+			return
+		}
+		value := uint(id)
+		customerID = &value
+	}
+
+	report, err := billing.VerifyLedger(db, customerID, c.Query("samples") == "true")
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// RerateInvoice rates the period of an invoice again and returns the
+// difference with the invoice, the invoice is unchanged until it is applied
+// @Summary Re-rate an invoice
+// @Produce json
+// @Tags Invoices
+// @Success 201 {object} object{item=models.Rerating}
+// @Failure 404,409,500 {object} object{error=string}
+// @Router /invoices/{id}/rerate [post]
+func RerateInvoice(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invoice not found"})
+		return
+	}
+	settings := conf.Snapshot()
+	plans, err := billing.LoadPlans(settings.Billing.PricePlansPath)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	rerating, err := billing.Rerate(db, plans, settings.Billing.DefaultPlan, uint(id))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "invoice not found"})
+		return
+	case errors.Is(err, billing.ErrInvoiceSuperseded):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": rerating})
+}
+
+// ListReratings list the re-ratings
+// @Summary List the re-ratings
+// @Produce json
+// @Tags Invoices
+// @Param invoice_id query int false "Invoice ID"
+// @Param status query string false "Status"
+// @Success 200 {object} object{items=[]models.Rerating}
+// @Failure 500 {object} object{error=string}
+// @Router /reratings [get]
+func ListReratings(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := db.Order("id")
+	if invoiceID := c.Query("invoice_id"); invoiceID != "" {
+		query = query.Where("invoice_id = ?", invoiceID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var reratings []models.Rerating
+	if err := query.Find(&reratings).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": reratings})
+}
+
+// GetRerating returns a re-rating with the difference of each line
+// @Summary Get a re-rating
+// @Produce json
+// @Tags Invoices
+// @Success 200 {object} object{item=models.Rerating}
+// @Failure 404 {object} object{error=string}
+// @Router /reratings/{id} [get]
+func GetRerating(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var rerating models.Rerating
+	query := db.Preload("Lines", func(db *gorm.DB) *gorm.DB { return db.Order("id") })
+	if err := query.First(&rerating, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "re-rating not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": rerating})
+}
+
+// ApplyRerating supersedes the invoice with one of the re-rated amounts
+// @Summary Apply a re-rating
+// @Produce json
+// @Tags Invoices
+// @Success 201 {object} object{item=models.Invoice}
+// @Failure 404,409,500 {object} object{error=string}
+// @Router /reratings/{id}/apply [post]
+func ApplyRerating(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "re-rating not found"})
+		return
+	}
+	invoice, err := billing.ApplyRerating(db, uint(id))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "re-rating not found"})
+		return
+	case errors.Is(err, billing.ErrReratingClosed), errors.Is(err, billing.ErrPeriodInvoiced):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": invoice})
+}
+
+// DiscardRerating closes a re-rating without changing the invoice
+// @Summary Discard a re-rating
+// @Produce json
+// @Tags Invoices
+// @Success 200 {object} object{item=models.Rerating}
+// @Failure 404,409,500 {object} object{error=string}
+// @Router /reratings/{id}/discard [post]
+func DiscardRerating(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "re-rating not found"})
+		return
+	}
+	rerating, err := billing.DiscardRerating(db, uint(id))
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "re-rating not found"})
+		return
+	case errors.Is(err, billing.ErrReratingClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": rerating})
+}
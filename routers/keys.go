@@ -0,0 +1,142 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type apiKeyRequest struct {
+	Name       string     `json:"name" binding:"required"`
+	Scopes     string     `json:"scopes" binding:"required"`
+	CustomerID *uint      `json:"customer_id"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type rotateRequest struct {
+	// GraceMinutes keeps the old key valid for a while so clients can switch
+	// over, at most a week and never past its own expiry
+	GraceMinutes int `json:"grace_minutes" binding:"min=0,max=10080"`
+}
+
+// ListAPIKeys list all API keys
+// @Summary List all API keys
+// @Produce json
+// @Tags Auth
+// @Success 200 {object} object{items=[]models.APIKey}
+// @Failure 500 {object} object{error=string}
+// @Router /keys [get]
+func ListAPIKeys(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var keys []models.APIKey
+	if err := db.Order("id").Find(&keys).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": keys})
+}
+
+// CreateAPIKey creates a new API key
+// @Summary Create an API key
+// @Accept json
+// @Produce json
+// @Tags Auth
+// @Success 201 {object} object{item=models.APIKey,api_key=string}
+// @Failure 400,500 {object} object{error=string}
+// @Router /keys [post]
+func CreateAPIKey(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request apiKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, plain, err := auth.CreateKey(db, request.Name, request.Scopes, request.CustomerID, request.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": key, "api_key": plain})
+}
+
+// RotateAPIKey replaces a key by a new one with the same name and scopes
+// @Summary Rotate an API key
+// @Accept json
+// @Produce json
+// @Tags Auth
+// @Success 201 {object} object{item=models.APIKey,api_key=string}
+// @Failure 400,404,500 {object} object{error=string}
+// @Router /keys/{id}/rotate [post]
+func RotateAPIKey(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request rotateRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var old models.APIKey
+	if err := db.First(&old, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if !old.IsActive(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "api key is revoked or expired"})
+		return
+	}
+
+	var key *models.APIKey
+	var plain string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		key, plain, err = auth.CreateKey(tx, old.Name, old.Scopes, old.CustomerID, old.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		expiresAt := time.Now().Add(time.Duration(request.GraceMinutes) * time.Minute)
+		if old.ExpiresAt != nil && old.ExpiresAt.Before(expiresAt) {
+			expiresAt = *old.ExpiresAt
+		}
+		return tx.Model(&old).Updates(models.APIKey{ExpiresAt: &expiresAt, RotatedToID: &key.ID}).Error
+	})
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": key, "api_key": plain})
+}
+
+// RevokeAPIKey revokes a key, invalidating every token issued from it
+// @Summary Revoke an API key
+// @Produce json
+// @Tags Auth
+// @Success 200 {object} object{item=models.APIKey}
+// @Failure 404,500 {object} object{error=string}
+// @Router /keys/{id} [delete]
+func RevokeAPIKey(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var key models.APIKey
+	if err := db.First(&key, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	if key.RevokedAt == nil {
+		now := time.Now()
+		if err := db.Model(&key).Update("revoked_at", now).Error; err != nil {
+			serverError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"item": key})
+}
@@ -0,0 +1,76 @@
+package routers
+
+import (
+	"billingo/logging"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.For("api")
+
+// validRequestID limits the request IDs accepted from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestLogger assigns an ID to every request, reusing the X-Request-ID header
+// sent by the client if any, and logs the request once it is served. The logger
+// carrying the ID is set as "logger".
+func RequestLogger(c *gin.Context) {
+	requestID := c.GetHeader("X-Request-ID")
+	if !validRequestID.MatchString(requestID) {
+		requestID = newRequestID()
+	}
+	c.Header("X-Request-ID", requestID)
+
+	entry := log.WithField("request_id", requestID)
+	c.Set("logger", entry)
+
+	start := time.Now()
+	c.Next()
+
+	entry = entry.WithFields(logrus.Fields{
+		"method":      c.Request.Method,
+		"path":        c.Request.URL.Path,
+		"status":      c.Writer.Status(),
+		"duration_ms": time.Since(start).Milliseconds(),
+		"client_ip":   c.ClientIP(),
+	})
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("errors", c.Errors.String())
+	}
+	if c.Writer.Status() >= 500 {
+		entry.Error("Request served")
+	} else {
+		entry.Info("Request served")
+	}
+}
+
+// requestLog returns the logger of the request
+func requestLog(c *gin.Context) *logrus.Entry {
+	if entry, exists := c.Get("logger"); exists {
+		return entry.(*logrus.Entry)
+	}
+	return log
+}
+
+// serverError logs the error of the request with its ID and responds with 500.
+// The error may name tables, hosts or files, the client only gets the request
+// ID to find it in the logs.
+func serverError(c *gin.Context, err error) {
+	requestLog(c).WithField("route", c.FullPath()).Errorf("Request failed: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":      "internal server error",
+		"request_id": c.Writer.Header().Get("X-Request-ID"),
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -2,16 +2,39 @@ package routers
 
 import (
 	"billingo/controllers"
+	"billingo/models"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func ListManagerRRDData(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
 	manager := c.MustGet("manager").(*controllers.Manager)
 
 	// Retrieve all vmRRDData from the manager
 	vmData := manager.GetAllVMData()
 
+	// Tenants only see the VMs they currently own
+	now := time.Now()
+	ownerships, isTenant, err := tenantOwnerships(c, db, &now, &now)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if isTenant {
+		owned := make(map[models.VMKey]models.RRDData)
+		for _, ownership := range ownerships {
+			for key, data := range vmData {
+				if ownership.Owns(key) {
+					owned[key] = data
+				}
+			}
+		}
+		vmData = owned
+	}
+
 	// Return the data as JSON
 	c.JSON(200, vmData)
 }
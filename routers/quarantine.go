@@ -0,0 +1,60 @@
+package routers
+
+import (
+	"billingo/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ListQuarantine list the messages quarantined by the subscriber, the latest
+// first, optionally of a single site
+// @Summary List the quarantined messages
+// @Produce json
+// @Tags Sites
+// @Param site_id query int false "site of the messages"
+// @Success 200 {object} object{items=[]models.QuarantinedMessage,total=int}
+// @Failure 500 {object} object{error=string}
+// @Router /quarantine [get]
+func ListQuarantine(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	query := db.Model(&models.QuarantinedMessage{})
+	if siteID := c.Query("site_id"); siteID != "" {
+		query = query.Where("site_id = ?", siteID)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	var messages []models.QuarantinedMessage
+	if err := query.Order("id DESC").Limit(1000).Find(&messages).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": messages, "total": total})
+}
+
+// DeleteQuarantined discards a quarantined message
+// @Summary Discard a quarantined message
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{item=models.QuarantinedMessage}
+// @Failure 404,500 {object} object{error=string}
+// @Router /quarantine/{id} [delete]
+func DeleteQuarantined(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var message models.QuarantinedMessage
+	if err := db.First(&message, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quarantined message not found"})
+		return
+	}
+	if err := db.Delete(&message).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": message})
+}
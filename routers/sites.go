@@ -0,0 +1,369 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/controllers"
+	"billingo/models"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type siteRequest struct {
+	Name         string `json:"name" binding:"required"`
+	DisplayName  string `json:"display_name"`
+	Topic        string `json:"topic" binding:"required"`
+	Cluster      string `json:"cluster"`
+	CommandTopic string `json:"command_topic"`
+	PublicKey    string `json:"public_key"`
+	Username     string `json:"username" binding:"required"`
+	ResellerID   *uint  `json:"reseller_id"`
+}
+
+type updateSiteRequest struct {
+	DisplayName  *string `json:"display_name"`
+	Topic        *string `json:"topic"`
+	CommandTopic *string `json:"command_topic"`
+	PublicKey    *string `json:"public_key"`
+	Cluster      *string `json:"cluster"`
+	ResellerID   *uint   `json:"reseller_id"`
+}
+
+type commandRequest struct {
+	Type    string `json:"type" binding:"required"`
+	From    int64  `json:"from"`
+	To      int64  `json:"to"`
+	Cluster string `json:"cluster"`
+	VMID    int    `json:"vmid"`
+}
+
+// ListSites list all edge sites
+// @Summary List all edge sites
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{items=[]models.Site}
+// @Failure 500 {object} object{error=string}
+// @Router /sites [get]
+func ListSites(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var sites []models.Site
+	if err := db.Order("id").Find(&sites).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": sites})
+}
+
+// CreateSite registers an edge site along the broker password of the site
+// @Summary Register an edge site
+// @Accept json
+// @Produce json
+// @Tags Sites
+// @Success 201 {object} object{item=models.Site,password=string}
+// @Failure 400,409,500 {object} object{error=string}
+// @Router /sites [post]
+func CreateSite(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request siteRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.ValidTopicFilter(request.Topic) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic is not a valid MQTT topic"})
+		return
+	}
+	if request.PublicKey != "" {
+		if _, err := models.ParsePublicKey(request.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "public_key: " + err.Error()})
+			return
+		}
+	}
+	if !resellerExists(c, db, request.ResellerID) {
+		return
+	}
+
+	var count int64
+	err := db.Model(&models.Site{}).
+		Where("name = ? OR topic = ? OR username = ?", request.Name, request.Topic, request.Username).
+		Count(&count).Error
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a site with this name, topic or username already exists"})
+		return
+	}
+
+	plain, hash, err := auth.NewSitePassword()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	site := models.Site{
+		Name:         request.Name,
+		DisplayName:  request.DisplayName,
+		Topic:        request.Topic,
+		Cluster:      request.Cluster,
+		CommandTopic: request.CommandTopic,
+		PublicKey:    request.PublicKey,
+		Username:     request.Username,
+		PasswordHash: hash,
+		ResellerID:   request.ResellerID,
+	}
+	if err := db.Create(&site).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": site, "password": plain})
+}
+
+// UpdateSite updates the display name, topics, public key, cluster or reseller of a site
+// @Summary Update an edge site
+// @Accept json
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{item=models.Site}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /sites/{id} [patch]
+func UpdateSite(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var site models.Site
+	if err := db.First(&site, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "site not found"})
+		return
+	}
+
+	var request updateSiteRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	updates := map[string]interface{}{}
+	if request.DisplayName != nil {
+		updates["display_name"] = *request.DisplayName
+	}
+	if request.Cluster != nil {
+		updates["cluster"] = *request.Cluster
+	}
+	if request.CommandTopic != nil {
+		updates["command_topic"] = *request.CommandTopic
+	}
+	if request.PublicKey != nil {
+		// An empty key accepts unsigned batches again, unless signatures are required
+		if *request.PublicKey != "" {
+			if _, err := models.ParsePublicKey(*request.PublicKey); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "public_key: " + err.Error()})
+				return
+			}
+		}
+		updates["public_key"] = *request.PublicKey
+	}
+	if request.ResellerID != nil {
+		if !resellerExists(c, db, request.ResellerID) {
+			return
+		}
+		updates["reseller_id"] = *request.ResellerID
+	}
+	if request.Topic != nil && *request.Topic != site.Topic {
+		if !models.ValidTopicFilter(*request.Topic) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "topic is not a valid MQTT topic"})
+			return
+		}
+		var count int64
+		if err := db.Model(&models.Site{}).Where("topic = ?", *request.Topic).Count(&count).Error; err != nil {
+			serverError(c, err)
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "the topic is registered to another site"})
+			return
+		}
+		updates["topic"] = *request.Topic
+	}
+
+	if len(updates) > 0 {
+		if err := db.Model(&site).Updates(updates).Error; err != nil {
+			serverError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"item": site})
+}
+
+// RotateSitePassword replaces the broker password of a site
+// @Summary Rotate the broker password of an edge site
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{item=models.Site,password=string}
+// @Failure 404,500 {object} object{error=string}
+// @Router /sites/{id}/password [post]
+func RotateSitePassword(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var site models.Site
+	if err := db.First(&site, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "site not found"})
+		return
+	}
+	plain, hash, err := auth.NewSitePassword()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if err := db.Model(&site).Update("password_hash", hash).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": site, "password": plain})
+}
+
+// DeleteSite removes a site, the messages of its topic are rejected from then
+// on. The samples already received keep their site ID.
+// @Summary Remove an edge site
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{item=models.Site}
+// @Failure 404,500 {object} object{error=string}
+// @Router /sites/{id} [delete]
+func DeleteSite(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var site models.Site
+	if err := db.First(&site, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "site not found"})
+		return
+	}
+	if err := db.Delete(&site).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": site})
+}
+
+// ListSiteStats returns the reception rate of the sites over the last hour
+// @Summary List the reception rate of the edge sites
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{items=[]models.SiteStats}
+// @Failure 500 {object} object{error=string}
+// @Router /sites/stats [get]
+func ListSiteStats(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	stats, err := models.CountSiteSamples(db, time.Now())
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": stats})
+}
+
+// ListSiteCommands list the commands sent to a site, the latest first
+// @Summary List the commands sent to an edge site
+// @Produce json
+// @Tags Sites
+// @Success 200 {object} object{items=[]models.SiteCommand}
+// @Failure 500 {object} object{error=string}
+// @Router /sites/{id}/commands [get]
+func ListSiteCommands(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var commands []models.SiteCommand
+	if err := db.Where("site_id = ?", c.Param("id")).Order("created_at DESC").Limit(100).Find(&commands).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": commands})
+}
+
+// SendSiteCommand sends a command to the collector of a site, its result is
+// recorded once the collector publishes it
+// @Summary Send a command to an edge site
+// @Accept json
+// @Produce json
+// @Tags Sites
+// @Success 202 {object} object{item=models.SiteCommand}
+// @Failure 400,404,500,503 {object} object{error=string}
+// @Router /sites/{id}/commands [post]
+func SendSiteCommand(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	manager := c.MustGet("manager").(*controllers.Manager)
+
+	var site models.Site
+	if err := db.First(&site, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "site not found"})
+		return
+	}
+
+	var request commandRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !slices.Contains(models.CommandTypes, request.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown command type"})
+		return
+	}
+
+	id, err := models.NewCommandID()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	command := models.SiteCommand{
+		ID:      id,
+		SiteID:  site.ID,
+		Type:    request.Type,
+		From:    request.From,
+		To:      request.To,
+		Cluster: request.Cluster,
+		VMID:    request.VMID,
+		Status:  models.CommandSent,
+	}
+	// Saved first, the result may arrive before the publication returns
+	if err := db.Create(&command).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+
+	err = manager.SendCommand(site, &models.Command{
+		ID:      command.ID,
+		Type:    command.Type,
+		From:    command.From,
+		To:      command.To,
+		Cluster: command.Cluster,
+		VMID:    command.VMID,
+	})
+	if err != nil {
+		now := time.Now()
+		db.Model(&command).Updates(map[string]interface{}{"status": models.CommandFailed, "message": err.Error(), "completed_at": now})
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, controllers.ErrNoCommandSender) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"item": command})
+}
+
+// resellerExists checks the reseller of a site exists, responding otherwise
+func resellerExists(c *gin.Context, db *gorm.DB, resellerID *uint) bool {
+	if resellerID == nil {
+		return true
+	}
+	if err := db.First(&models.Customer{}, *resellerID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reseller not found"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,362 @@
+package routers
+
+import (
+	"billingo/billing"
+	"billingo/config"
+	"billingo/models"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type subscriptionRequest struct {
+	Plan      string     `json:"plan" binding:"required"`
+	SiteID    *uint      `json:"site_id"`
+	Cluster   string     `json:"cluster"`
+	VMID      *int       `json:"vmid"`
+	StartTime time.Time  `json:"start_time" binding:"required"`
+	EndTime   *time.Time `json:"end_time"`
+}
+
+type planChangeRequest struct {
+	Plan    string    `json:"plan" binding:"required"`
+	SiteID  *uint     `json:"site_id"`
+	Cluster string    `json:"cluster"`
+	VMID    *int      `json:"vmid"`
+	At      time.Time `json:"at" binding:"required"`
+}
+
+type endSubscriptionRequest struct {
+	EndTime time.Time `json:"end_time" binding:"required"`
+}
+
+// errPlanNotFound is returned for a subscription to a plan missing from the plans file
+var errPlanNotFound = errors.New("price plan not found")
+
+// errChangeAtStart is returned for a plan change at the start of the subscription
+var errChangeAtStart = errors.New("the plan changes at the start of the subscription, end it and subscribe again")
+
+// checkPlan checks that the plan exists in the price plans file
+func checkPlan(c *gin.Context, name string) error {
+	conf := c.MustGet("config").(*config.Config)
+	plans, err := billing.LoadPlans(conf.Snapshot().Billing.PricePlansPath)
+	if err != nil {
+		return err
+	}
+	if _, exists := plans[name]; !exists {
+		return errPlanNotFound
+	}
+	return nil
+}
+
+// errSubscriptionOverlap is returned for a subscription overlapping another one
+// of the customer or of its VM
+var errSubscriptionOverlap = errors.New("a subscription already covers this period, change the plan instead")
+
+// errVMNotOwned is returned for a subscription of a VM the customer does not own
+var errVMNotOwned = errors.New("the customer does not own the VM during this period")
+
+// onTheHour reports whether the time falls on the hour, the usage is rated by
+// hour so the subscriptions change plan on the hour
+func onTheHour(at time.Time) bool {
+	return at.Truncate(time.Hour).Equal(at)
+}
+
+// checkVMOwned returns errVMNotOwned unless the customer owns the VM during
+// part of the period, open ended for a nil end. A nil VM is the customer itself.
+func checkVMOwned(db *gorm.DB, customerID uint, siteID *uint, cluster string, vmid *int, from time.Time, to *time.Time) error {
+	if vmid == nil {
+		return nil
+	}
+	var count int64
+	err := models.OverlappingOwnerships(db, siteID, cluster, *vmid, from, to).
+		Where("customer_id = ?", customerID).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errVMNotOwned
+	}
+	return nil
+}
+
+// subscriptionScope selects the subscriptions of a VM of the customer, on
+// its site and cluster, or of the customer itself for a nil VM
+func subscriptionScope(db *gorm.DB, customerID uint, siteID *uint, cluster string, vmid *int) *gorm.DB {
+	query := db.Model(&models.Subscription{}).Where("customer_id = ?", customerID)
+	if vmid == nil {
+		return query.Where("vm_id IS NULL")
+	}
+	return models.SiteScope(query, siteID).Where("cluster = ? AND vm_id = ?", cluster, *vmid)
+}
+
+// overlappingSubscriptions selects the subscriptions of the customer, or of
+// its VM, overlapping the period, open ended for a nil end. An empty cluster
+// matches every cluster, as for the usage of the VM.
+func overlappingSubscriptions(db *gorm.DB, customerID uint, siteID *uint, cluster string, vmid *int, from time.Time, to *time.Time) *gorm.DB {
+	query := db.Model(&models.Subscription{}).Where("customer_id = ?", customerID)
+	if vmid == nil {
+		query = query.Where("vm_id IS NULL")
+	} else {
+		query = models.SiteScope(query, siteID).
+			Where("vm_id = ? AND (cluster = ? OR cluster = '' OR ? = '')", *vmid, cluster, cluster)
+	}
+	query = query.Where("end_time IS NULL OR end_time > ?", from)
+	if to != nil {
+		query = query.Where("start_time < ?", *to)
+	}
+	return query
+}
+
+// changePlan ends the previous subscription at the given time and creates the
+// next one on the plan, until the previous would have ended
+func changePlan(tx *gorm.DB, previous *models.Subscription, plan string, at time.Time) (models.Subscription, error) {
+	next := models.Subscription{
+		CustomerID: previous.CustomerID,
+		SiteID:     previous.SiteID,
+		Cluster:    previous.Cluster,
+		VMID:       previous.VMID,
+		Plan:       plan,
+		StartTime:  at,
+	}
+	// The update sets the end of the previous subscription in place, the next
+	// one keeps its own copy
+	if previous.EndTime != nil {
+		end := *previous.EndTime
+		next.EndTime = &end
+	}
+	if err := tx.Model(previous).Update("end_time", at).Error; err != nil {
+		return next, err
+	}
+	return next, tx.Create(&next).Error
+}
+
+// ListCustomerSubscriptions list the plan subscriptions of a customer
+// @Summary List the subscriptions of a customer
+// @Produce json
+// @Tags Customers
+// @Success 200 {object} object{items=[]models.Subscription}
+// @Failure 404,500 {object} object{error=string}
+// @Router /customers/{id}/subscriptions [get]
+func ListCustomerSubscriptions(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var subscriptions []models.Subscription
+	err := db.Where("customer_id = ?", customer.ID).Order("vm_id NULLS FIRST, start_time").Find(&subscriptions).Error
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": subscriptions})
+}
+
+// CreateCustomerSubscription subscribes a customer, or one of its VMs, to a plan
+// @Summary Subscribe a customer to a plan
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 201 {object} object{item=models.Subscription}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/subscriptions [post]
+func CreateCustomerSubscription(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var request subscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.EndTime != nil && !request.EndTime.After(request.StartTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be after start_time"})
+		return
+	}
+	if !onTheHour(request.StartTime) || (request.EndTime != nil && !onTheHour(*request.EndTime)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_time and end_time must be on the hour"})
+		return
+	}
+	if err := checkPlan(c, request.Plan); errors.Is(err, errPlanNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	subscription := models.Subscription{
+		CustomerID: customer.ID,
+		SiteID:     request.SiteID,
+		Cluster:    request.Cluster,
+		VMID:       request.VMID,
+		Plan:       request.Plan,
+		StartTime:  request.StartTime,
+		EndTime:    request.EndTime,
+	}
+	err := billing.ChangeUninvoiced(db, customer.ID, request.StartTime, request.EndTime, func(tx *gorm.DB) error {
+		if err := checkVMOwned(tx, customer.ID, request.SiteID, request.Cluster, request.VMID, request.StartTime, request.EndTime); err != nil {
+			return err
+		}
+		// A customer or a VM has a single plan at any time
+		var count int64
+		err := overlappingSubscriptions(tx, customer.ID, request.SiteID, request.Cluster, request.VMID, request.StartTime, request.EndTime).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errSubscriptionOverlap
+		}
+		return tx.Create(&subscription).Error
+	})
+	switch {
+	case errors.Is(err, errVMNotOwned):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errSubscriptionOverlap), errors.Is(err, billing.ErrPeriodInvoiced):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"item": subscription})
+}
+
+// ChangeCustomerPlan switches the plan of a customer, or one of its VMs, at
+// the given time. The current subscription ends and the new one continues
+// until it would have ended.
+// @Summary Change the plan of a customer
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 201 {object} object{previous=models.Subscription,item=models.Subscription}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/subscriptions/change [post]
+func ChangeCustomerPlan(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var request planChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !onTheHour(request.At) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at must be on the hour"})
+		return
+	}
+	if err := checkPlan(c, request.Plan); errors.Is(err, errPlanNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	// The plan changes from the given time on, until the current subscription
+	// would have ended
+	var previous, next models.Subscription
+	err := billing.ChangeUninvoiced(db, customer.ID, request.At, nil, func(tx *gorm.DB) error {
+		err := subscriptionScope(tx, customer.ID, request.SiteID, request.Cluster, request.VMID).
+			Where("start_time <= ? AND (end_time IS NULL OR end_time > ?)", request.At, request.At).
+			First(&previous).Error
+		if err != nil {
+			return err
+		}
+		if !request.At.After(previous.StartTime) {
+			return errChangeAtStart
+		}
+		if err := checkVMOwned(tx, customer.ID, request.SiteID, request.Cluster, request.VMID, request.At, previous.EndTime); err != nil {
+			return err
+		}
+		next, err = changePlan(tx, &previous, request.Plan, request.At)
+		return err
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no subscription is active at this time"})
+		return
+	}
+	if errors.Is(err, errChangeAtStart) || errors.Is(err, errVMNotOwned) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, billing.ErrPeriodInvoiced) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"previous": previous, "item": next})
+}
+
+// EndCustomerSubscription ends a subscription of a customer
+// @Summary End a subscription
+// @Accept json
+// @Produce json
+// @Tags Customers
+// @Success 200 {object} object{item=models.Subscription}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/subscriptions/{subscription} [patch]
+func EndCustomerSubscription(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var subscription models.Subscription
+	if err := db.Where("customer_id = ?", c.Param("id")).First(&subscription, c.Param("subscription")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		return
+	}
+
+	var request endSubscriptionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.EndTime.After(subscription.StartTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be after start_time"})
+		return
+	}
+	if !onTheHour(request.EndTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end_time must be on the hour"})
+		return
+	}
+	if subscription.EndTime != nil && request.EndTime.After(*subscription.EndTime) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a subscription can only end earlier"})
+		return
+	}
+
+	// The plan no longer applies between the new and the previous end
+	err := billing.ChangeUninvoiced(db, subscription.CustomerID, request.EndTime, subscription.EndTime, func(tx *gorm.DB) error {
+		return tx.Model(&subscription).Update("end_time", request.EndTime).Error
+	})
+	if errors.Is(err, billing.ErrPeriodInvoiced) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": subscription})
+}
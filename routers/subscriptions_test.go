@@ -0,0 +1,56 @@
+package routers
+
+import (
+	"billingo/models"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestChangePlanKeepsTheEnd(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	vmid := 100
+	tests := []struct {
+		name    string
+		endTime *time.Time
+	}{
+		{"open ended", nil},
+		{"with an end", &end},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := models.Subscription{CustomerID: 1, Cluster: "pve", VMID: &vmid, Plan: "basic", StartTime: start}
+			previous.ID = 1
+			if test.endTime != nil {
+				previousEnd := *test.endTime
+				previous.EndTime = &previousEnd
+			}
+
+			next, err := changePlan(db, &previous, "pro", at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if previous.EndTime == nil || !previous.EndTime.Equal(at) {
+				t.Errorf("previous ends at %v, want %v", previous.EndTime, at)
+			}
+			if !next.StartTime.Equal(at) || next.Plan != "pro" || next.Cluster != "pve" || next.VMID != &vmid {
+				t.Errorf("next is %+v", next)
+			}
+			switch {
+			case test.endTime == nil && next.EndTime != nil:
+				t.Errorf("next ends at %v, want no end", *next.EndTime)
+			case test.endTime != nil && (next.EndTime == nil || !next.EndTime.Equal(*test.endTime)):
+				t.Errorf("next ends at %v, want %v", next.EndTime, *test.endTime)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package routers
+
+import (
+	"billingo/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// deadLetterLimit bounds the deliveries listed at once, the dead letter may be large
+const deadLetterLimit = 1000
+
+type requeueRequest struct {
+	// Sink restricts the requeue to a sink, every sink when empty
+	Sink string `json:"sink"`
+	// IDs are the data rows to requeue, every dead row when empty
+	IDs []uint `json:"ids"`
+}
+
+// ListDeadDeliveries lists the deliveries that ran out of attempts
+// @Summary List the dead deliveries
+// @Produce json
+// @Tags Sync
+// @Param sink query string false "Sink of the deliveries"
+// @Success 200 {object} object{items=[]models.DataDelivery,total=int}
+// @Failure 500 {object} object{error=string}
+// @Router /sync/dead [get]
+func ListDeadDeliveries(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	query := models.DeadDeliveries(db, c.Query("sink"))
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	var deliveries []models.DataDelivery
+	if err := query.Order("data_id, sink").Limit(deadLetterLimit).Find(&deliveries).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": deliveries, "total": total})
+}
+
+// RequeueDeadDeliveries makes dead deliveries pending again, with their attempts reset
+// @Summary Requeue the dead deliveries
+// @Accept json
+// @Produce json
+// @Tags Sync
+// @Success 200 {object} object{requeued=int}
+// @Failure 400,500 {object} object{error=string}
+// @Router /sync/dead/requeue [post]
+func RequeueDeadDeliveries(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var request requeueRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	requeued, err := models.RequeueDead(db, request.Sink, request.IDs)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": requeued})
+}
@@ -0,0 +1,22 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// tenantOwnerships returns the VM ownerships of the tenant behind the request
+// overlapping the given period. The boolean is false when the principal is not
+// a tenant and may see every VM.
+func tenantOwnerships(c *gin.Context, db *gorm.DB, from, to *time.Time) ([]models.VMOwnership, bool, error) {
+	principal := c.MustGet("principal").(*auth.Principal)
+	if !principal.IsTenant() {
+		return nil, false, nil
+	}
+	ownerships, err := models.CustomerOwnerships(db, *principal.CustomerID, from, to)
+	return ownerships, true, err
+}
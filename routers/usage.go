@@ -0,0 +1,44 @@
+package routers
+
+import (
+	"billingo/filters"
+	"billingo/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ListUsage summarizes the usage of each VM over a period
+// @Summary Summarize the usage per VM
+// @Produce json
+// @Tags Servers
+// @Success 200 {object} object{items=[]models.Usage}
+// @Failure 400,500 {object} object{error=string}
+// @Router /usage [get]
+func ListUsage(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	var dataFilter filters.DataFilter
+	if err := c.ShouldBindQuery(&dataFilter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := dataFilter.Filter(db.Model(&models.Data{}))
+	ownerships, isTenant, err := tenantOwnerships(c, db, dataFilter.InitialDatetime, dataFilter.FinalDatetime)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	if isTenant {
+		query = filters.TenantScope(query, ownerships)
+	}
+
+	usage, err := models.SummarizeUsage(query)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": usage})
+}
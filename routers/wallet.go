@@ -0,0 +1,140 @@
+package routers
+
+import (
+	"billingo/auth"
+	"billingo/billing"
+	"billingo/config"
+	"billingo/models"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type walletRequest struct {
+	Kind           string  `json:"kind" binding:"required"`
+	Amount         float64 `json:"amount" binding:"required"`
+	Description    string  `json:"description"`
+	IdempotencyKey string  `json:"idempotency_key" binding:"required"`
+}
+
+// walletCustomer loads the customer of the wallet, a tenant only reaches its own
+func walletCustomer(c *gin.Context, db *gorm.DB) (*models.Customer, bool) {
+	principal := c.MustGet("principal").(*auth.Principal)
+	query := db
+	if principal.IsTenant() {
+		query = query.Where("id = ?", *principal.CustomerID)
+	}
+	var customer models.Customer
+	if err := query.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return nil, false
+	}
+	return &customer, true
+}
+
+// GetCustomerWallet returns the balance of the wallet of a customer
+// @Summary Get the wallet balance of a customer
+// @Produce json
+// @Tags Wallets
+// @Success 200 {object} object{item=billing.WalletStatus}
+// @Failure 404,500 {object} object{error=string}
+// @Router /customers/{id}/wallet [get]
+func GetCustomerWallet(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	customer, ok := walletCustomer(c, db)
+	if !ok {
+		return
+	}
+	status, err := billing.GetWalletStatus(db, customer.ID, conf.Snapshot().Billing.WalletCreditLimit)
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"item": status})
+}
+
+// ListWalletTransactions list the transactions of the wallet of a customer
+// with their postings
+// @Summary List the wallet transactions of a customer
+// @Produce json
+// @Tags Wallets
+// @Param kind query string false "Kind of transaction"
+// @Success 200 {object} object{items=[]models.WalletTransaction}
+// @Failure 404,500 {object} object{error=string}
+// @Router /customers/{id}/wallet/transactions [get]
+func ListWalletTransactions(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+
+	customer, ok := walletCustomer(c, db)
+	if !ok {
+		return
+	}
+	query := db.Where("customer_id = ?", customer.ID).
+		Preload("Postings", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).
+		Order("id")
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	var transactions []models.WalletTransaction
+	if err := query.Find(&transactions).Error; err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": transactions})
+}
+
+// CreateWalletTransaction tops up, refunds or adjusts the wallet of a
+// customer. A request retried with the same idempotency key returns the
+// transaction already posted.
+// @Summary Post a wallet transaction
+// @Accept json
+// @Produce json
+// @Tags Wallets
+// @Success 200,201 {object} object{item=models.WalletTransaction}
+// @Failure 400,404,409,500 {object} object{error=string}
+// @Router /customers/{id}/wallet/transactions [post]
+func CreateWalletTransaction(c *gin.Context) {
+	db := c.MustGet("db").(*gorm.DB)
+	conf := c.MustGet("config").(*config.Config)
+
+	var customer models.Customer
+	if err := db.First(&customer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+
+	var request walletRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entry := billing.WalletEntry{
+		Kind:           request.Kind,
+		IdempotencyKey: request.IdempotencyKey,
+		Description:    request.Description,
+		Amount:         request.Amount,
+	}
+	if err := entry.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction, created, err := billing.PostWalletEntry(db, customer.ID, entry, conf.Snapshot().Billing.WalletCreditLimit)
+	switch {
+	case errors.Is(err, billing.ErrInsufficientBalance), errors.Is(err, billing.ErrIdempotencyConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		serverError(c, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"item": transaction})
+}
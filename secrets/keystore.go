@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrNotFound is returned for the entries missing from the keystore
+var ErrNotFound = errors.New("secret not found in keystore")
+
+const saltSize = 16
+
+// keystoreFile is the layout of the keystore on disk, the entries are sealed
+// with AES-256-GCM using a key derived from the passphrase and the salt
+type keystoreFile struct {
+	Salt    []byte            `json:"salt"`
+	Entries map[string][]byte `json:"entries"`
+}
+
+// Keystore is a local file of secrets encrypted with a passphrase
+type Keystore struct {
+	path string
+	file keystoreFile
+	aead cipher.AEAD
+}
+
+// OpenKeystore reads the keystore at path, an empty keystore is returned if
+// the file does not exist yet
+func OpenKeystore(path, passphrase string) (*Keystore, error) {
+	if passphrase == "" {
+		return nil, errors.New("the keystore passphrase is empty")
+	}
+	k := &Keystore{path: path}
+
+	content, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		k.file.Salt = make([]byte, saltSize)
+		if _, err := rand.Read(k.file.Salt); err != nil {
+			return nil, err
+		}
+		k.file.Entries = map[string][]byte{}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(content, &k.file); err != nil {
+			return nil, fmt.Errorf("parsing keystore %s: %w", path, err)
+		}
+		if k.file.Entries == nil {
+			k.file.Entries = map[string][]byte{}
+		}
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), k.file.Salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Get decrypts an entry of the keystore
+func (k *Keystore) Get(name string) (string, error) {
+	sealed, exists := k.file.Entries[name]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("keystore entry %s is corrupted", name)
+	}
+	// The name is authenticated so entries cannot be swapped
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("decrypting keystore entry %s, wrong passphrase?", name)
+	}
+	return string(plain), nil
+}
+
+// Set encrypts the value as the entry name, replacing any previous value. The
+// change is only kept once saved.
+func (k *Keystore) Set(name, value string) error {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	k.file.Entries[name] = k.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return nil
+}
+
+// Delete removes the entry name
+func (k *Keystore) Delete(name string) {
+	delete(k.file.Entries, name)
+}
+
+// Names lists the entries of the keystore
+func (k *Keystore) Names() []string {
+	names := make([]string, 0, len(k.file.Entries))
+	for name := range k.file.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save writes the keystore atomically, readable by its owner only
+func (k *Keystore) Save() error {
+	content, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(k.path), ".keystore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(0600); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), k.path)
+}
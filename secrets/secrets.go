@@ -0,0 +1,61 @@
+// Package secrets resolves the secret references of the configuration and
+// manages the local encrypted keystore
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Schemes of the secret references, any other value is used as is
+const (
+	SchemeFile     = "file:"
+	SchemeEnv      = "env:"
+	SchemeKeystore = "keystore:"
+)
+
+// IsReference reports whether the value refers to a secret stored elsewhere
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, SchemeFile) ||
+		strings.HasPrefix(value, SchemeEnv) ||
+		strings.HasPrefix(value, SchemeKeystore)
+}
+
+// Resolve returns the secret the value refers to:
+//
+//	file:/run/secrets/db_password  content of the file, without the trailing newline
+//	env:DB_PASSWORD                value of the environment variable
+//	keystore:db_password           entry of the keystore
+//
+// Values that are not references are returned unchanged. The keystore may be
+// nil when no reference uses it.
+func Resolve(value string, keystore *Keystore) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SchemeFile):
+		return ReadFile(strings.TrimPrefix(value, SchemeFile))
+	case strings.HasPrefix(value, SchemeEnv):
+		name := strings.TrimPrefix(value, SchemeEnv)
+		secret, exists := os.LookupEnv(name)
+		if !exists {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, SchemeKeystore):
+		if keystore == nil {
+			return "", fmt.Errorf("%s needs a keystore, none is configured", value)
+		}
+		return keystore.Get(strings.TrimPrefix(value, SchemeKeystore))
+	default:
+		return value, nil
+	}
+}
+
+// ReadFile reads a secret from a file, as mounted by Docker or Kubernetes
+func ReadFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
@@ -0,0 +1,192 @@
+// Package telemetry exposes the internal metrics of the service in the
+// Prometheus format
+package telemetry
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "billingo"
+
+// Registry holds the internal metrics of the service
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	ProxmoxRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxmox",
+		Name:      "requests_total",
+		Help:      "Requests made to the Proxmox API by cluster, endpoint and result.",
+	}, []string{"cluster", "endpoint", "result"})
+	ProxmoxRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "proxmox",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests made to the Proxmox API by cluster and endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster", "endpoint"})
+	RRDSamples = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "collector",
+		Name:      "rrd_samples_total",
+		Help:      "New RRD samples collected by resource type.",
+	}, []string{"type"})
+	ChangeDrops = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "manager",
+		Name:      "change_drops_total",
+		Help:      "Samples dropped because the change channel was full.",
+	})
+	BufferFileSize = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "buffer",
+		Name:      "file_size_bytes",
+		Help:      "Size of the buffer file waiting to be saved to the database.",
+	})
+	BatchInsertDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "batch_insert_duration_seconds",
+		Help:      "Duration of the batch inserts of buffered samples.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	BatchInsertRows = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "batch_insert_rows_total",
+		Help:      "Rows saved by the batch inserts.",
+	})
+	BatchInsertFailures = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "database",
+		Name:      "batch_insert_failures_total",
+		Help:      "Batch inserts that failed.",
+	})
+	SinkSent = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "sent_batches_total",
+		Help:      "Batches sent to each sink by result.",
+	}, []string{"sink", "result"})
+	SinkRows = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "rows",
+		Help:      "Rows by sink and delivery status, as of the last delivery round.",
+	}, []string{"sink", "status"})
+	SinkDeadLettered = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "sink",
+		Name:      "dead_lettered_rows_total",
+		Help:      "Rows that ran out of delivery attempts, by sink.",
+	}, []string{"sink"})
+	SubscriberSamples = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "subscriber",
+		Name:      "samples_total",
+		Help:      "Samples received by the MQTT subscriber by result: stored, duplicate, rejected or quarantined.",
+	}, []string{"result"})
+	PromotedRows = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "subscriber",
+		Name:      "promoted_rows_total",
+		Help:      "Rows of data_raws promoted into data.",
+	})
+	WalletDebits = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "billing",
+		Name:      "wallet_debits_total",
+		Help:      "Usage transactions posted on the wallets of the prepaid customers.",
+	})
+	WalletsBelowLimit = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "billing",
+		Name:      "wallets_below_limit",
+		Help:      "Wallets of prepaid customers whose balance is below the credit limit.",
+	})
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// changeQueueDepth reports the depth of the change channel of the manager
+// watched last
+var changeQueueDepth atomic.Pointer[func() int]
+
+var (
+	_ = factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "manager",
+		Name:      "change_queue_depth",
+		Help:      "Samples waiting in the change channel.",
+	}, func() float64 {
+		if depth := changeQueueDepth.Load(); depth != nil {
+			return float64((*depth)())
+		}
+		return 0
+	})
+	changeQueueCapacity = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "manager",
+		Name:      "change_queue_capacity",
+		Help:      "Capacity of the change channel.",
+	})
+)
+
+// WatchChangeQueue exposes the depth and capacity of the manager change
+// channel, replacing the channel watched before
+func WatchChangeQueue(depth func() int, capacity int) {
+	changeQueueDepth.Store(&depth)
+	changeQueueCapacity.Set(float64(capacity))
+}
+
+// ObserveDuration records the time elapsed since start in the histogram
+func ObserveDuration(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics of the Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Middleware records the count and latency of the HTTP requests
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	HTTPRequestDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
@@ -1,21 +1,20 @@
 package utils
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"time"
 )
 
-const BaseURL = "https://console.cloudvbox.com/api2/json"
-const AuthToken = "PVEAPIToken=root@pam!vbox=5639e614-5d8e-46e6-93ca-1a57a9238af0"
-
-func FetchJSON(endpoint string) ([]byte, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", BaseURL+endpoint, nil)
+// FetchJSON requests the endpoint of the API at baseURL authenticating with the token
+func FetchJSON(baseURL, token, endpoint string, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	req, err := http.NewRequest("GET", baseURL+endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+AuthToken)
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -23,5 +22,8 @@ func FetchJSON(endpoint string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, endpoint)
+	}
 	return ioutil.ReadAll(resp.Body)
 }